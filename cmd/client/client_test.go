@@ -0,0 +1,29 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/atopos31/go-veilink/internal/config"
+)
+
+func TestTunnelFlags(t *testing.T) {
+	var tunnels []config.ClientTunnel
+	flags := (*tunnelFlags)(&tunnels)
+	for _, value := range []string{"tcp:6000:127.0.0.1:22", "udp:0:[fd00::1]:53"} {
+		if err := flags.Set(value); err != nil {
+			t.Fatalf("%s: %v", value, err)
+		}
+	}
+	want := []config.ClientTunnel{
+		{PublicProtocol: "tcp", PublicPort: 6000, InternalIP: "127.0.0.1", InternalPort: 22},
+		{PublicProtocol: "udp", PublicPort: 0, InternalIP: "fd00::1", InternalPort: 53},
+	}
+	if len(tunnels) != len(want) || tunnels[0] != want[0] || tunnels[1] != want[1] {
+		t.Fatalf("got %+v", tunnels)
+	}
+	for _, value := range []string{"tcp", "tcp:6000", "tcp:70000:127.0.0.1:22", "tcp:6000:127.0.0.1", "tcp:6000:127.0.0.1:ssh"} {
+		if err := flags.Set(value); err == nil {
+			t.Errorf("%s accepted", value)
+		}
+	}
+}
@@ -35,6 +35,9 @@ func main() {
 	handler := handler.NewServerHandler(app)
 	addr := fmt.Sprintf("%s:%d", app.Config().WebUI.IP, app.Config().WebUI.Port)
 	r := webServer(handler)
+	if path, wsHandler := app.WebSocketHandler(); wsHandler != nil {
+		r.GET(path, gin.WrapH(wsHandler))
+	}
 
 	srv := &http.Server{
 		Addr:    addr,
@@ -65,7 +68,7 @@ var htmlFiles embed.FS
 //go:embed web/*.css web/*.ico web/*.js
 var staticFiles embed.FS
 
-func webServer(handler *handler.ServerHandler) http.Handler {
+func webServer(handler *handler.ServerHandler) *gin.Engine {
 	r := gin.Default()
 	htmlFS, err := fs.Sub(htmlFiles, "web")
 	if err != nil {
@@ -100,5 +103,7 @@ func webServer(handler *handler.ServerHandler) http.Handler {
 	clients.POST("/:clientID/tunnels", handler.AddClientTunnel)
 	clients.DELETE("/:clientID/tunnels/:tunnelID", handler.RemoveClientTunnel)
 	clients.PUT("/:clientID/tunnels/:tunnelID", handler.UpdateClientTunnel)
+	clients.GET("/:clientID/tunnels/:tunnelID/stats", handler.GetClientTunnelStats)
+	clients.PUT("/:clientID/tunnels/:tunnelID/cert", handler.SetClientTunnelCert)
 	return r
 }
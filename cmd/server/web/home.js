@@ -79,8 +79,8 @@ function loadTunnels() {
                 const row = document.createElement('tr');
                 row.innerHTML = `
                         <td>${tunnel.public_protocol.toUpperCase()}</td>
-                        <td>${tunnel.public_ip}:${tunnel.public_port}</td>
-                        <td>${tunnel.internal_ip}:${tunnel.internal_port}</td>
+                        <td>${tunnel.public_ip}:${portRange(tunnel.public_port, tunnel.port_count)}</td>
+                        <td>${tunnel.internal_ip}:${portRange(tunnel.internal_port, tunnel.port_count)}</td>
                         <td>
                             <div class="badge ${tunnel.encrypt ? 'badge-success' : 'badge-error'}">
                                 ${tunnel.encrypt ? '是' : '否'}
@@ -162,13 +162,15 @@ function closeTunnelModal() {
     document.getElementById('publicPort').value = '';
     document.getElementById('internalIP').value = '127.0.0.1';
     document.getElementById('internalPort').value = '';
+    document.getElementById('portCount').value = 1;
     document.getElementById('encrypt').checked = false;
     editingTunnelId = null;
 }
 
 function saveTunnel() {
     const clientId = document.getElementById('clientSelect').value;
-    const publicPort = parseInt(document.getElementById('publicPort').value);
+    // 外网端口留空时由服务端从port_ranges中分配
+    const publicPort = parseInt(document.getElementById('publicPort').value) || 0;
     const internalPort = parseInt(document.getElementById('internalPort').value);
 
     const tunnelData = {
@@ -178,6 +180,7 @@ function saveTunnel() {
         public_port: publicPort,
         internal_ip: document.getElementById('internalIP').value,
         internal_port: internalPort,
+        port_count: parseInt(document.getElementById('portCount').value) || 1,
         encrypt: document.getElementById('encrypt').checked
     };
 
@@ -188,7 +191,7 @@ function saveTunnel() {
     }
 
     // 验证端口号
-    if (!publicPort || publicPort < 1 || publicPort > 65535 ||
+    if (publicPort < 0 || publicPort > 65535 ||
         !internalPort || internalPort < 1 || internalPort > 65535) {
         showFeedback(false, '请输入有效的端口(1-65535)');
         return;
@@ -311,6 +314,7 @@ function editTunnel(tunnelId) {
             document.getElementById('publicPort').value = tunnel.public_port;
             document.getElementById('internalIP').value = tunnel.internal_ip;
             document.getElementById('internalPort').value = tunnel.internal_port;
+            document.getElementById('portCount').value = tunnel.port_count || 1;
             document.getElementById('encrypt').checked = tunnel.encrypt;
 
             // 打开模态框
@@ -397,4 +401,9 @@ function copyClientKey() {
             console.error('复制失败:', err);
             showFeedback(false, '复制失败');
         });
-}
\ No newline at end of file
+}
+
+// 端口范围隧道显示为 起始端口-结束端口
+function portRange(port, count) {
+    return count > 1 ? `${port}-${port + count - 1}` : `${port}`;
+}
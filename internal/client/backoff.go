@@ -0,0 +1,50 @@
+package client
+
+import (
+	"math"
+	"math/rand"
+	"time"
+)
+
+// backoff 计算重连等待时间，指数增长并加入随机抖动
+type backoff struct {
+	initial time.Duration
+	max     time.Duration
+	jitter  float64 // 抖动比例，0.2 表示 ±20%
+	attempt int
+}
+
+func newBackoff(initial, max time.Duration, jitter float64) *backoff {
+	if initial <= 0 {
+		initial = time.Second
+	}
+	if max < initial {
+		max = initial
+	}
+	if jitter < 0 {
+		jitter = 0
+	} else if jitter > 1 {
+		jitter = 1
+	}
+	return &backoff{initial: initial, max: max, jitter: jitter}
+}
+
+// Next returns how long to wait before the next reconnect attempt.
+func (b *backoff) Next() time.Duration {
+	d := float64(b.initial) * math.Pow(2, float64(b.attempt))
+	if d >= float64(b.max) {
+		d = float64(b.max)
+	} else {
+		b.attempt++
+	}
+	d += d * b.jitter * (2*rand.Float64() - 1)
+	if d > float64(b.max) {
+		d = float64(b.max)
+	}
+	return time.Duration(d)
+}
+
+// Reset is called once a connection has been established.
+func (b *backoff) Reset() {
+	b.attempt = 0
+}
@@ -0,0 +1,30 @@
+package client
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBackoffGrowsToMax(t *testing.T) {
+	b := newBackoff(time.Second, 10*time.Second, 0)
+	want := []time.Duration{1, 2, 4, 8, 10, 10}
+	for i, w := range want {
+		if got := b.Next(); got != w*time.Second {
+			t.Fatalf("attempt %d: got %v, want %v", i, got, w*time.Second)
+		}
+	}
+	b.Reset()
+	if got := b.Next(); got != time.Second {
+		t.Fatalf("after reset: got %v, want %v", got, time.Second)
+	}
+}
+
+func TestBackoffJitter(t *testing.T) {
+	b := newBackoff(time.Second, time.Minute, 0.5)
+	for i := 0; i < 100; i++ {
+		b.Reset()
+		if got := b.Next(); got < time.Second/2 || got > time.Second*3/2 {
+			t.Fatalf("jittered delay %v out of range", got)
+		}
+	}
+}
@@ -1,9 +1,13 @@
 package client
 
 import (
+	"errors"
 	"fmt"
 	"io"
 	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/atopos31/go-veilink/internal/common"
@@ -12,61 +16,210 @@ import (
 	"github.com/xtaci/smux"
 )
 
+// 拨号内网服务的超时时间，需小于服务端等待状态回复的时间
+const (
+	dialTimeout     = time.Second * 5
+	writeTimeout    = time.Second * 3
+	udpWriteTimeout = time.Second * 3
+)
+
+// 等待握手回复的时间，超时说明服务端可能是不回复握手的旧版本
+const handshakeTimeout = time.Second * 5
+
 type Client struct {
+	conf       config.ClientConfig
 	serverAddr string
+	dialer     transport
+	dialerErr  error
 	clientID   string
 	key        string
+	poolSize   int
+	status     *statusTracker
+	statusAddr string
+	smux       common.SmuxParams
+	tunnels    []common.TunnelSpec // 连接时向服务端注册的隧道
+	proxyAllow common.Allowlist    // socks5隧道允许访问的目标，为空时拒绝所有目标
+	serverCaps atomic.Uint64       // 服务端在握手时声明的功能
+
+	sessionsLock sync.Mutex
+	sessions     []*smux.Session // 当前已连接的会话，反向隧道在其上打开stream
 }
 
 func NewClient(conf config.ClientConfig) *Client {
+	serverAddr := net.JoinHostPort(conf.ServerIp, strconv.Itoa(conf.ServerPort))
+	poolSize := conf.PoolSize
+	if poolSize <= 0 {
+		poolSize = 1
+	}
+	tunnels := make([]common.TunnelSpec, 0, len(conf.Tunnels))
+	for _, t := range conf.Tunnels {
+		tunnels = append(tunnels, common.TunnelSpec{
+			PublicProtocol: t.PublicProtocol,
+			PublicPort:     t.PublicPort,
+			InternalIP:     t.InternalIP,
+			InternalPort:   t.InternalPort,
+			Encrypt:        t.Encrypt,
+		})
+	}
+	proxyAllow, err := common.ParseAllowlist(conf.ProxyAllow)
+	if err != nil {
+		logrus.Errorf("%v, socks5 tunnels will refuse all destinations", err)
+	}
+	dialer, dialerErr := newTransport(conf)
+	status := serverAddr
+	if dialer != nil {
+		status = dialer.String()
+	}
 	return &Client{
-		serverAddr: fmt.Sprintf("%s:%d", conf.ServerIp, conf.ServerPort),
+		conf:       conf,
+		serverAddr: serverAddr,
+		dialer:     dialer,
+		dialerErr:  dialerErr,
 		key:        conf.Key,
 		clientID:   conf.ClientID,
+		poolSize:   poolSize,
+		status:     newStatusTracker(status, conf.ClientID, conf.StatusFile),
+		statusAddr: conf.StatusAddr,
+		smux:       smuxParamsFromConfig(conf.Smux),
+		tunnels:    tunnels,
+		proxyAllow: proxyAllow,
+	}
+}
+
+// smuxParamsFromConfig maps the smux section of the client config, zero fields are left to the server.
+func smuxParamsFromConfig(conf config.Smux) common.SmuxParams {
+	return common.SmuxParams{
+		Version:           conf.Version,
+		KeepAliveInterval: conf.KeepAliveInterval,
+		KeepAliveTimeout:  conf.KeepAliveTimeout,
+		MaxFrameSize:      conf.MaxFrameSize,
+		MaxReceiveBuffer:  conf.MaxReceiveBuffer,
+		MaxStreamBuffer:   conf.MaxStreamBuffer,
 	}
 }
 
-func (c *Client) Run() {
+// Run keeps poolSize sessions connected, reconnecting with backoff on transient errors.
+// It only returns when the server refuses the client for good or a reverse tunnel can not listen.
+func (c *Client) Run() error {
+	if c.dialerErr != nil {
+		return c.dialerErr
+	}
+	if err := c.listenReverse(); err != nil {
+		return err
+	}
+	if c.statusAddr != "" {
+		go func() {
+			if err := c.status.ServeStatus(c.statusAddr); err != nil {
+				logrus.Errorf("status server error: %v", err)
+			}
+		}()
+	}
+	fatal := make(chan error, c.poolSize)
+	for i := 0; i < c.poolSize; i++ {
+		go func() {
+			fatal <- c.keepConnected()
+		}()
+	}
+	err := <-fatal
+	c.status.Stopped(err)
+	return err
+}
+
+// 保持一个与服务端的会话，断开后按退避策略重连，仅在遇到致命错误时返回
+func (c *Client) keepConnected() error {
+	backoff := newBackoff(c.conf.ReconnectInitial, c.conf.ReconnectMax, c.conf.ReconnectJitter)
 	for {
-		err := c.run()
+		err := c.run(backoff)
+		var hsErr *common.HandshakeError
+		if errors.As(err, &hsErr) && hsErr.Fatal() {
+			return err
+		}
 		if err != nil && err != io.EOF {
 			logrus.Errorf("run error: %v", err)
 		}
-		logrus.Warnf("Reconnecting...")
-		time.Sleep(time.Second * 2)
+		wait := backoff.Next()
+		c.status.Failed(err, wait)
+		logrus.Warnf("Reconnecting in %v...", wait.Round(time.Millisecond))
+		time.Sleep(wait)
 	}
 }
 
-func (c *Client) run() error {
-	conn, err := net.Dial("tcp", c.serverAddr)
+func (c *Client) Status() Status {
+	return c.status.Get()
+}
+
+func (c *Client) run(backoff *backoff) error {
+	conn, err := c.dialer.Dial(0)
 	if err != nil {
 		return err
 	}
 	defer conn.Close()
-	handshakeReq := common.HandshakeReq{ClientID: c.clientID}
+	handshakeReq := common.HandshakeReq{
+		ClientID:     c.clientID,
+		Version:      common.ProtocolVersion,
+		Capabilities: common.Capabilities,
+		Smux:         &c.smux,
+		Tunnels:      c.tunnels,
+	}
 	buf, err := handshakeReq.Encode()
 	if err != nil {
 		return err
 	}
 	// 发送 handshake 请求
-	conn.SetWriteDeadline(time.Now().Add(time.Second * 3))
+	conn.SetWriteDeadline(time.Now().Add(writeTimeout))
 	_, err = conn.Write(buf)
 	conn.SetWriteDeadline(time.Time{})
 	if err != nil {
 		return err
 	}
 
-	// 创建 smux
-	smuxconfig := smux.DefaultConfig()
-	smuxconfig.KeepAliveInterval = 1 * time.Second
-	smuxconfig.KeepAliveTimeout = 2 * time.Second
+	// 等待 handshake 回复，协议版本1之前的服务端不回复握手
+	handshakeResp := common.HandshakeResp{}
+	conn.SetReadDeadline(time.Now().Add(handshakeTimeout))
+	err = handshakeResp.Decode(conn)
+	conn.SetReadDeadline(time.Time{})
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return fmt.Errorf("no handshake response within %v, the server may predate protocol version 1 and need an upgrade: %w", handshakeTimeout, err)
+	}
+	if err != nil {
+		return err
+	}
+	if err := handshakeResp.Err(); err != nil {
+		return err
+	}
+	// 服务端版本过低时拒绝，协议版本1的服务端缺少的功能降级不用
+	if err := common.CheckVersion(handshakeResp.Version); err != nil {
+		return &common.HandshakeError{Code: common.HandshakeIncompatible, Msg: fmt.Sprintf("server %v, upgrade the server", err)}
+	}
+	serverCaps := handshakeResp.Capabilities & common.Capabilities
+	if missing := common.Capabilities &^ serverCaps; missing != 0 {
+		logrus.Warnf("server speaks protocol version %d without capabilities %#x, they are disabled", handshakeResp.Version, uint64(missing))
+	}
+	c.serverCaps.Store(uint64(serverCaps))
+	c.logTunnels(handshakeResp.Tunnels)
+
+	// 使用服务端协商后的参数创建 smux
+	smuxParams := c.smux.Merge(common.DefaultSmuxParams())
+	if handshakeResp.Smux != nil {
+		smuxParams = *handshakeResp.Smux
+	}
+	smuxconfig, err := smuxParams.Config()
+	if err != nil {
+		return err
+	}
 	mux, err := smux.Client(conn, smuxconfig)
 	if err != nil {
 		return err
 	}
 	logrus.Debug("Handshake success！")
-	logrus.Debugf("Success connect server: %s", c.serverAddr)
+	logrus.Debugf("Success connect server: %s", c.dialer)
 	defer mux.Close()
+	c.addSession(mux)
+	defer c.removeSession(mux)
+	backoff.Reset()
+	c.status.Connected()
+	defer c.status.Disconnected()
 	for {
 		stream, err := mux.AcceptStream()
 		if err != nil {
@@ -76,10 +229,26 @@ func (c *Client) run() error {
 	}
 }
 
+// 服务端不接受的隧道不影响会话本身，仅记录原因
+func (c *Client) logTunnels(results []common.TunnelResult) {
+	for i, t := range c.tunnels {
+		addr := net.JoinHostPort(t.InternalIP, strconv.Itoa(int(t.InternalPort)))
+		if i >= len(results) {
+			logrus.Warnf("Tunnel %s:%d => %s not registered: server does not support client tunnels", t.PublicProtocol, t.PublicPort, addr)
+			continue
+		}
+		if results[i].Error != "" {
+			logrus.Errorf("Tunnel %s:%d => %s rejected: %s", t.PublicProtocol, t.PublicPort, addr, results[i].Error)
+			continue
+		}
+		logrus.Infof("Tunnel %s:%d => %s registered", t.PublicProtocol, results[i].PublicPort, addr)
+	}
+}
+
 func (c *Client) handleStream(tunnelConn common.VeilConn) {
 	defer tunnelConn.Close()
 	enc := &common.EncryptProtocl{}
-	encryptOn, err := enc.Check(tunnelConn)
+	encryptOn, compression, err := enc.Check(tunnelConn)
 	if err != nil {
 		logrus.Errorf("Check error: %v", err)
 		return
@@ -96,6 +265,13 @@ func (c *Client) handleStream(tunnelConn common.VeilConn) {
 			return
 		}
 	}
+	if compression != common.CompressionNone {
+		tunnelConn, err = common.NewCompressStream(compression, tunnelConn, nil)
+		if err != nil {
+			logrus.Errorf("NewCompressStream error: %v", err)
+			return
+		}
+	}
 
 	vp := &common.VeilinkProtocol{}
 	if err = vp.Decode(tunnelConn); err != nil {
@@ -103,42 +279,82 @@ func (c *Client) handleStream(tunnelConn common.VeilConn) {
 		return
 	}
 
+	if vp.P2P != nil {
+		c.handleP2P(tunnelConn, vp)
+		return
+	}
+
 	var localConn net.Conn
 	switch vp.PublicProtocol {
-	case "tcp":
-		localConn, err = net.Dial("tcp", fmt.Sprintf("%s:%d", vp.InternalIP, vp.InternalPort))
+	case "tcp", "http", "stcp", "socks5":
+		addr := net.JoinHostPort(vp.InternalIP, strconv.Itoa(int(vp.InternalPort)))
+		if vp.PublicProtocol == "socks5" {
+			// 代理请求的目标由服务端转发而来，只允许访问本地配置允许的地址
+			if addr, err = c.proxyAllow.Resolve(vp.Target, dialTimeout); err != nil {
+				logrus.Warnf("Proxy to %s refused: %v", vp.Target, err)
+				c.sendStatus(tunnelConn, err)
+				return
+			}
+		}
+		localConn, err = net.DialTimeout("tcp", addr, dialTimeout)
 		if err != nil {
 			logrus.Errorf("Dial error: %v", err)
+			c.sendStatus(tunnelConn, err)
 			return
 		}
 		defer localConn.Close()
+		if vp.ProxyProtocol != "" {
+			if err := writeProxyHeader(localConn, vp); err != nil {
+				logrus.Errorf("Write proxy header error: %v", err)
+				c.sendStatus(tunnelConn, err)
+				return
+			}
+		}
+		if err := c.sendStatus(tunnelConn, nil); err != nil {
+			logrus.Errorf("Send status error: %v", err)
+			return
+		}
 
 		in, out := common.Join(localConn, tunnelConn)
 		logrus.Infof("in: %d bytes, out: %d bytes", in, out)
 	case "udp":
-		localConn, err = net.Dial("udp", fmt.Sprintf("%s:%d", vp.InternalIP, vp.InternalPort))
+		if vp.UDPMux {
+			if err := c.sendStatus(tunnelConn, nil); err != nil {
+				logrus.Errorf("Send status error: %v", err)
+				return
+			}
+			c.handleUDPMux(tunnelConn, net.JoinHostPort(vp.InternalIP, strconv.Itoa(int(vp.InternalPort))))
+			return
+		}
+		localConn, err = net.DialTimeout("udp", net.JoinHostPort(vp.InternalIP, strconv.Itoa(int(vp.InternalPort))), dialTimeout)
 		if err != nil {
 			logrus.Errorf("Dial error: %v", err)
+			c.sendStatus(tunnelConn, err)
+			return
+		}
+		if err := c.sendStatus(tunnelConn, nil); err != nil {
+			logrus.Errorf("Send status error: %v", err)
+			localConn.Close()
 			return
 		}
 		go func() {
 			defer localConn.Close()
 			defer tunnelConn.Close()
-			buf := make([]byte, 1024*64)
+			writer := common.NewUDPFrameWriter(tunnelConn, udpWriteTimeout)
+			buf := make([]byte, common.MaxUDPPayload+1)
 			for {
 				nr, err := localConn.Read(buf)
 				if err != nil {
-					logrus.Errorf("Decode error: %v", err)
+					if !errors.Is(err, net.ErrClosed) {
+						logrus.Errorf("Read error: %v", err)
+					}
 					break
 				}
-				p := common.UDPpacket(buf[:nr])
-				body, err := p.Encode()
-				if err != nil {
-					logrus.Errorf("Encode error: %v", err)
-					break
+				_, err = writer.WritePacket(buf[:nr])
+				if errors.Is(err, common.ErrDatagramSize) {
+					c.status.DropOversized(nr)
+					continue
 				}
-
-				_, err = tunnelConn.Write(body)
 				if err != nil {
 					logrus.Errorf("Write error: %v", err)
 					break
@@ -146,11 +362,19 @@ func (c *Client) handleStream(tunnelConn common.VeilConn) {
 			}
 		}()
 
+		// stream关闭(服务端回收空闲流)后关闭本地socket，结束上面的读取协程
+		defer localConn.Close()
 		p := common.UDPpacket{}
 		for {
 			err := p.Decode(tunnelConn)
+			if errors.Is(err, common.ErrDatagramSize) {
+				c.status.DropOversized(0)
+				continue
+			}
 			if err != nil {
-				logrus.Errorf("Decode error: %v", err)
+				if err != io.EOF {
+					logrus.Errorf("Decode error: %v", err)
+				}
 				break
 			}
 			_, err = localConn.Write(p)
@@ -161,7 +385,48 @@ func (c *Client) handleStream(tunnelConn common.VeilConn) {
 		}
 	default:
 		logrus.Warnf("Unsupported protocol: %s", vp.PublicProtocol)
+		c.sendStatus(tunnelConn, fmt.Errorf("unsupported protocol: %s", vp.PublicProtocol))
 		return
 	}
 
 }
+
+// 在转发数据前告知内网服务访问者的真实地址
+func writeProxyHeader(localConn net.Conn, vp *common.VeilinkProtocol) error {
+	hdr, err := common.EncodeProxyHeader(vp.ProxyProtocol, vp.RemoteAddr, vp.LocalAddr)
+	if err != nil {
+		return err
+	}
+	localConn.SetWriteDeadline(time.Now().Add(writeTimeout))
+	_, err = localConn.Write(hdr)
+	localConn.SetWriteDeadline(time.Time{})
+	return err
+}
+
+// 告知服务端内网服务的拨号结果，服务端未声明CapStreamStatus时不等待该结果
+func (c *Client) sendStatus(tunnelConn common.VeilConn, dialErr error) error {
+	serverCaps := common.Capability(c.serverCaps.Load())
+	if !serverCaps.Has(common.CapStreamStatus) {
+		return nil
+	}
+	return writeStatus(tunnelConn, dialErr, serverCaps)
+}
+
+// writeStatus replies in the encoding and frame format supported by a peer with the capabilities peerCaps.
+func writeStatus(conn common.VeilConn, dialErr error, peerCaps common.Capability) error {
+	st := &common.StreamStatus{OK: dialErr == nil, Denied: errors.Is(dialErr, common.ErrTargetDenied)}
+	if dialErr != nil {
+		st.Error = dialErr.Error()
+	}
+	conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+	defer conn.SetWriteDeadline(time.Time{})
+	if peerCaps.Has(common.CapBinaryFrames) {
+		return st.WriteBinary(conn, peerCaps.FrameFormat())
+	}
+	buf, err := st.Encode(peerCaps.FrameFormat())
+	if err != nil {
+		return err
+	}
+	_, err = conn.Write(buf)
+	return err
+}
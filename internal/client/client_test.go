@@ -0,0 +1,64 @@
+package client
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/atopos31/go-veilink/internal/common"
+)
+
+func TestHandleStreamProxyHeader(t *testing.T) {
+	for _, version := range []string{common.ProxyProtocolV1, common.ProxyProtocolV2} {
+		t.Run(version, func(t *testing.T) {
+			local, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer local.Close()
+
+			tunnel, server := net.Pipe()
+			defer server.Close()
+			c := &Client{status: newStatusTracker("", "c1", "")}
+			go c.handleStream(tunnel)
+
+			port := local.Addr().(*net.TCPAddr).Port
+			vp := &common.VeilinkProtocol{
+				ClientID:       "c1",
+				PublicProtocol: "tcp",
+				InternalIP:     "127.0.0.1",
+				InternalPort:   uint16(port),
+				ProxyProtocol:  version,
+				RemoteAddr:     "203.0.113.7:52311",
+				LocalAddr:      "198.51.100.1:443",
+			}
+			go func() {
+				server.Write((common.EncryptProtocl{}).Encode(false, common.CompressionNone, common.FrameLong))
+				vp.WriteBinary(server, common.FrameLong)
+				server.Write([]byte("hello"))
+			}()
+
+			conn, err := local.Accept()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+			// 内网服务先收到PROXY协议头，其后才是公网连接的数据
+			reader := bufio.NewReader(conn)
+			src, dst, err := common.ReadProxyHeader(reader)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if src.String() != vp.RemoteAddr || dst.String() != vp.LocalAddr {
+				t.Fatalf("header %v => %v", src, dst)
+			}
+			payload := make([]byte, 5)
+			if _, err := io.ReadFull(reader, payload); err != nil || string(payload) != "hello" {
+				t.Fatalf("payload %q, %v", payload, err)
+			}
+		})
+	}
+}
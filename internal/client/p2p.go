@@ -0,0 +1,101 @@
+package client
+
+import (
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/atopos31/go-veilink/internal/common"
+	"github.com/sirupsen/logrus"
+	"github.com/xtaci/smux"
+)
+
+const (
+	p2pAcceptTimeout = time.Second * 15 // 等待访问者kcp握手的时间
+	p2pProbeDuration = time.Second * 5  // 持续向服务端发送探测包的时间，服务端签发token前的探测包会被丢弃
+)
+
+// sendP2PProbes sends probes to the rendezvous port of the server until done is closed or p2pProbeDuration elapses.
+func sendP2PProbes(conn net.PacketConn, server net.Addr, token string, role byte, done <-chan struct{}) {
+	probe := common.EncodeP2PProbe(token, role)
+	ticker := time.NewTicker(time.Millisecond * 100)
+	defer ticker.Stop()
+	timeout := time.After(p2pProbeDuration)
+	for {
+		conn.WriteTo(probe, server)
+		select {
+		case <-done:
+			return
+		case <-timeout:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// handleP2P punches towards the visitor and serves its streams over kcp,
+// every stream is connected to the internal service of the stcp tunnel.
+func (c *Client) handleP2P(tunnelConn common.VeilConn, vp *common.VeilinkProtocol) {
+	peer, err := net.ResolveUDPAddr("udp", vp.P2P.PeerAddr)
+	if err != nil {
+		c.sendStatus(tunnelConn, err)
+		return
+	}
+	server, err := net.ResolveUDPAddr("udp", c.serverAddr)
+	if err != nil {
+		c.sendStatus(tunnelConn, err)
+		return
+	}
+	udpConn, err := net.ListenUDP("udp", nil)
+	if err != nil {
+		c.sendStatus(tunnelConn, err)
+		return
+	}
+	defer udpConn.Close()
+	if err := c.sendStatus(tunnelConn, nil); err != nil {
+		logrus.Errorf("Send status error: %v", err)
+		return
+	}
+	// 服务端收到探测包后即可关闭该stream，之后的流量都经由打洞后的UDP连接
+	tunnelConn.Close()
+
+	done := make(chan struct{})
+	go sendP2PProbes(udpConn, server, vp.P2P.Token, common.P2PRoleClient, done)
+	go common.P2PPunch(udpConn, peer, p2pAcceptTimeout, done)
+	sess, closeSess, err := common.AcceptP2P(udpConn, vp.P2P.Key, p2pAcceptTimeout)
+	close(done)
+	if err != nil {
+		logrus.Warnf("P2P with visitor %s fail: %v", peer, err)
+		return
+	}
+	defer closeSess()
+
+	target := net.JoinHostPort(vp.InternalIP, strconv.Itoa(int(vp.InternalPort)))
+	logrus.Infof("P2P session with visitor %s established, target %s", peer, target)
+	for {
+		stream, err := sess.AcceptStream()
+		if err != nil {
+			logrus.Infof("P2P session with visitor %s closed: %v", peer, err)
+			return
+		}
+		go c.serveP2PStream(stream, target)
+	}
+}
+
+func (c *Client) serveP2PStream(stream *smux.Stream, target string) {
+	defer stream.Close()
+	localConn, err := net.DialTimeout("tcp", target, dialTimeout)
+	if err != nil {
+		logrus.Errorf("Dial error: %v", err)
+		writeStatus(stream, err, 0)
+		return
+	}
+	defer localConn.Close()
+	// 访问者不经过握手，可能是不支持二进制编码的旧版本，按未声明任何功能回复
+	if err := writeStatus(stream, nil, 0); err != nil {
+		logrus.Errorf("Send status error: %v", err)
+		return
+	}
+	in, out := common.Join(localConn, stream)
+	logrus.Infof("p2p in: %d bytes, out: %d bytes", in, out)
+}
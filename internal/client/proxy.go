@@ -0,0 +1,149 @@
+package client
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+
+	"golang.org/x/net/http/httpproxy"
+	"golang.org/x/net/proxy"
+)
+
+// 经代理连接且未指定超时时，代理握手的超时时间
+const proxyHandshakeTimeout = time.Second * 10
+
+// proxyURL returns the proxy for the target, or nil for a direct connection. Without a configured
+// proxy it follows HTTPS_PROXY/HTTP_PROXY, then ALL_PROXY, excluding the hosts in NO_PROXY.
+func proxyURL(configured string, target *url.URL) (*url.URL, error) {
+	if configured != "" {
+		return url.Parse(configured)
+	}
+	conf := httpproxy.FromEnvironment()
+	all := getEnvAny("ALL_PROXY", "all_proxy")
+	if conf.HTTPSProxy == "" {
+		conf.HTTPSProxy = all
+	}
+	if conf.HTTPProxy == "" {
+		conf.HTTPProxy = all
+	}
+	return conf.ProxyFunc()(target)
+}
+
+func getEnvAny(names ...string) string {
+	for _, name := range names {
+		if val := os.Getenv(name); val != "" {
+			return val
+		}
+	}
+	return ""
+}
+
+// dialProxy connects to addr through the proxy selected for scheme, a zero deadline means no timeout
+// for a direct connection.
+func dialProxy(configured, scheme, addr string, deadline time.Time) (net.Conn, error) {
+	proxyURL, err := proxyURL(configured, &url.URL{Scheme: scheme, Host: addr})
+	if err != nil {
+		return nil, err
+	}
+	if proxyURL == nil {
+		dialer := &net.Dialer{Deadline: deadline}
+		return dialer.Dial("tcp", addr)
+	}
+	if deadline.IsZero() {
+		deadline = time.Now().Add(proxyHandshakeTimeout)
+	}
+	switch proxyURL.Scheme {
+	case "http", "https":
+		return dialConnect(proxyURL, addr, deadline)
+	case "socks5", "socks5h":
+		return dialSOCKS5(proxyURL, addr, deadline)
+	default:
+		return nil, fmt.Errorf("unsupported proxy scheme %q", proxyURL.Scheme)
+	}
+}
+
+// dialSOCKS5 connects to addr through the SOCKS5 proxy, the target host is resolved by the proxy.
+func dialSOCKS5(proxyURL *url.URL, addr string, deadline time.Time) (net.Conn, error) {
+	proxyAddr := proxyURL.Host
+	if proxyURL.Port() == "" {
+		proxyAddr = net.JoinHostPort(proxyURL.Hostname(), "1080")
+	}
+	var auth *proxy.Auth
+	if user := proxyURL.User; user != nil {
+		password, _ := user.Password()
+		auth = &proxy.Auth{User: user.Username(), Password: password}
+	}
+	dialer, err := proxy.SOCKS5("tcp", proxyAddr, auth, &net.Dialer{})
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithDeadline(context.Background(), deadline)
+	defer cancel()
+	conn, err := dialer.(proxy.ContextDialer).DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("socks5 proxy %s: %w", proxyAddr, err)
+	}
+	return conn, nil
+}
+
+// dialConnect opens a tunnel to addr through the HTTP proxy with the CONNECT method.
+func dialConnect(proxyURL *url.URL, addr string, deadline time.Time) (net.Conn, error) {
+	proxyAddr := proxyURL.Host
+	if proxyURL.Port() == "" {
+		port := "80"
+		if proxyURL.Scheme == "https" {
+			port = "443"
+		}
+		proxyAddr = net.JoinHostPort(proxyURL.Hostname(), port)
+	}
+	dialer := &net.Dialer{Deadline: deadline}
+	conn, err := dialer.Dial("tcp", proxyAddr)
+	if err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(deadline)
+	if proxyURL.Scheme == "https" {
+		tlsConn := tls.Client(conn, &tls.Config{ServerName: proxyURL.Hostname()})
+		if err := tlsConn.Handshake(); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		conn = tlsConn
+	}
+
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: make(http.Header),
+	}
+	if user := proxyURL.User; user != nil {
+		password, _ := user.Password()
+		auth := base64.StdEncoding.EncodeToString([]byte(user.Username() + ":" + password))
+		req.Header.Set("Proxy-Authorization", "Basic "+auth)
+	}
+	if err := req.Write(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	// 代理在隧道建立前不会转发服务端的数据，bufio不会多读
+	resp, err := http.ReadResponse(bufio.NewReader(conn), req)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		conn.Close()
+		return nil, fmt.Errorf("proxy %s refused CONNECT: %s", proxyAddr, resp.Status)
+	}
+	conn.SetDeadline(time.Time{})
+	return conn, nil
+}
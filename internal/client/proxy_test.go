@@ -0,0 +1,111 @@
+package client
+
+import (
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestProxyFromEnvironment(t *testing.T) {
+	for _, name := range []string{"HTTPS_PROXY", "https_proxy", "HTTP_PROXY", "http_proxy", "NO_PROXY", "no_proxy", "REQUEST_METHOD"} {
+		t.Setenv(name, "")
+	}
+	t.Setenv("ALL_PROXY", "socks5://proxy.example:1080")
+	t.Setenv("NO_PROXY", "internal.example")
+
+	got, err := proxyURL("", &url.URL{Scheme: "https", Host: "gateway.example:9527"})
+	if err != nil || got == nil || got.String() != "socks5://proxy.example:1080" {
+		t.Fatalf("got %v, %v", got, err)
+	}
+	if got, _ := proxyURL("", &url.URL{Scheme: "https", Host: "internal.example:9527"}); got != nil {
+		t.Fatalf("NO_PROXY ignored: %v", got)
+	}
+	t.Setenv("HTTPS_PROXY", "http://proxy.example:3128")
+	if got, _ := proxyURL("", &url.URL{Scheme: "https", Host: "gateway.example:9527"}); got.String() != "http://proxy.example:3128" {
+		t.Fatalf("HTTPS_PROXY should take precedence: %v", got)
+	}
+	if got, _ := proxyURL("socks5://other:1080", &url.URL{Scheme: "https", Host: "gateway.example:9527"}); got.Host != "other:1080" {
+		t.Fatalf("configured proxy ignored: %v", got)
+	}
+}
+
+// socks5Proxy accepts one connection with username/password authentication and relays it.
+func socks5Proxy(t *testing.T) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		buf := make([]byte, 512)
+		// 方法协商，选择用户名密码认证
+		io.ReadFull(conn, buf[:2])
+		io.ReadFull(conn, buf[:buf[1]])
+		conn.Write([]byte{5, 2})
+		io.ReadFull(conn, buf[:2])
+		user := make([]byte, buf[1])
+		io.ReadFull(conn, user)
+		io.ReadFull(conn, buf[:1])
+		password := make([]byte, buf[0])
+		io.ReadFull(conn, password)
+		if string(user) != "user" || string(password) != "pass" {
+			conn.Write([]byte{1, 1})
+			return
+		}
+		conn.Write([]byte{1, 0})
+		// CONNECT请求，目标为域名
+		io.ReadFull(conn, buf[:5])
+		host := make([]byte, buf[4])
+		io.ReadFull(conn, host)
+		io.ReadFull(conn, buf[:2])
+		port := int(buf[0])<<8 | int(buf[1])
+		upstream, err := net.Dial("tcp", net.JoinHostPort(string(host), strconv.Itoa(port)))
+		if err != nil {
+			conn.Write([]byte{5, 5, 0, 1, 0, 0, 0, 0, 0, 0})
+			return
+		}
+		defer upstream.Close()
+		conn.Write([]byte{5, 0, 0, 1, 0, 0, 0, 0, 0, 0})
+		go io.Copy(upstream, conn)
+		io.Copy(conn, upstream)
+	}()
+	return ln.Addr().String()
+}
+
+func TestTCPThroughSOCKS5(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		io.Copy(conn, conn)
+	}()
+	_, port, _ := net.SplitHostPort(ln.Addr().String())
+
+	tr := &tcpTransport{addr: net.JoinHostPort("localhost", port), proxy: "socks5://user:pass@" + socks5Proxy(t)}
+	conn, err := tr.Dial(time.Second * 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.Write([]byte("veilink"))
+	got := make([]byte, 7)
+	if _, err := io.ReadFull(conn, got); err != nil || string(got) != "veilink" {
+		t.Fatalf("got %q, %v", got, err)
+	}
+}
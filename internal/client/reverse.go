@@ -0,0 +1,150 @@
+package client
+
+import (
+	"errors"
+	"net"
+	"slices"
+	"time"
+
+	"github.com/atopos31/go-veilink/internal/common"
+	"github.com/atopos31/go-veilink/internal/config"
+	"github.com/sirupsen/logrus"
+	"github.com/xtaci/smux"
+)
+
+var (
+	errNotConnected       = errors.New("not connected to server")
+	errReverseUnsupported = errors.New("server does not support reverse tunnels, upgrade the server")
+)
+
+func (c *Client) addSession(mux *smux.Session) {
+	c.sessionsLock.Lock()
+	defer c.sessionsLock.Unlock()
+	c.sessions = append(c.sessions, mux)
+}
+
+func (c *Client) removeSession(mux *smux.Session) {
+	c.sessionsLock.Lock()
+	defer c.sessionsLock.Unlock()
+	c.sessions = slices.DeleteFunc(c.sessions, func(s *smux.Session) bool { return s == mux })
+}
+
+// openStream opens a stream on the session with the fewest streams.
+func (c *Client) openStream() (*smux.Stream, error) {
+	c.sessionsLock.Lock()
+	var picked *smux.Session
+	for _, s := range c.sessions {
+		if !s.IsClosed() && (picked == nil || s.NumStreams() < picked.NumStreams()) {
+			picked = s
+		}
+	}
+	c.sessionsLock.Unlock()
+	if picked == nil {
+		return nil, errNotConnected
+	}
+	return picked.OpenStream()
+}
+
+// listenReverse opens the local ports of the reverse tunnels, all of them or none.
+func (c *Client) listenReverse() error {
+	listeners := make([]net.Listener, 0, len(c.conf.Reverse))
+	for _, r := range c.conf.Reverse {
+		ln, err := net.Listen("tcp", r.BindAddr)
+		if err != nil {
+			for _, opened := range listeners {
+				opened.Close()
+			}
+			return err
+		}
+		listeners = append(listeners, ln)
+	}
+	for i, ln := range listeners {
+		logrus.Infof("Reverse tunnel %s => %s (via server)", ln.Addr(), c.conf.Reverse[i].Target)
+		go c.serveReverse(ln, c.conf.Reverse[i])
+	}
+	return nil
+}
+
+func (c *Client) serveReverse(ln net.Listener, r config.Reverse) {
+	defer ln.Close()
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			logrus.Errorf("Reverse tunnel %s accept error: %v", r.BindAddr, err)
+			return
+		}
+		go c.handleReverse(conn, r.Target)
+	}
+}
+
+func (c *Client) handleReverse(localConn net.Conn, target string) {
+	defer localConn.Close()
+	tunnelConn, err := c.dialReverse(target)
+	if err != nil {
+		logrus.Errorf("Reverse to %s error: %v", target, err)
+		return
+	}
+	defer tunnelConn.Close()
+	in, out := common.Join(localConn, tunnelConn)
+	logrus.Infof("reverse %s in: %d bytes, out: %d bytes", target, in, out)
+}
+
+// dialReverse asks the server to dial target and waits for the result.
+func (c *Client) dialReverse(target string) (common.VeilConn, error) {
+	// 旧版本服务端不接受客户端打开的stream，打开后只会等到超时
+	serverCaps := common.Capability(c.serverCaps.Load())
+	if !serverCaps.Has(common.CapReverse) {
+		return nil, errReverseUnsupported
+	}
+	stream, err := c.openStream()
+	if err != nil {
+		return nil, err
+	}
+	var conn common.VeilConn = stream
+	enc := &common.EncryptProtocl{}
+	stream.SetWriteDeadline(time.Now().Add(writeTimeout))
+	_, err = stream.Write(enc.Encode(c.conf.Encrypt, common.CompressionNone, serverCaps.FrameFormat()))
+	stream.SetWriteDeadline(time.Time{})
+	if err != nil {
+		stream.Close()
+		return nil, err
+	}
+	if c.conf.Encrypt {
+		byteKey, err := common.KeyStringToByte(c.key)
+		if err != nil {
+			stream.Close()
+			return nil, err
+		}
+		if conn, err = common.NewChacha20Stream(byteKey, stream); err != nil {
+			stream.Close()
+			return nil, err
+		}
+	}
+
+	req := &common.ReverseReq{Target: target}
+	buf, err := req.Encode(serverCaps.FrameFormat())
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+	_, err = conn.Write(buf)
+	conn.SetWriteDeadline(time.Time{})
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	st := &common.StreamStatus{}
+	conn.SetReadDeadline(time.Now().Add(time.Second * 10))
+	err = st.Decode(conn)
+	conn.SetReadDeadline(time.Time{})
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if !st.OK {
+		conn.Close()
+		return nil, errors.New(st.Error)
+	}
+	return conn, nil
+}
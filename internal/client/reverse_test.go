@@ -0,0 +1,74 @@
+package client
+
+import (
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/atopos31/go-veilink/internal/common"
+	"github.com/xtaci/smux"
+)
+
+func TestDialReverse(t *testing.T) {
+	serverConn, clientConn := net.Pipe()
+	serverMux, err := smux.Server(serverConn, smux.DefaultConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer serverMux.Close()
+	mux, err := smux.Client(clientConn, smux.DefaultConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mux.Close()
+	// 服务端收到请求后回复拨号成功并回显数据
+	targets := make(chan string, 1)
+	go func() {
+		stream, err := serverMux.AcceptStream()
+		if err != nil {
+			return
+		}
+		defer stream.Close()
+		if _, _, err := (common.EncryptProtocl{}).Check(stream); err != nil {
+			return
+		}
+		req := &common.ReverseReq{}
+		if err := req.Decode(stream); err != nil {
+			return
+		}
+		targets <- req.Target
+		buf, _ := (&common.StreamStatus{OK: true}).Encode(common.FrameLong)
+		stream.Write(buf)
+		io.Copy(stream, stream)
+	}()
+
+	c := &Client{}
+	c.addSession(mux)
+	// 服务端未声明支持反向隧道时不打开stream
+	if _, err := c.dialReverse("10.0.0.5:5432"); !errors.Is(err, errReverseUnsupported) {
+		t.Fatalf("got %v", err)
+	}
+	c.serverCaps.Store(uint64(common.Capabilities))
+	conn, err := c.dialReverse("10.0.0.5:5432")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if got := <-targets; got != "10.0.0.5:5432" {
+		t.Fatalf("target %q", got)
+	}
+	conn.Write([]byte("ping"))
+	buf := make([]byte, 4)
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "ping" {
+		t.Fatalf("got %q, %v", buf, err)
+	}
+
+	// 没有可用会话
+	c.removeSession(mux)
+	if _, err := c.dialReverse("10.0.0.5:5432"); !errors.Is(err, errNotConnected) {
+		t.Fatalf("got %v", err)
+	}
+}
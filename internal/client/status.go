@@ -0,0 +1,147 @@
+package client
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// 客户端连接状态
+const (
+	StateConnecting   = "connecting"
+	StateConnected    = "connected"
+	StateReconnecting = "reconnecting"
+	StateStopped      = "stopped"
+)
+
+// Status 客户端当前状态，可通过本地http接口或状态文件查看
+type Status struct {
+	State       string     `json:"state"`
+	ServerAddr  string     `json:"server_addr"`
+	ClientID    string     `json:"client_id"`
+	Sessions    int        `json:"sessions"` // 当前已连接的会话数
+	ConnectedAt *time.Time `json:"connected_at,omitempty"`
+	LastError   string     `json:"last_error,omitempty"`
+	LastErrorAt *time.Time `json:"last_error_at,omitempty"`
+	Reconnects  int64      `json:"reconnects"`
+	NextRetryAt *time.Time `json:"next_retry_at,omitempty"`
+
+	UDPOversized int64 `json:"udp_oversized,omitempty"` // 因超出长度上限被丢弃的UDP数据包
+}
+
+type statusTracker struct {
+	mu           sync.Mutex
+	status       Status
+	file         string
+	udpOversized atomic.Int64 // 不随状态变化写文件，读取时合入Status
+}
+
+func newStatusTracker(serverAddr, clientID, file string) *statusTracker {
+	return &statusTracker{
+		status: Status{State: StateConnecting, ServerAddr: serverAddr, ClientID: clientID},
+		file:   file,
+	}
+}
+
+func (st *statusTracker) Get() Status {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	status := st.status
+	status.UDPOversized = st.udpOversized.Load()
+	return status
+}
+
+func (st *statusTracker) update(fn func(s *Status)) {
+	st.mu.Lock()
+	fn(&st.status)
+	status := st.status
+	st.mu.Unlock()
+	status.UDPOversized = st.udpOversized.Load()
+	st.writeFile(status)
+}
+
+// DropOversized counts a UDP datagram dropped for exceeding common.MaxUDPPayload.
+func (st *statusTracker) DropOversized(size int) {
+	st.udpOversized.Add(1)
+	if size > 0 {
+		logrus.Warnf("drop oversized udp datagram of %d bytes", size)
+	} else {
+		logrus.Warnf("drop oversized udp datagram")
+	}
+}
+
+func (st *statusTracker) Connected() {
+	st.update(func(s *Status) {
+		now := time.Now()
+		s.State = StateConnected
+		s.Sessions++
+		s.ConnectedAt = &now
+		s.NextRetryAt = nil
+	})
+}
+
+func (st *statusTracker) Disconnected() {
+	st.update(func(s *Status) {
+		s.Sessions--
+	})
+}
+
+func (st *statusTracker) Failed(err error, retryAfter time.Duration) {
+	st.update(func(s *Status) {
+		now := time.Now()
+		next := now.Add(retryAfter)
+		if s.Sessions == 0 {
+			s.State = StateReconnecting
+		}
+		s.Reconnects++
+		s.NextRetryAt = &next
+		if err != nil {
+			s.LastError = err.Error()
+			s.LastErrorAt = &now
+		}
+	})
+}
+
+func (st *statusTracker) Stopped(err error) {
+	st.update(func(s *Status) {
+		now := time.Now()
+		s.State = StateStopped
+		s.NextRetryAt = nil
+		s.LastError = err.Error()
+		s.LastErrorAt = &now
+	})
+}
+
+func (st *statusTracker) writeFile(status Status) {
+	if st.file == "" {
+		return
+	}
+	buf, err := json.MarshalIndent(status, "", "  ")
+	if err != nil {
+		return
+	}
+	// 先写临时文件再重命名，避免读取到写了一半的文件
+	tmp := st.file + ".tmp"
+	if err := os.WriteFile(tmp, buf, 0o644); err != nil {
+		logrus.Warnf("write status file error: %v", err)
+		return
+	}
+	if err := os.Rename(tmp, st.file); err != nil {
+		logrus.Warnf("write status file error: %v", err)
+	}
+}
+
+// ServeStatus exposes the client status as JSON on addr.
+func (st *statusTracker) ServeStatus(addr string) error {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/status", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(st.Get())
+	})
+	return http.ListenAndServe(addr, mux)
+}
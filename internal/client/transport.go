@@ -0,0 +1,81 @@
+package client
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/atopos31/go-veilink/internal/common"
+	"github.com/atopos31/go-veilink/internal/config"
+)
+
+// transport 客户端连接服务端gateway的方式，握手及smux会话在其返回的连接上进行
+type transport interface {
+	// Dial connects to the gateway, timeout 0 means no timeout where the transport allows it.
+	Dial(timeout time.Duration) (net.Conn, error)
+	String() string
+}
+
+// newTransport selects the transport of the client, websocket is used by default when websocket_url is set.
+func newTransport(conf config.ClientConfig) (transport, error) {
+	name := conf.Transport
+	if name == "" {
+		name = "tcp"
+		if conf.WebSocketURL != "" {
+			name = "websocket"
+		}
+	}
+	switch name {
+	case "tcp":
+		return &tcpTransport{addr: net.JoinHostPort(conf.ServerIp, strconv.Itoa(conf.ServerPort)), proxy: conf.Proxy}, nil
+	case "websocket":
+		if conf.WebSocketURL == "" {
+			return nil, errors.New("websocket transport requires websocket_url")
+		}
+		return &wsTransport{url: conf.WebSocketURL, proxy: conf.Proxy}, nil
+	case "kcp":
+		if conf.KCP.Addr == "" {
+			return nil, errors.New("kcp transport requires kcp addr")
+		}
+		if conf.Proxy != "" {
+			return nil, errors.New("kcp transport can not be used through a proxy")
+		}
+		return &kcpTransport{conf: conf.KCP}, nil
+	default:
+		return nil, fmt.Errorf("unsupported transport %q", name)
+	}
+}
+
+// tcpTransport 直接或经HTTP CONNECT、SOCKS5代理连接gateway
+type tcpTransport struct {
+	addr  string
+	proxy string
+}
+
+func (t *tcpTransport) Dial(timeout time.Duration) (net.Conn, error) {
+	var deadline time.Time
+	if timeout > 0 {
+		deadline = time.Now().Add(timeout)
+	}
+	// gateway不是HTTP服务，按https选择代理
+	return dialProxy(t.proxy, "https", t.addr, deadline)
+}
+
+func (t *tcpTransport) String() string {
+	return t.addr
+}
+
+// kcpTransport 经kcp(UDP)连接，丢包较多的线路上比TCP延迟更低
+type kcpTransport struct {
+	conf config.KCP
+}
+
+func (t *kcpTransport) Dial(time.Duration) (net.Conn, error) {
+	return common.DialKCP(t.conf.Addr, t.conf.DataShards, t.conf.ParityShards)
+}
+
+func (t *kcpTransport) String() string {
+	return "kcp://" + t.conf.Addr
+}
@@ -0,0 +1,119 @@
+package client
+
+import (
+	"errors"
+	"io"
+	"net"
+	"sync"
+
+	"github.com/atopos31/go-veilink/internal/common"
+	"github.com/sirupsen/logrus"
+)
+
+// udpMux 处理复用同一个stream的UDP隧道，每个流ID对应一个本地UDP socket
+type udpMux struct {
+	tunnelConn common.VeilConn
+	writer     *common.UDPFrameWriter
+	status     *statusTracker
+	localAddr  string
+	mu         sync.Mutex
+	flows      map[uint32]net.Conn
+}
+
+func (c *Client) handleUDPMux(tunnelConn common.VeilConn, localAddr string) {
+	m := &udpMux{
+		tunnelConn: tunnelConn,
+		writer:     common.NewUDPFrameWriter(tunnelConn, udpWriteTimeout),
+		status:     c.status,
+		localAddr:  localAddr,
+		flows:      make(map[uint32]net.Conn),
+	}
+	defer m.closeAll()
+	// 数据包在下一次解码前已同步写出，整个循环复用同一个缓冲区
+	dg := common.UDPDatagram{}
+	for {
+		err := dg.Decode(tunnelConn)
+		if errors.Is(err, common.ErrDatagramSize) {
+			m.status.DropOversized(0)
+			continue
+		}
+		if err != nil {
+			if !errors.Is(err, io.EOF) {
+				logrus.Errorf("Decode error: %v", err)
+			}
+			return
+		}
+		if dg.Close {
+			m.closeFlow(dg.FlowID)
+			continue
+		}
+		localConn, err := m.flow(dg.FlowID)
+		if err != nil {
+			logrus.Errorf("Dial error: %v", err)
+			m.writer.WriteDatagram(&common.UDPDatagram{FlowID: dg.FlowID, Close: true})
+			continue
+		}
+		if _, err := localConn.Write(dg.Data); err != nil {
+			logrus.Errorf("Write error: %v", err)
+		}
+	}
+}
+
+// flow returns the local socket of the flow, dialing it on the first datagram.
+func (m *udpMux) flow(id uint32) (net.Conn, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if localConn := m.flows[id]; localConn != nil {
+		return localConn, nil
+	}
+	localConn, err := net.DialTimeout("udp", m.localAddr, dialTimeout)
+	if err != nil {
+		return nil, err
+	}
+	m.flows[id] = localConn
+	go m.readLocal(id, localConn)
+	return localConn, nil
+}
+
+func (m *udpMux) readLocal(id uint32, localConn net.Conn) {
+	buf := make([]byte, common.MaxUDPPayload+1)
+	dg := common.UDPDatagram{FlowID: id}
+	for {
+		nr, err := localConn.Read(buf)
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				logrus.Errorf("Read error: %v", err)
+			}
+			return
+		}
+		dg.Data = buf[:nr]
+		_, err = m.writer.WriteDatagram(&dg)
+		if errors.Is(err, common.ErrDatagramSize) {
+			m.status.DropOversized(nr)
+			continue
+		}
+		if err != nil {
+			logrus.Errorf("Write error: %v", err)
+			return
+		}
+	}
+}
+
+func (m *udpMux) closeFlow(id uint32) {
+	m.mu.Lock()
+	localConn := m.flows[id]
+	delete(m.flows, id)
+	m.mu.Unlock()
+	if localConn != nil {
+		localConn.Close()
+	}
+}
+
+func (m *udpMux) closeAll() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for id, localConn := range m.flows {
+		localConn.Close()
+		delete(m.flows, id)
+	}
+}
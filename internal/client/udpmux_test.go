@@ -0,0 +1,89 @@
+package client
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/atopos31/go-veilink/internal/common"
+)
+
+func TestHandleUDPMux(t *testing.T) {
+	// 本地UDP服务回显数据包
+	local, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer local.Close()
+	go func() {
+		buf := make([]byte, 64)
+		for {
+			n, addr, err := local.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			local.WriteTo(buf[:n], addr)
+		}
+	}()
+
+	tunnel, server := net.Pipe()
+	defer server.Close()
+	c := &Client{status: newStatusTracker("", "c1", "")}
+	done := make(chan struct{})
+	go func() {
+		c.handleUDPMux(tunnel, local.LocalAddr().String())
+		close(done)
+	}()
+
+	w := common.NewUDPFrameWriter(server, time.Second)
+	replies := make(chan common.UDPDatagram, 4)
+	go func() {
+		for {
+			dg := common.UDPDatagram{}
+			if err := dg.Decode(server); err != nil {
+				close(replies)
+				return
+			}
+			replies <- dg
+		}
+	}()
+	expect := func(flowID uint32, data string) {
+		t.Helper()
+		select {
+		case dg := <-replies:
+			if dg.FlowID != flowID || string(dg.Data) != data {
+				t.Fatalf("got flow %d %q, want flow %d %q", dg.FlowID, dg.Data, flowID, data)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("no reply for flow %d", flowID)
+		}
+	}
+
+	// 每个流ID使用独立的本地socket，回复带回原来的流ID
+	w.WriteDatagram(&common.UDPDatagram{FlowID: 1, Data: []byte("one")})
+	expect(1, "one")
+	w.WriteDatagram(&common.UDPDatagram{FlowID: 2, Data: []byte("two")})
+	expect(2, "two")
+	w.WriteDatagram(&common.UDPDatagram{FlowID: 1, Close: true})
+	w.WriteDatagram(&common.UDPDatagram{FlowID: 2, Data: []byte("again")})
+	expect(2, "again")
+
+	// 超过负载上限的数据包被丢弃并计数，之后的数据包照常转发
+	oversized := make([]byte, 6+6+common.MaxUDPPayload+1)
+	oversized[1] = 6 // cmdUDPMux
+	binary.BigEndian.PutUint32(oversized[2:6], uint32(6+common.MaxUDPPayload+1))
+	server.Write(oversized)
+	w.WriteDatagram(&common.UDPDatagram{FlowID: 2, Data: []byte("after")})
+	expect(2, "after")
+	if n := c.Status().UDPOversized; n != 1 {
+		t.Fatalf("udp_oversized %d", n)
+	}
+
+	server.Close()
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("mux not closed with its stream")
+	}
+}
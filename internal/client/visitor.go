@@ -0,0 +1,287 @@
+package client
+
+import (
+	"errors"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/atopos31/go-veilink/internal/common"
+	"github.com/atopos31/go-veilink/internal/config"
+	"github.com/google/uuid"
+	"github.com/sirupsen/logrus"
+	"github.com/xtaci/smux"
+)
+
+const (
+	p2pRetryInterval = time.Second * 30 // 打洞失败后改为转发的时长，之后的新连接重新尝试打洞
+	p2pStatusTimeout = time.Second * 10 // 经打洞连接等待目标客户端拨号结果的时间
+	p2pPunchDuration = time.Second * 5
+	p2pDialTimeout   = time.Second * 10 // 等待目标客户端确认kcp会话的时间
+)
+
+// Visitor 在本地监听端口，每个连接经由服务端转发到其他客户端的stcp隧道
+type Visitor struct {
+	conf          config.Visitor
+	serverAddr    string
+	dialer        transport
+	dialerErr     error
+	p2pLock       sync.Mutex
+	p2p           *smux.Session // 与目标客户端打洞建立的会话，所有本地连接复用
+	p2pRetryAt    time.Time
+	p2pConnecting chan struct{} // 打洞进行中时非nil，完成后关闭，其他连接等待而不重复打洞
+}
+
+func NewVisitor(conf config.ClientConfig) *Visitor {
+	dialer, dialerErr := newTransport(conf)
+	return &Visitor{
+		conf:       *conf.Visitor,
+		serverAddr: net.JoinHostPort(conf.ServerIp, strconv.Itoa(conf.ServerPort)),
+		dialer:     dialer,
+		dialerErr:  dialerErr,
+	}
+}
+
+func (v *Visitor) Run() error {
+	if v.dialerErr != nil {
+		return v.dialerErr
+	}
+	ln, err := net.Listen("tcp", v.conf.BindAddr)
+	if err != nil {
+		return err
+	}
+	defer ln.Close()
+	logrus.Infof("Visitor of %s/%s listening on %s", v.conf.ClientID, v.conf.Name, ln.Addr())
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return err
+		}
+		go v.handleConn(conn)
+	}
+}
+
+func (v *Visitor) handleConn(localConn net.Conn) {
+	defer localConn.Close()
+	if v.conf.P2P && v.serveP2P(localConn) {
+		return
+	}
+	serverConn, err := v.dial()
+	if err != nil {
+		logrus.Errorf("Visit %s/%s error: %v", v.conf.ClientID, v.conf.Name, err)
+		return
+	}
+	in, out := common.Join(localConn, serverConn)
+	logrus.Infof("visitor in: %d bytes, out: %d bytes", in, out)
+}
+
+// serveP2P relays the local connection over the p2p session and reports whether it was handled.
+// Connections that can not use p2p are relayed through the server by the caller.
+func (v *Visitor) serveP2P(localConn net.Conn) bool {
+	sess, stream := v.p2pStream()
+	if stream == nil {
+		return false
+	}
+	defer stream.Close()
+	st := &common.StreamStatus{}
+	stream.SetReadDeadline(time.Now().Add(p2pStatusTimeout))
+	err := st.Decode(stream)
+	stream.SetReadDeadline(time.Time{})
+	if err != nil {
+		logrus.Warnf("P2P with %s/%s broken, relay through server: %v", v.conf.ClientID, v.conf.Name, err)
+		v.resetP2P(sess)
+		return false
+	}
+	if !st.OK {
+		logrus.Errorf("Visit %s/%s error: %s", v.conf.ClientID, v.conf.Name, st.Error)
+		return true
+	}
+	in, out := common.Join(localConn, stream)
+	logrus.Infof("p2p visitor in: %d bytes, out: %d bytes", in, out)
+	return true
+}
+
+// p2pStream opens a stream on the p2p session, punching a new one if needed.
+func (v *Visitor) p2pStream() (*smux.Session, *smux.Stream) {
+	sess := v.p2pSession()
+	if sess == nil {
+		return nil, nil
+	}
+	stream, err := sess.OpenStream()
+	if err != nil {
+		v.p2pLock.Lock()
+		sess.Close()
+		if v.p2p == sess {
+			v.p2p = nil
+		}
+		v.p2pLock.Unlock()
+		return nil, nil
+	}
+	return sess, stream
+}
+
+// p2pSession returns the p2p session or nil if p2p is unavailable.
+// Only one caller punches at a time, the others wait for its result without holding the lock.
+func (v *Visitor) p2pSession() *smux.Session {
+	for {
+		v.p2pLock.Lock()
+		if v.p2p != nil && !v.p2p.IsClosed() {
+			sess := v.p2p
+			v.p2pLock.Unlock()
+			return sess
+		}
+		if time.Now().Before(v.p2pRetryAt) {
+			v.p2pLock.Unlock()
+			return nil
+		}
+		if connecting := v.p2pConnecting; connecting != nil {
+			v.p2pLock.Unlock()
+			<-connecting
+			continue
+		}
+		connecting := make(chan struct{})
+		v.p2pConnecting = connecting
+		v.p2pLock.Unlock()
+
+		sess, err := v.connectP2P()
+		v.p2pLock.Lock()
+		if err != nil {
+			logrus.Warnf("P2P with %s/%s unavailable, relay through server: %v", v.conf.ClientID, v.conf.Name, err)
+			v.p2pRetryAt = time.Now().Add(p2pRetryInterval)
+		}
+		v.p2p = sess
+		v.p2pConnecting = nil
+		close(connecting)
+		v.p2pLock.Unlock()
+		return sess
+	}
+}
+
+func (v *Visitor) resetP2P(sess *smux.Session) {
+	v.p2pLock.Lock()
+	defer v.p2pLock.Unlock()
+	sess.Close()
+	if v.p2p == sess {
+		v.p2p = nil
+		v.p2pRetryAt = time.Now().Add(p2pRetryInterval)
+	}
+}
+
+// connectP2P lets the server exchange the UDP addresses of both sides and punches towards the target client.
+func (v *Visitor) connectP2P() (*smux.Session, error) {
+	server, err := net.ResolveUDPAddr("udp", v.serverAddr)
+	if err != nil {
+		return nil, err
+	}
+	udpConn, err := net.ListenUDP("udp", nil)
+	if err != nil {
+		return nil, err
+	}
+	token := uuid.New().String()
+	done := make(chan struct{})
+	go sendP2PProbes(udpConn, server, token, common.P2PRoleVisitor, done)
+	resp, err := v.negotiateP2P(token)
+	close(done)
+	if err != nil {
+		udpConn.Close()
+		return nil, err
+	}
+	peer, err := net.ResolveUDPAddr("udp", resp.PeerAddr)
+	if err != nil {
+		udpConn.Close()
+		return nil, err
+	}
+	go common.P2PPunch(udpConn, peer, p2pPunchDuration, nil)
+	sess, err := common.DialP2P(udpConn, peer, common.P2PKey(v.conf.SecretKey, token), p2pDialTimeout)
+	if err != nil {
+		udpConn.Close()
+		return nil, err
+	}
+	go func() {
+		<-sess.CloseChan()
+		udpConn.Close()
+	}()
+	logrus.Infof("P2P with %s/%s at %s", v.conf.ClientID, v.conf.Name, peer)
+	return sess, nil
+}
+
+func (v *Visitor) negotiateP2P(token string) (*common.P2PResp, error) {
+	req := v.request()
+	req.P2PToken = token
+	conn, err := v.send(req)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	// 服务端需等待双方的探测包及目标客户端的回复
+	resp := &common.P2PResp{}
+	conn.SetReadDeadline(time.Now().Add(time.Second * 25))
+	if err := resp.Decode(conn); err != nil {
+		if errors.Is(err, common.ErrP2PResp) {
+			// 请求被拒绝时服务端回复的是StreamStatus
+			return nil, errors.New("visitor refused")
+		}
+		return nil, err
+	}
+	if resp.Error != "" {
+		return nil, errors.New(resp.Error)
+	}
+	return resp, nil
+}
+
+func (v *Visitor) request() *common.VisitorReq {
+	timestamp := time.Now().Unix()
+	req := &common.VisitorReq{
+		ClientID:  v.conf.ClientID,
+		Name:      v.conf.Name,
+		Timestamp: timestamp,
+		Nonce:     uuid.NewString(),
+	}
+	req.Sign = common.VisitorSign(v.conf.SecretKey, req.ClientID, req.Name, timestamp, req.Nonce)
+	return req
+}
+
+// send connects to the gateway and writes the visitor request.
+func (v *Visitor) send(req *common.VisitorReq) (net.Conn, error) {
+	conn, err := v.dialer.Dial(dialTimeout)
+	if err != nil {
+		return nil, err
+	}
+	buf, err := req.Encode()
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+	_, err = conn.Write(buf)
+	conn.SetWriteDeadline(time.Time{})
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// dial connects to the gateway and waits until the server reached the target service.
+func (v *Visitor) dial() (net.Conn, error) {
+	conn, err := v.send(v.request())
+	if err != nil {
+		return nil, err
+	}
+
+	// 服务端需要等待目标客户端拨号内网服务
+	st := &common.StreamStatus{}
+	conn.SetReadDeadline(time.Now().Add(time.Second * 15))
+	err = st.Decode(conn)
+	conn.SetReadDeadline(time.Time{})
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if !st.OK {
+		conn.Close()
+		return nil, errors.New(st.Error)
+	}
+	return conn, nil
+}
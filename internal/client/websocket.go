@@ -0,0 +1,77 @@
+package client
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/url"
+	"time"
+
+	"golang.org/x/net/websocket"
+)
+
+// 经代理连接及WebSocket握手的总超时时间
+const wsHandshakeTimeout = time.Second * 10
+
+// wsTransport 经WebSocket连接服务端，用于只允许HTTP(S)出站的网络，可经代理连接
+type wsTransport struct {
+	url   string
+	proxy string
+}
+
+func (t *wsTransport) String() string {
+	return t.url
+}
+
+// Dial connects within wsHandshakeTimeout regardless of timeout.
+func (t *wsTransport) Dial(time.Duration) (net.Conn, error) {
+	location, err := url.Parse(t.url)
+	if err != nil {
+		return nil, err
+	}
+	origin := &url.URL{Host: location.Host}
+	switch location.Scheme {
+	case "ws":
+		origin.Scheme = "http"
+	case "wss":
+		origin.Scheme = "https"
+	default:
+		return nil, fmt.Errorf("unsupported websocket scheme %q", location.Scheme)
+	}
+	addr := location.Host
+	if location.Port() == "" {
+		port := "80"
+		if location.Scheme == "wss" {
+			port = "443"
+		}
+		addr = net.JoinHostPort(location.Hostname(), port)
+	}
+
+	deadline := time.Now().Add(wsHandshakeTimeout)
+	conn, err := dialProxy(t.proxy, origin.Scheme, addr, deadline)
+	if err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(deadline)
+	if location.Scheme == "wss" {
+		tlsConn := tls.Client(conn, &tls.Config{ServerName: location.Hostname()})
+		if err := tlsConn.Handshake(); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		conn = tlsConn
+	}
+	wsConfig, err := websocket.NewConfig(t.url, origin.String())
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	ws, err := websocket.NewClient(wsConfig, conn)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	ws.PayloadType = websocket.BinaryFrame
+	return ws, nil
+}
@@ -0,0 +1,79 @@
+package client
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"golang.org/x/net/websocket"
+)
+
+// connectProxy accepts one CONNECT request and relays it to the requested address.
+func connectProxy(t *testing.T) (string, chan string) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	auth := make(chan string, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		req, err := http.ReadRequest(bufio.NewReader(conn))
+		if err != nil || req.Method != http.MethodConnect {
+			return
+		}
+		auth <- req.Header.Get("Proxy-Authorization")
+		upstream, err := net.Dial("tcp", req.Host)
+		if err != nil {
+			return
+		}
+		defer upstream.Close()
+		io.WriteString(conn, "HTTP/1.1 200 Connection established\r\n\r\n")
+		go io.Copy(upstream, conn)
+		io.Copy(conn, upstream)
+	}()
+	return ln.Addr().String(), auth
+}
+
+func TestWebSocketThroughProxy(t *testing.T) {
+	server := httptest.NewServer(websocket.Handler(func(ws *websocket.Conn) {
+		ws.PayloadType = websocket.BinaryFrame
+		io.Copy(ws, ws)
+	}))
+	defer server.Close()
+	proxyAddr, auth := connectProxy(t)
+
+	d := &wsTransport{
+		url:   "ws" + strings.TrimPrefix(server.URL, "http") + "/",
+		proxy: "http://user:pass@" + proxyAddr,
+	}
+	conn, err := d.Dial(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if got := <-auth; got != "Basic dXNlcjpwYXNz" {
+		t.Fatalf("unexpected proxy authorization %q", got)
+	}
+
+	// 流式读取不受WebSocket帧边界影响
+	msg := bytes.Repeat([]byte("veilink"), 10000)
+	go conn.Write(msg)
+	got := make([]byte, len(msg))
+	if _, err := io.ReadFull(conn, got); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, msg) {
+		t.Fatal("echo changed")
+	}
+}
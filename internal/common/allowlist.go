@@ -0,0 +1,125 @@
+package common
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var ErrTargetDenied = errors.New("destination is not allowed")
+
+// allowRule 允许访问的网段及端口范围
+type allowRule struct {
+	network   *net.IPNet
+	low, high uint16
+}
+
+// Allowlist 限制代理类隧道可以拨号的目标，为空时拒绝所有目标
+type Allowlist []allowRule
+
+// ParseAllowlist parses rules such as "10.0.0.0/8", "192.168.1.10:22",
+// "10.0.0.0/8:8000-9000" or "[fd00::/8]:443". Rules without ports allow every port.
+func ParseAllowlist(rules []string) (Allowlist, error) {
+	list := make(Allowlist, 0, len(rules))
+	for _, rule := range rules {
+		r, err := parseAllowRule(strings.TrimSpace(rule))
+		if err != nil {
+			return nil, fmt.Errorf("invalid allow rule %q: %w", rule, err)
+		}
+		list = append(list, r)
+	}
+	return list, nil
+}
+
+func parseAllowRule(rule string) (allowRule, error) {
+	network, ports := rule, ""
+	if strings.HasPrefix(rule, "[") {
+		end := strings.Index(rule, "]")
+		if end < 0 {
+			return allowRule{}, errors.New("missing ]")
+		}
+		network = rule[1:end]
+		if rest := rule[end+1:]; rest != "" {
+			if !strings.HasPrefix(rest, ":") {
+				return allowRule{}, errors.New("expect :port after ]")
+			}
+			ports = rest[1:]
+		}
+	} else if strings.Count(rule, ":") == 1 {
+		network, ports, _ = strings.Cut(rule, ":")
+	}
+
+	r := allowRule{low: 1, high: 65535}
+	if !strings.Contains(network, "/") {
+		ip := net.ParseIP(network)
+		if ip == nil {
+			return allowRule{}, errors.New("invalid ip")
+		}
+		bits := net.IPv6len * 8
+		if ip.To4() != nil {
+			ip, bits = ip.To4(), net.IPv4len*8
+		}
+		r.network = &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}
+	} else {
+		_, ipnet, err := net.ParseCIDR(network)
+		if err != nil {
+			return allowRule{}, err
+		}
+		r.network = ipnet
+	}
+	if ports == "" {
+		return r, nil
+	}
+	lowStr, highStr, found := strings.Cut(ports, "-")
+	if !found {
+		highStr = lowStr
+	}
+	low, err := strconv.ParseUint(lowStr, 10, 16)
+	if err != nil {
+		return allowRule{}, err
+	}
+	high, err := strconv.ParseUint(highStr, 10, 16)
+	if err != nil || high < low || low == 0 {
+		return allowRule{}, errors.New("invalid port range")
+	}
+	r.low, r.high = uint16(low), uint16(high)
+	return r, nil
+}
+
+func (a Allowlist) allow(ip net.IP, port uint16) bool {
+	for _, r := range a {
+		if r.network.Contains(ip) && port >= r.low && port <= r.high {
+			return true
+		}
+	}
+	return false
+}
+
+// Resolve returns the address to dial for the requested target. Host names are resolved
+// here and the checked address is dialed, so DNS can not be used to bypass the allowlist.
+func (a Allowlist) Resolve(target string, timeout time.Duration) (string, error) {
+	host, portStr, err := net.SplitHostPort(target)
+	if err != nil {
+		return "", err
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return "", fmt.Errorf("invalid port %q", portStr)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	ips, err := net.DefaultResolver.LookupIP(ctx, "ip", host)
+	if err != nil {
+		return "", err
+	}
+	for _, ip := range ips {
+		if a.allow(ip, uint16(port)) {
+			return net.JoinHostPort(ip.String(), portStr), nil
+		}
+	}
+	return "", fmt.Errorf("%w: %s", ErrTargetDenied, target)
+}
@@ -0,0 +1,52 @@
+package common
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestAllowlist(t *testing.T) {
+	list, err := ParseAllowlist([]string{"10.0.0.0/8", "192.168.1.10:22", "172.16.0.0/12:8000-9000", "[fd00::/8]:443", "::1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		target string
+		allow  bool
+	}{
+		{"10.1.2.3:80", true},
+		{"192.168.1.10:22", true},
+		{"192.168.1.10:23", false},
+		{"192.168.1.11:22", false},
+		{"172.16.5.5:8500", true},
+		{"172.16.5.5:9001", false},
+		{"[fd00::1]:443", true},
+		{"[fd00::1]:80", false},
+		{"[::1]:22", true},
+		{"8.8.8.8:53", false},
+	}
+	for _, c := range cases {
+		addr, err := list.Resolve(c.target, time.Second)
+		if c.allow && err != nil {
+			t.Errorf("%s: %v", c.target, err)
+		}
+		if !c.allow && !errors.Is(err, ErrTargetDenied) {
+			t.Errorf("%s: expect denied, got %q %v", c.target, addr, err)
+		}
+	}
+}
+
+func TestAllowlistEmpty(t *testing.T) {
+	if _, err := Allowlist(nil).Resolve("127.0.0.1:22", time.Second); !errors.Is(err, ErrTargetDenied) {
+		t.Fatalf("empty allowlist must deny, got %v", err)
+	}
+}
+
+func TestAllowlistInvalid(t *testing.T) {
+	for _, rule := range []string{"10.0.0.0/33", "host.example", "10.0.0.1:0", "10.0.0.1:9-8", "[fd00::1"} {
+		if _, err := ParseAllowlist([]string{rule}); err == nil {
+			t.Errorf("%q parsed", rule)
+		}
+	}
+}
@@ -0,0 +1,117 @@
+package common
+
+import (
+	"bytes"
+	"io"
+	"testing"
+	"time"
+)
+
+// discardConn 丢弃写入的数据，读取时立即返回EOF
+type discardConn struct{}
+
+func (discardConn) Read(p []byte) (int, error)         { return 0, io.EOF }
+func (discardConn) Write(p []byte) (int, error)        { return len(p), nil }
+func (discardConn) Close() error                       { return nil }
+func (discardConn) SetWriteDeadline(t time.Time) error { return nil }
+func (discardConn) SetReadDeadline(t time.Time) error  { return nil }
+
+// BenchmarkStreamSetup measures the control messages exchanged for every public connection:
+// the veilink protocol sent by the server and the dial status replied by the client.
+func BenchmarkStreamSetup(b *testing.B) {
+	vp := &VeilinkProtocol{
+		ClientID:       "client-1",
+		PublicProtocol: "tcp",
+		PublicIP:       "0.0.0.0",
+		PublicPort:     8080,
+		InternalIP:     "127.0.0.1",
+		InternalPort:   80,
+		RemoteAddr:     "203.0.113.7:52311",
+		LocalAddr:      "198.51.100.1:8080",
+	}
+	st := &StreamStatus{OK: true}
+	var reader bytes.Reader
+	b.Run("json", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			buf, err := vp.Encode(FrameLong)
+			if err != nil {
+				b.Fatal(err)
+			}
+			reader.Reset(buf)
+			if err := new(VeilinkProtocol).Decode(&reader); err != nil {
+				b.Fatal(err)
+			}
+			if buf, err = st.Encode(FrameLong); err != nil {
+				b.Fatal(err)
+			}
+			reader.Reset(buf)
+			if err := new(StreamStatus).Decode(&reader); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("binary", func(b *testing.B) {
+		var buf bytes.Buffer
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			buf.Reset()
+			if err := vp.WriteBinary(&buf, FrameLong); err != nil {
+				b.Fatal(err)
+			}
+			if err := new(VeilinkProtocol).Decode(&buf); err != nil {
+				b.Fatal(err)
+			}
+			if err := st.WriteBinary(&buf, FrameLong); err != nil {
+				b.Fatal(err)
+			}
+			if err := new(StreamStatus).Decode(&buf); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+// BenchmarkUDPPacket measures one packet relayed over an exclusive stream, written and read back.
+func BenchmarkUDPPacket(b *testing.B) {
+	payload := bytes.Repeat([]byte{0x5a}, 1200)
+	frame, _ := UDPpacket(payload).Encode()
+	writer := NewUDPFrameWriter(discardConn{}, 0)
+	var reader bytes.Reader
+	pkt := UDPpacket{}
+	b.ReportAllocs()
+	b.SetBytes(int64(len(payload)))
+	for i := 0; i < b.N; i++ {
+		if _, err := writer.WritePacket(payload); err != nil {
+			b.Fatal(err)
+		}
+		reader.Reset(frame)
+		if err := pkt.Decode(&reader); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkChacha20Write(b *testing.B) {
+	key, _ := GenChacha20Key()
+	s, err := NewChacha20Stream(key, discardConn{})
+	if err != nil {
+		b.Fatal(err)
+	}
+	p := make([]byte, 16<<10)
+	b.ReportAllocs()
+	b.SetBytes(int64(len(p)))
+	for i := 0; i < b.N; i++ {
+		if _, err := s.Write(p); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkJoin measures the per connection cost of relaying between two connections.
+func BenchmarkJoin(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		Join(discardConn{}, discardConn{})
+	}
+}
@@ -0,0 +1,264 @@
+package common
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+)
+
+// 二进制编码的控制消息，仅发送给握手时声明CapBinaryFrames的对端
+const (
+	cmdVPBinary     = 0xa
+	cmdStatusBinary = 0xb
+)
+
+const (
+	vpFlagUDPMux = 1 << iota
+	vpFlagP2P
+)
+
+// 旧版本只判断标志是否等于statusFlagOK，拒绝时仍视为失败
+const (
+	statusFlagOK = 1 << iota
+	statusFlagDenied
+)
+
+// stream内的控制消息帧，FrameLong格式的帧头版本为versionLong、帧体长度为uint32
+const (
+	shortFrameHeaderSize = 4 // version(1) cmd(1) length(2)
+	longFrameHeaderSize  = 6 // version(1) cmd(1) length(4)
+	maxStreamFrameBody   = 1 << 20
+)
+
+var ErrBinaryFrame = errors.New("Invalid vp binary frame error")
+
+// AppendBinary appends the binary frame of vp to dst.
+// Strings are length prefixed with a uvarint, ports are big endian uint16.
+func (vp *VeilinkProtocol) AppendBinary(dst []byte, format FrameFormat) ([]byte, error) {
+	dst, start := appendFrameHeader(dst, cmdVPBinary, format)
+	var flags byte
+	if vp.UDPMux {
+		flags |= vpFlagUDPMux
+	}
+	if vp.P2P != nil {
+		flags |= vpFlagP2P
+	}
+	dst = append(dst, flags)
+	dst = appendString(dst, vp.ClientID)
+	dst = appendString(dst, vp.PublicProtocol)
+	dst = appendString(dst, vp.PublicIP)
+	dst = binary.BigEndian.AppendUint16(dst, vp.PublicPort)
+	dst = appendString(dst, vp.InternalIP)
+	dst = binary.BigEndian.AppendUint16(dst, vp.InternalPort)
+	dst = appendString(dst, vp.Target)
+	dst = appendString(dst, vp.ProxyProtocol)
+	dst = appendString(dst, vp.RemoteAddr)
+	dst = appendString(dst, vp.LocalAddr)
+	if vp.P2P != nil {
+		dst = appendString(dst, vp.P2P.Token)
+		dst = appendString(dst, vp.P2P.PeerAddr)
+		dst = binary.AppendUvarint(dst, uint64(len(vp.P2P.Key)))
+		dst = append(dst, vp.P2P.Key...)
+	}
+	return finishFrame(dst, start, format)
+}
+
+// 旧字段之后追加的新字段被旧版本忽略
+func (vp *VeilinkProtocol) decodeBinary(body []byte) error {
+	r := binaryReader{buf: body}
+	flags := r.byte()
+	vp.UDPMux = flags&vpFlagUDPMux != 0
+	vp.ClientID = r.string()
+	vp.PublicProtocol = r.string()
+	vp.PublicIP = r.string()
+	vp.PublicPort = r.uint16()
+	vp.InternalIP = r.string()
+	vp.InternalPort = r.uint16()
+	vp.Target = r.string()
+	vp.ProxyProtocol = r.string()
+	vp.RemoteAddr = r.string()
+	vp.LocalAddr = r.string()
+	if flags&vpFlagP2P != 0 {
+		vp.P2P = &P2PInfo{Token: r.string(), PeerAddr: r.string()}
+		vp.P2P.Key = append([]byte(nil), r.bytes()...)
+	}
+	return r.err
+}
+
+// WriteBinary writes the binary frame of vp with a pooled buffer.
+func (vp *VeilinkProtocol) WriteBinary(w io.Writer, format FrameFormat) error {
+	buf := getFrameBuffer()
+	frame, err := vp.AppendBinary(*buf, format)
+	if err == nil {
+		_, err = w.Write(frame)
+	}
+	putFrameBuffer(buf, frame)
+	return err
+}
+
+// AppendBinary appends the binary frame of st to dst.
+func (st *StreamStatus) AppendBinary(dst []byte, format FrameFormat) ([]byte, error) {
+	dst, start := appendFrameHeader(dst, cmdStatusBinary, format)
+	var flags byte
+	if st.OK {
+		flags |= statusFlagOK
+	}
+	if st.Denied {
+		flags |= statusFlagDenied
+	}
+	dst = append(dst, flags)
+	dst = appendString(dst, st.Error)
+	return finishFrame(dst, start, format)
+}
+
+func (st *StreamStatus) decodeBinary(body []byte) error {
+	r := binaryReader{buf: body}
+	flags := r.byte()
+	st.OK = flags&statusFlagOK != 0
+	st.Denied = flags&statusFlagDenied != 0
+	st.Error = r.string()
+	return r.err
+}
+
+// WriteBinary writes the binary frame of st with a pooled buffer.
+func (st *StreamStatus) WriteBinary(w io.Writer, format FrameFormat) error {
+	buf := getFrameBuffer()
+	frame, err := st.AppendBinary(*buf, format)
+	if err == nil {
+		_, err = w.Write(frame)
+	}
+	putFrameBuffer(buf, frame)
+	return err
+}
+
+// appendFrameHeader appends a header with the length left empty and returns where the body starts.
+func appendFrameHeader(dst []byte, cmd byte, format FrameFormat) ([]byte, int) {
+	if format == FrameLong {
+		dst = append(dst, versionLong, cmd, 0, 0, 0, 0)
+	} else {
+		dst = append(dst, version, cmd, 0, 0)
+	}
+	return dst, len(dst)
+}
+
+func finishFrame(dst []byte, start int, format FrameFormat) ([]byte, error) {
+	bodyLen := len(dst) - start
+	headerSize, maxBody := shortFrameHeaderSize, math.MaxUint16
+	if format == FrameLong {
+		headerSize, maxBody = longFrameHeaderSize, maxStreamFrameBody
+	}
+	if bodyLen > maxBody {
+		return dst[:start-headerSize], fmt.Errorf("%w: %d bytes", ErrFrameTooLarge, bodyLen)
+	}
+	if format == FrameLong {
+		binary.BigEndian.PutUint32(dst[start-4:start], uint32(bodyLen))
+	} else {
+		binary.BigEndian.PutUint16(dst[start-2:start], uint16(bodyLen))
+	}
+	return dst, nil
+}
+
+// encodeStreamFrame encodes v as the JSON body of a stream frame.
+func encodeStreamFrame(cmd byte, v any, format FrameFormat) ([]byte, error) {
+	body, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	dst, start := appendFrameHeader(make([]byte, 0, longFrameHeaderSize+len(body)), cmd, format)
+	return finishFrame(append(dst, body...), start, format)
+}
+
+func appendString(dst []byte, s string) []byte {
+	dst = binary.AppendUvarint(dst, uint64(len(s)))
+	return append(dst, s...)
+}
+
+// readFrame reads the next frame of either format into buf and returns its command and body,
+// the body is only valid until buf is reused.
+func readFrame(reader io.Reader, buf []byte) (byte, []byte, error) {
+	if cap(buf) < longFrameHeaderSize {
+		buf = make([]byte, longFrameHeaderSize)
+	}
+	buf = buf[:longFrameHeaderSize]
+	if _, err := io.ReadFull(reader, buf[:shortFrameHeaderSize]); err != nil {
+		return 0, nil, err
+	}
+	cmd := buf[1]
+	var n uint32
+	switch buf[0] {
+	case version:
+		n = uint32(binary.BigEndian.Uint16(buf[2:shortFrameHeaderSize]))
+	case versionLong:
+		if _, err := io.ReadFull(reader, buf[shortFrameHeaderSize:]); err != nil {
+			return 0, nil, err
+		}
+		n = binary.BigEndian.Uint32(buf[2:longFrameHeaderSize])
+	default:
+		return 0, nil, ErrVersion
+	}
+	if n > maxStreamFrameBody {
+		return 0, nil, fmt.Errorf("%w: %d bytes", ErrFrameTooLarge, n)
+	}
+	bodyLen := int(n)
+	if cap(buf) < bodyLen {
+		buf = make([]byte, bodyLen)
+	}
+	body := buf[:bodyLen]
+	if _, err := io.ReadFull(reader, body); err != nil {
+		return 0, nil, err
+	}
+	return cmd, body, nil
+}
+
+// binaryReader 依次读取二进制帧中的字段，出错后后续读取均返回零值
+type binaryReader struct {
+	buf []byte
+	err error
+}
+
+func (r *binaryReader) next(n int) []byte {
+	if r.err != nil {
+		return nil
+	}
+	if n < 0 || n > len(r.buf) {
+		r.err = ErrBinaryFrame
+		return nil
+	}
+	b := r.buf[:n]
+	r.buf = r.buf[n:]
+	return b
+}
+
+func (r *binaryReader) byte() byte {
+	if b := r.next(1); b != nil {
+		return b[0]
+	}
+	return 0
+}
+
+func (r *binaryReader) uint16() uint16 {
+	if b := r.next(2); b != nil {
+		return binary.BigEndian.Uint16(b)
+	}
+	return 0
+}
+
+func (r *binaryReader) bytes() []byte {
+	if r.err != nil {
+		return nil
+	}
+	n, size := binary.Uvarint(r.buf)
+	if size <= 0 || n > uint64(len(r.buf)-size) {
+		r.err = ErrBinaryFrame
+		return nil
+	}
+	r.buf = r.buf[size:]
+	return r.next(int(n))
+}
+
+func (r *binaryReader) string() string {
+	return string(r.bytes())
+}
@@ -4,17 +4,24 @@ import (
 	"crypto/rand"
 	"encoding/base64"
 	"errors"
+	"fmt"
 	"io"
+	"sync"
 	"time"
 
 	"golang.org/x/crypto/chacha20"
 )
 
+var ErrCipherOutOfSync = errors.New("chacha20 stream broken by a failed write")
+
 type Chacha20Stream struct {
 	key     []byte
 	encoder *chacha20.Cipher
 	decoder *chacha20.Cipher
 	conn    VeilConn
+	writeMu sync.Mutex // 密钥流的推进与写入必须一致，否则并发写入会使对端解密错位
+	// 写入失败或未写完时密钥流已经推进，与对端错位，之后的写入都返回该错误
+	writeErr error
 }
 
 func NewChacha20Stream(key []byte, conn VeilConn) (*Chacha20Stream, error) {
@@ -65,10 +72,34 @@ func (s *Chacha20Stream) Read(p []byte) (int, error) {
 	return n, nil
 }
 
+// Write encrypts p chunk by chunk into a pooled buffer, p itself is left untouched.
+// A failed or short write leaves the keystream ahead of the peer, so the stream
+// can not be written again and every later call returns ErrCipherOutOfSync.
 func (s *Chacha20Stream) Write(p []byte) (int, error) {
-	dst := make([]byte, len(p))
-	s.encoder.XORKeyStream(dst, p)
-	return s.conn.Write(dst)
+	buf := getRelayBuffer()
+	defer putRelayBuffer(buf)
+	dst := *buf
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	if s.writeErr != nil {
+		return 0, s.writeErr
+	}
+	written := 0
+	for len(p) > 0 {
+		chunk := min(len(p), len(dst))
+		s.encoder.XORKeyStream(dst[:chunk], p[:chunk])
+		n, err := s.conn.Write(dst[:chunk])
+		written += n
+		if err == nil && n < chunk {
+			err = io.ErrShortWrite
+		}
+		if err != nil {
+			s.writeErr = fmt.Errorf("%w: %v", ErrCipherOutOfSync, err)
+			return written, err
+		}
+		p = p[chunk:]
+	}
+	return written, nil
 }
 
 func (s *Chacha20Stream) Close() error {
@@ -79,6 +110,10 @@ func (s *Chacha20Stream) SetWriteDeadline(t time.Time) error {
 	return s.conn.SetWriteDeadline(t)
 }
 
+func (s *Chacha20Stream) SetReadDeadline(t time.Time) error {
+	return s.conn.SetReadDeadline(t)
+}
+
 func GenChacha20Key() ([]byte, error) {
 	key := make([]byte, chacha20.KeySize)
 	if _, err := rand.Read(key); err != nil {
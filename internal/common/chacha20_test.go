@@ -1,6 +1,10 @@
 package common
 
-import "testing"
+import (
+	"errors"
+	"io"
+	"testing"
+)
 
 func TestGenKey(t *testing.T) {
 	key, err := GenChacha20Key()
@@ -9,3 +13,28 @@ func TestGenKey(t *testing.T) {
 	}
 	t.Log(KeyByteToString(key))
 }
+
+// shortConn accepts at most limit bytes per Write without reporting an error.
+type shortConn struct {
+	discardConn
+	limit int
+}
+
+func (c shortConn) Write(p []byte) (int, error) {
+	return min(len(p), c.limit), nil
+}
+
+func TestChacha20ShortWrite(t *testing.T) {
+	key, _ := GenChacha20Key()
+	s, err := NewChacha20Stream(key, shortConn{limit: 100})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 密钥流已推进到未写出的部分，继续写入会使对端解密错位
+	if n, err := s.Write(make([]byte, 200)); n != 100 || !errors.Is(err, io.ErrShortWrite) {
+		t.Fatalf("got %d, %v", n, err)
+	}
+	if n, err := s.Write(make([]byte, 10)); n != 0 || !errors.Is(err, ErrCipherOutOfSync) {
+		t.Fatalf("write after short write got %d, %v", n, err)
+	}
+}
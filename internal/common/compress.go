@@ -0,0 +1,231 @@
+package common
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/golang/snappy"
+	"github.com/klauspost/compress/zstd"
+)
+
+// Compression 隧道stream的压缩算法，随加密标志一起发送给客户端
+type Compression byte
+
+const (
+	CompressionNone Compression = iota
+	CompressionSnappy
+	CompressionZstd
+)
+
+// zstd单个stream的窗口大小，限制每个连接占用的内存
+const zstdWindowSize = 1 << 20
+
+// ParseCompression parses the compression setting of a tunnel, empty means no compression.
+func ParseCompression(name string) (Compression, error) {
+	switch name {
+	case "", "none":
+		return CompressionNone, nil
+	case "snappy":
+		return CompressionSnappy, nil
+	case "zstd":
+		return CompressionZstd, nil
+	default:
+		return CompressionNone, fmt.Errorf("unknown compression %q, expect snappy or zstd", name)
+	}
+}
+
+func (c Compression) String() string {
+	switch c {
+	case CompressionNone:
+		return "none"
+	case CompressionSnappy:
+		return "snappy"
+	case CompressionZstd:
+		return "zstd"
+	default:
+		return fmt.Sprintf("compression(%d)", byte(c))
+	}
+}
+
+// CompressStats 压缩前后的字节数，两个方向合计
+type CompressStats struct {
+	raw  atomic.Int64
+	wire atomic.Int64
+}
+
+// Ratio returns raw bytes per compressed byte, 0 before any data is transferred.
+func (s *CompressStats) Ratio() float64 {
+	wire := s.wire.Load()
+	if wire == 0 {
+		return 0
+	}
+	return float64(s.raw.Load()) / float64(wire)
+}
+
+func (s *CompressStats) Raw() int64 {
+	return s.raw.Load()
+}
+
+func (s *CompressStats) Wire() int64 {
+	return s.wire.Load()
+}
+
+func (s *CompressStats) addRaw(n int) {
+	if s != nil {
+		s.raw.Add(int64(n))
+	}
+}
+
+func (s *CompressStats) addWire(n int) {
+	if s != nil {
+		s.wire.Add(int64(n))
+	}
+}
+
+type flushWriter interface {
+	io.WriteCloser
+	Flush() error
+}
+
+// CompressStream 压缩写入的数据，每次写入后立即flush，避免交互式协议的数据滞留在缓冲区
+// 关闭时写入流的结尾并释放编解码器
+type CompressStream struct {
+	compression Compression
+	conn        VeilConn
+	wire        *meteredConn
+	reader      io.Reader // 首次读取时创建，避免创建时阻塞等待对端的数据
+	readMu      sync.Mutex
+	readClosed  bool
+	writer      flushWriter
+	writeMu     sync.Mutex
+	writeClosed bool
+	closeOnce   sync.Once
+	stats       *CompressStats
+}
+
+// NewCompressStream wraps conn with the compression, stats may be nil.
+func NewCompressStream(compression Compression, conn VeilConn, stats *CompressStats) (*CompressStream, error) {
+	wire := &meteredConn{conn: conn, stats: stats}
+	s := &CompressStream{compression: compression, conn: conn, wire: wire, stats: stats}
+	switch compression {
+	case CompressionSnappy:
+		s.writer = snappy.NewBufferedWriter(wire)
+	case CompressionZstd:
+		enc, err := zstd.NewWriter(wire,
+			zstd.WithEncoderConcurrency(1),
+			zstd.WithEncoderLevel(zstd.SpeedFastest),
+			zstd.WithWindowSize(zstdWindowSize))
+		if err != nil {
+			return nil, err
+		}
+		s.writer = enc
+	default:
+		return nil, fmt.Errorf("unsupported compression %v", compression)
+	}
+	return s, nil
+}
+
+func (s *CompressStream) Read(p []byte) (int, error) {
+	s.readMu.Lock()
+	defer s.readMu.Unlock()
+	if s.readClosed {
+		return 0, net.ErrClosed
+	}
+	if s.reader == nil {
+		switch s.compression {
+		case CompressionSnappy:
+			s.reader = snappy.NewReader(s.wire)
+		case CompressionZstd:
+			dec, err := zstd.NewReader(s.wire,
+				zstd.WithDecoderConcurrency(1),
+				zstd.WithDecoderLowmem(true),
+				zstd.WithDecoderMaxWindow(zstdWindowSize))
+			if err != nil {
+				return 0, err
+			}
+			s.reader = dec
+		}
+	}
+	n, err := s.reader.Read(p)
+	s.stats.addRaw(n)
+	return n, err
+}
+
+func (s *CompressStream) Write(p []byte) (int, error) {
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	if s.writeClosed {
+		return 0, net.ErrClosed
+	}
+	n, err := s.writer.Write(p)
+	if err != nil {
+		return n, err
+	}
+	if err := s.writer.Flush(); err != nil {
+		return n, err
+	}
+	s.stats.addRaw(n)
+	return n, nil
+}
+
+// Close ends the compressed stream so the peer reads io.EOF, then closes the conn and releases the codecs.
+func (s *CompressStream) Close() error {
+	var err error
+	s.closeOnce.Do(func() {
+		// 有写入阻塞在conn上时无法写入结尾，关闭conn使其返回后再释放编码器
+		if s.writeMu.TryLock() {
+			s.closeWriter()
+			s.writeMu.Unlock()
+		}
+		err = s.conn.Close()
+		s.writeMu.Lock()
+		s.closeWriter()
+		s.writeMu.Unlock()
+
+		s.readMu.Lock()
+		s.readClosed = true
+		if dec, ok := s.reader.(*zstd.Decoder); ok {
+			dec.Close()
+		}
+		s.readMu.Unlock()
+	})
+	return err
+}
+
+// closeWriter writes the end of the stream, it fails harmlessly once the conn is closed.
+func (s *CompressStream) closeWriter() {
+	if !s.writeClosed {
+		s.writeClosed = true
+		s.writer.Close()
+	}
+}
+
+func (s *CompressStream) SetWriteDeadline(t time.Time) error {
+	return s.conn.SetWriteDeadline(t)
+}
+
+func (s *CompressStream) SetReadDeadline(t time.Time) error {
+	return s.conn.SetReadDeadline(t)
+}
+
+// meteredConn 统计压缩后实际收发的字节数
+type meteredConn struct {
+	conn  VeilConn
+	stats *CompressStats
+}
+
+func (c *meteredConn) Read(p []byte) (int, error) {
+	n, err := c.conn.Read(p)
+	c.stats.addWire(n)
+	return n, err
+}
+
+func (c *meteredConn) Write(p []byte) (int, error) {
+	n, err := c.conn.Write(p)
+	c.stats.addWire(n)
+	return n, err
+}
@@ -0,0 +1,119 @@
+package common
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"testing"
+)
+
+func TestEncryptProtoclCompression(t *testing.T) {
+	enc := EncryptProtocl{}
+	for _, format := range []FrameFormat{FrameShort, FrameLong} {
+		for _, c := range []Compression{CompressionNone, CompressionSnappy, CompressionZstd} {
+			encryptOn, compression, err := enc.Check(bytes.NewReader(enc.Encode(true, c, format)))
+			if err != nil || !encryptOn || compression != c {
+				t.Fatalf("%v: got %v %v %v", c, encryptOn, compression, err)
+			}
+		}
+	}
+	// 协议版本1的标志没有格式版本，其后的数据不会被读走
+	reader := bytes.NewReader([]byte{cmdEncrypt, cmdEncryptOn, 0})
+	if encryptOn, _, err := enc.Check(reader); err != nil || !encryptOn || reader.Len() != 1 {
+		t.Fatalf("legacy flags got %v %v, %d bytes left", encryptOn, err, reader.Len())
+	}
+	if _, _, err := enc.Check(bytes.NewReader([]byte{cmdEncrypt, 0x3})); !errors.Is(err, ErrEncrypt) {
+		t.Fatalf("got %v", err)
+	}
+	if _, _, err := enc.Check(bytes.NewReader([]byte{cmdEncrypt, encryptVersion, 0xf0})); err == nil {
+		t.Fatal("unknown compression accepted")
+	}
+}
+
+func TestCompressStream(t *testing.T) {
+	key, _ := GenChacha20Key()
+	for _, c := range []Compression{CompressionSnappy, CompressionZstd} {
+		t.Run(c.String(), func(t *testing.T) {
+			a, b := tcpPair(t)
+			// 与加密组合时先压缩再加密
+			encA, err := NewChacha20Stream(key, a)
+			if err != nil {
+				t.Fatal(err)
+			}
+			go func() {
+				encB, _ := NewChacha20Stream(key, b)
+				compB, _ := NewCompressStream(c, encB, nil)
+				io.Copy(compB, compB)
+			}()
+			stats := new(CompressStats)
+			compA, err := NewCompressStream(c, encA, stats)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// 小的写入不会滞留在压缩缓冲区中
+			compA.Write([]byte("ping"))
+			got := make([]byte, 4)
+			if _, err := io.ReadFull(compA, got); err != nil || string(got) != "ping" {
+				t.Fatalf("got %q, %v", got, err)
+			}
+
+			msg := bytes.Repeat([]byte("GET /index.html HTTP/1.1\r\nHost: example.com\r\n\r\n"), 2000)
+			go compA.Write(msg)
+			got = make([]byte, len(msg))
+			if _, err := io.ReadFull(compA, got); err != nil || !bytes.Equal(got, msg) {
+				t.Fatalf("echo changed: %v", err)
+			}
+			if stats.Raw() != int64(2*(len(msg)+4)) {
+				t.Fatalf("raw bytes %d", stats.Raw())
+			}
+			if stats.Ratio() < 10 {
+				t.Fatalf("ratio %.2f", stats.Ratio())
+			}
+		})
+	}
+}
+
+func TestCompressStreamClose(t *testing.T) {
+	for _, c := range []Compression{CompressionSnappy, CompressionZstd} {
+		t.Run(c.String(), func(t *testing.T) {
+			a, b := tcpPair(t)
+			compA, _ := NewCompressStream(c, a, nil)
+			compB, _ := NewCompressStream(c, b, nil)
+			defer compB.Close()
+			compA.Write([]byte("bye"))
+			compA.Close()
+			// 关闭时写入了流的结尾，对端读到的是io.EOF而不是ErrUnexpectedEOF
+			got, err := io.ReadAll(compB)
+			if err != nil || string(got) != "bye" {
+				t.Fatalf("got %q, %v", got, err)
+			}
+			if _, err := compA.Read(make([]byte, 1)); !errors.Is(err, net.ErrClosed) {
+				t.Fatalf("read after close: %v", err)
+			}
+		})
+	}
+}
+
+func tcpPair(t *testing.T) (net.Conn, net.Conn) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	a, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		a.Close()
+		b.Close()
+	})
+	return a, b
+}
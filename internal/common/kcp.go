@@ -0,0 +1,60 @@
+package common
+
+import (
+	"net"
+
+	"github.com/xtaci/kcp-go/v5"
+)
+
+// kcp传输的socket缓冲区，避免突发流量在内核中被丢弃
+const kcpSocketBuffer = 4 << 20
+
+// kcp传输不使用kcp-go的BlockCrypt，与tcp传输一样在连接层不加密也不做校验：握手及smux帧头为明文，
+// 隧道数据的机密性由隧道的encrypt（chacha20）提供，需要保护整个连接时请使用wss。
+// 客户端与服务端的BlockCrypt必须一致，改为加密需同时升级两端
+
+// 快速模式：关闭延迟确认及拥塞控制，以带宽换取丢包时更低的延迟
+func tuneKCP(sess *kcp.UDPSession) {
+	sess.SetStreamMode(true)
+	sess.SetWindowSize(1024, 1024)
+	sess.SetNoDelay(1, 10, 2, 1)
+}
+
+// kcpListener 为每个接受的会话应用相同的参数
+type kcpListener struct {
+	*kcp.Listener
+}
+
+func (l *kcpListener) Accept() (net.Conn, error) {
+	sess, err := l.AcceptKCP()
+	if err != nil {
+		return nil, err
+	}
+	tuneKCP(sess)
+	return sess, nil
+}
+
+// ListenKCP listens for clients using the kcp transport. Both sides must use the same FEC shards,
+// 0 disables FEC.
+func ListenKCP(addr string, dataShards, parityShards int) (net.Listener, error) {
+	ln, err := kcp.ListenWithOptions(addr, nil, dataShards, parityShards)
+	if err != nil {
+		return nil, err
+	}
+	ln.SetReadBuffer(kcpSocketBuffer)
+	ln.SetWriteBuffer(kcpSocketBuffer)
+	return &kcpListener{Listener: ln}, nil
+}
+
+// DialKCP connects to the kcp listener of the server. Kcp has no handshake of its own,
+// an unreachable server only shows up when the first read times out.
+func DialKCP(addr string, dataShards, parityShards int) (net.Conn, error) {
+	sess, err := kcp.DialWithOptions(addr, nil, dataShards, parityShards)
+	if err != nil {
+		return nil, err
+	}
+	sess.SetReadBuffer(kcpSocketBuffer)
+	sess.SetWriteBuffer(kcpSocketBuffer)
+	tuneKCP(sess)
+	return sess, nil
+}
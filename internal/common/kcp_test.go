@@ -0,0 +1,56 @@
+package common
+
+import (
+	"bytes"
+	"io"
+	"testing"
+	"time"
+)
+
+func TestKCPLoopback(t *testing.T) {
+	for _, shards := range [][2]int{{0, 0}, {10, 3}} {
+		ln, err := ListenKCP("127.0.0.1:0", shards[0], shards[1])
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer ln.Close()
+		go func() {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+			// 与tcp传输相同，先完成握手再传输数据
+			req := &HandshakeReq{}
+			if err := req.Decode(conn); err != nil {
+				return
+			}
+			buf, _ := (&HandshakeResp{Code: HandshakeOK, Version: ProtocolVersion}).Encode()
+			conn.Write(buf)
+			io.Copy(conn, conn)
+		}()
+
+		conn, err := DialKCP(ln.Addr().String(), shards[0], shards[1])
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		buf, _ := (&HandshakeReq{ClientID: "c1", Version: ProtocolVersion}).Encode()
+		conn.Write(buf)
+		resp := &HandshakeResp{}
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		if err := resp.Decode(conn); err != nil || resp.Err() != nil {
+			t.Fatalf("shards %v: handshake %v, %v", shards, err, resp.Err())
+		}
+		msg := bytes.Repeat([]byte("veilink"), 10000)
+		go conn.Write(msg)
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		got := make([]byte, len(msg))
+		if _, err := io.ReadFull(conn, got); err != nil {
+			t.Fatalf("shards %v: %v", shards, err)
+		}
+		if !bytes.Equal(got, msg) {
+			t.Fatalf("shards %v: echo changed", shards)
+		}
+	}
+}
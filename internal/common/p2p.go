@@ -0,0 +1,171 @@
+package common
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"errors"
+	"io"
+	"net"
+	"time"
+
+	"github.com/xtaci/kcp-go/v5"
+	"github.com/xtaci/smux"
+)
+
+// P2P打洞时发往服务端的探测包，服务端据此得知双方在公网上的地址
+const (
+	p2pProbeMagic = "VLP2"
+	p2pPunchMagic = "VLPH" // 打洞包，短于kcp加密头部，会被对端的kcp直接丢弃
+	p2pHelloMagic = "VLPS" // kcp会话建立后双方往返确认，密钥不一致时收不到
+
+	P2PRoleVisitor = 'v'
+	P2PRoleClient  = 'c'
+)
+
+var ErrP2PTimeout = errors.New("p2p connect timeout")
+
+// P2PInfo 服务端通过VeilinkProtocol告知目标客户端的打洞信息
+type P2PInfo struct {
+	Token    string // 本次打洞的标识
+	PeerAddr string // 服务端观察到的访问者地址
+	Key      []byte // kcp加密密钥，由stcp密钥和Token派生
+}
+
+// P2PKey derives the session key from the stcp secret, so the visitor never receives it over the network.
+func P2PKey(secret string, token string) []byte {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte("p2p\n" + token))
+	return mac.Sum(nil)
+}
+
+// EncodeP2PProbe builds the probe a peer sends to the rendezvous port of the server.
+func EncodeP2PProbe(token string, role byte) []byte {
+	buf := make([]byte, 0, len(p2pProbeMagic)+1+len(token))
+	buf = append(buf, p2pProbeMagic...)
+	buf = append(buf, role)
+	return append(buf, token...)
+}
+
+func DecodeP2PProbe(buf []byte) (token string, role byte, ok bool) {
+	if len(buf) <= len(p2pProbeMagic)+1 || !bytes.HasPrefix(buf, []byte(p2pProbeMagic)) {
+		return "", 0, false
+	}
+	return string(buf[len(p2pProbeMagic)+1:]), buf[len(p2pProbeMagic)], true
+}
+
+// P2PPunch keeps sending punch packets to the peer until done is closed or d elapses,
+// opening the NAT mappings of both sides for the kcp session.
+func P2PPunch(conn net.PacketConn, peer net.Addr, d time.Duration, done <-chan struct{}) {
+	ticker := time.NewTicker(time.Millisecond * 100)
+	defer ticker.Stop()
+	timeout := time.After(d)
+	for {
+		conn.WriteTo([]byte(p2pPunchMagic), peer)
+		select {
+		case <-done:
+			return
+		case <-timeout:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func p2pSmuxConfig() *smux.Config {
+	conf, _ := DefaultSmuxParams().Config()
+	return conf
+}
+
+// p2pHello writes hello to the kcp session and waits for the same magic from the peer,
+// the visitor writes first and the client echoes it back.
+func p2pHello(sess *kcp.UDPSession, timeout time.Duration, writeFirst bool) error {
+	sess.SetDeadline(time.Now().Add(timeout))
+	defer sess.SetDeadline(time.Time{})
+	hello := []byte(p2pHelloMagic)
+	if writeFirst {
+		if _, err := sess.Write(hello); err != nil {
+			return err
+		}
+	}
+	buf := make([]byte, len(hello))
+	if _, err := io.ReadFull(sess, buf); err != nil {
+		var netErr net.Error
+		if errors.As(err, &netErr) && netErr.Timeout() {
+			return ErrP2PTimeout
+		}
+		return err
+	}
+	if !bytes.Equal(buf, hello) {
+		return errors.New("invalid p2p hello")
+	}
+	if !writeFirst {
+		_, err := sess.Write(hello)
+		return err
+	}
+	return nil
+}
+
+// DialP2P starts the visitor side of the P2P session over the punched socket,
+// it fails unless the client answers the hello within timeout.
+func DialP2P(conn net.PacketConn, peer net.Addr, key []byte, timeout time.Duration) (*smux.Session, error) {
+	block, err := kcp.NewAESBlockCrypt(key)
+	if err != nil {
+		return nil, err
+	}
+	sess, err := kcp.NewConn3(0, peer, block, 0, 0, conn)
+	if err != nil {
+		return nil, err
+	}
+	tuneKCP(sess)
+	if err := p2pHello(sess, timeout, true); err != nil {
+		sess.Close()
+		return nil, err
+	}
+	mux, err := smux.Client(sess, p2pSmuxConfig())
+	if err != nil {
+		sess.Close()
+		return nil, err
+	}
+	return mux, nil
+}
+
+// AcceptP2P waits on the punched socket for the visitor holding the same key.
+// The returned close function releases the kcp listener together with the session.
+func AcceptP2P(conn net.PacketConn, key []byte, timeout time.Duration) (*smux.Session, func(), error) {
+	block, err := kcp.NewAESBlockCrypt(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	ln, err := kcp.ServeConn(block, 0, 0, conn)
+	if err != nil {
+		return nil, nil, err
+	}
+	ln.SetDeadline(time.Now().Add(timeout))
+	sess, err := ln.AcceptKCP()
+	if err != nil {
+		ln.Close()
+		var netErr net.Error
+		if errors.As(err, &netErr) && netErr.Timeout() {
+			return nil, nil, ErrP2PTimeout
+		}
+		return nil, nil, err
+	}
+	ln.SetDeadline(time.Time{})
+	tuneKCP(sess)
+	if err := p2pHello(sess, timeout, false); err != nil {
+		sess.Close()
+		ln.Close()
+		return nil, nil, err
+	}
+	mux, err := smux.Server(sess, p2pSmuxConfig())
+	if err != nil {
+		sess.Close()
+		ln.Close()
+		return nil, nil, err
+	}
+	return mux, func() {
+		mux.Close()
+		ln.Close()
+	}, nil
+}
@@ -0,0 +1,96 @@
+package common
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func listenUDP(t *testing.T) net.PacketConn {
+	t.Helper()
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+func TestP2PProbe(t *testing.T) {
+	token, role, ok := DecodeP2PProbe(EncodeP2PProbe("abc", P2PRoleClient))
+	if !ok || token != "abc" || role != P2PRoleClient {
+		t.Fatalf("probe changed: %q %c %v", token, role, ok)
+	}
+	if _, _, ok := DecodeP2PProbe([]byte(p2pPunchMagic)); ok {
+		t.Fatal("punch packet decoded as probe")
+	}
+}
+
+func TestP2PLoopback(t *testing.T) {
+	visitor, client := listenUDP(t), listenUDP(t)
+	key := P2PKey("secret", "token")
+	done := make(chan struct{})
+	defer close(done)
+	go P2PPunch(client, visitor.LocalAddr(), 5*time.Second, done)
+	go P2PPunch(visitor, client.LocalAddr(), 5*time.Second, done)
+
+	accepted := make(chan error, 1)
+	go func() {
+		sess, closeSess, err := AcceptP2P(client, key, 5*time.Second)
+		if err != nil {
+			accepted <- err
+			return
+		}
+		defer closeSess()
+		stream, err := sess.AcceptStream()
+		if err != nil {
+			accepted <- err
+			return
+		}
+		_, err = io.Copy(stream, stream)
+		accepted <- err
+	}()
+
+	sess, err := DialP2P(visitor, client.LocalAddr(), key, 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sess.Close()
+	stream, err := sess.OpenStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := bytes.Repeat([]byte("veilink"), 10000)
+	go stream.Write(msg)
+	stream.SetReadDeadline(time.Now().Add(5 * time.Second))
+	got := make([]byte, len(msg))
+	if _, err := io.ReadFull(stream, got); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, msg) {
+		t.Fatal("echo changed")
+	}
+}
+
+func TestP2PWrongKey(t *testing.T) {
+	visitor, client := listenUDP(t), listenUDP(t)
+	dialed := make(chan error, 1)
+	go func() {
+		sess, err := DialP2P(visitor, client.LocalAddr(), P2PKey("wrong", "token"), time.Second)
+		if err == nil {
+			sess.Close()
+		}
+		dialed <- err
+	}()
+	_, _, err := AcceptP2P(client, P2PKey("secret", "token"), time.Second)
+	if !errors.Is(err, ErrP2PTimeout) {
+		t.Fatalf("expect ErrP2PTimeout, got %v", err)
+	}
+	// 没有收到对端的确认，访问者不能认为打洞成功
+	if err := <-dialed; !errors.Is(err, ErrP2PTimeout) {
+		t.Fatalf("dial expect ErrP2PTimeout, got %v", err)
+	}
+}
@@ -0,0 +1,47 @@
+package common
+
+import "sync"
+
+const (
+	relayBufferSize = 32 << 10 // 与io.Copy默认的缓冲区大小相同
+	frameBufferSize = 2 << 10  // 控制消息及普通UDP数据包都小于该值
+	// 超过该容量的帧缓冲区不放回池中，避免个别大数据包长期占用内存
+	maxPooledFrameBuffer = udpFrameHeaderSize + maxUDPFrameBody
+)
+
+var relayPool = sync.Pool{
+	New: func() any {
+		buf := make([]byte, relayBufferSize)
+		return &buf
+	},
+}
+
+var framePool = sync.Pool{
+	New: func() any {
+		buf := make([]byte, 0, frameBufferSize)
+		return &buf
+	},
+}
+
+// getRelayBuffer returns a buffer of relayBufferSize for copying between connections.
+func getRelayBuffer() *[]byte {
+	return relayPool.Get().(*[]byte)
+}
+
+func putRelayBuffer(buf *[]byte) {
+	relayPool.Put(buf)
+}
+
+// getFrameBuffer returns an empty buffer to append a frame to.
+func getFrameBuffer() *[]byte {
+	return framePool.Get().(*[]byte)
+}
+
+// putFrameBuffer returns buf to the pool, frame is what was appended to it and may have grown.
+func putFrameBuffer(buf *[]byte, frame []byte) {
+	if cap(frame) > maxPooledFrameBuffer {
+		return
+	}
+	*buf = frame[:0]
+	framePool.Put(buf)
+}
@@ -0,0 +1,195 @@
+package common
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+)
+
+// HAProxy PROXY protocol 版本，见 https://www.haproxy.org/download/2.9/doc/proxy-protocol.txt
+const (
+	ProxyProtocolV1 = "v1"
+	ProxyProtocolV2 = "v2"
+)
+
+const (
+	proxyV1MaxLen   = 107
+	proxyV2HdrLen   = 16
+	proxyV2CmdLocal = 0x20
+	proxyV2CmdProxy = 0x21
+	proxyV2TCP4     = 0x11
+	proxyV2TCP6     = 0x21
+	proxyV2Unspec   = 0x00
+)
+
+var (
+	proxyV2Sig = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+	ErrProxyHeader = errors.New("invalid proxy protocol header")
+)
+
+// EncodeProxyHeader builds the PROXY header announcing a TCP connection from src to dst.
+// Addresses that can not be parsed or belong to different families are sent as UNKNOWN.
+func EncodeProxyHeader(version string, src, dst string) ([]byte, error) {
+	srcAddr, srcErr := netip.ParseAddrPort(src)
+	dstAddr, dstErr := netip.ParseAddrPort(dst)
+	known := srcErr == nil && dstErr == nil
+	if known {
+		srcAddr = netip.AddrPortFrom(srcAddr.Addr().Unmap(), srcAddr.Port())
+		dstAddr = netip.AddrPortFrom(dstAddr.Addr().Unmap(), dstAddr.Port())
+		known = srcAddr.Addr().Is4() == dstAddr.Addr().Is4()
+	}
+
+	switch version {
+	case ProxyProtocolV1:
+		if !known {
+			return []byte("PROXY UNKNOWN\r\n"), nil
+		}
+		family := "TCP6"
+		if srcAddr.Addr().Is4() {
+			family = "TCP4"
+		}
+		return []byte(fmt.Sprintf("PROXY %s %s %s %d %d\r\n", family,
+			srcAddr.Addr(), dstAddr.Addr(), srcAddr.Port(), dstAddr.Port())), nil
+	case ProxyProtocolV2:
+		hdr := append([]byte{}, proxyV2Sig...)
+		hdr = append(hdr, proxyV2CmdProxy)
+		var body []byte
+		switch {
+		case !known:
+			hdr = append(hdr, proxyV2Unspec)
+		case srcAddr.Addr().Is4():
+			hdr = append(hdr, proxyV2TCP4)
+			body = append(body, srcAddr.Addr().AsSlice()...)
+			body = append(body, dstAddr.Addr().AsSlice()...)
+		default:
+			hdr = append(hdr, proxyV2TCP6)
+			body = append(body, srcAddr.Addr().AsSlice()...)
+			body = append(body, dstAddr.Addr().AsSlice()...)
+		}
+		if known {
+			body = binary.BigEndian.AppendUint16(body, srcAddr.Port())
+			body = binary.BigEndian.AppendUint16(body, dstAddr.Port())
+		}
+		hdr = binary.BigEndian.AppendUint16(hdr, uint16(len(body)))
+		return append(hdr, body...), nil
+	default:
+		return nil, fmt.Errorf("unknown proxy protocol version %q", version)
+	}
+}
+
+// ReadProxyHeader reads a v1 or v2 PROXY header. The returned addresses are nil for
+// UNKNOWN or LOCAL headers, the caller then keeps the addresses of the connection.
+func ReadProxyHeader(reader *bufio.Reader) (src, dst net.Addr, err error) {
+	// 先检查首字节，不以协议头开始的连接无需等待更多数据
+	first, err := reader.Peek(1)
+	if err != nil {
+		return nil, nil, err
+	}
+	if first[0] != proxyV2Sig[0] && first[0] != 'P' {
+		return nil, nil, ErrProxyHeader
+	}
+	if sig, err := reader.Peek(len(proxyV2Sig)); err == nil && bytes.Equal(sig, proxyV2Sig) {
+		return readProxyV2(reader)
+	}
+	prefix, err := reader.Peek(6)
+	if err != nil {
+		return nil, nil, err
+	}
+	if string(prefix) != "PROXY " {
+		return nil, nil, ErrProxyHeader
+	}
+	return readProxyV1(reader)
+}
+
+func readProxyV1(reader *bufio.Reader) (net.Addr, net.Addr, error) {
+	line := make([]byte, 0, proxyV1MaxLen)
+	for {
+		b, err := reader.ReadByte()
+		if err != nil {
+			return nil, nil, err
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+		if len(line) >= proxyV1MaxLen {
+			return nil, nil, ErrProxyHeader
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, nil, ErrProxyHeader
+	}
+	fields := strings.Fields(string(line[:len(line)-2]))
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, nil, ErrProxyHeader
+	}
+	src, err := parseProxyV1Addr(fields[2], fields[4])
+	if err != nil {
+		return nil, nil, err
+	}
+	dst, err := parseProxyV1Addr(fields[3], fields[5])
+	if err != nil {
+		return nil, nil, err
+	}
+	return src, dst, nil
+}
+
+func parseProxyV1Addr(ip, port string) (net.Addr, error) {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return nil, ErrProxyHeader
+	}
+	p, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return nil, ErrProxyHeader
+	}
+	return net.TCPAddrFromAddrPort(netip.AddrPortFrom(addr, uint16(p))), nil
+}
+
+func readProxyV2(reader *bufio.Reader) (net.Addr, net.Addr, error) {
+	hdr := make([]byte, proxyV2HdrLen)
+	if _, err := io.ReadFull(reader, hdr); err != nil {
+		return nil, nil, err
+	}
+	body := make([]byte, binary.BigEndian.Uint16(hdr[14:16]))
+	if _, err := io.ReadFull(reader, body); err != nil {
+		return nil, nil, err
+	}
+	switch hdr[12] {
+	case proxyV2CmdLocal:
+		return nil, nil, nil
+	case proxyV2CmdProxy:
+	default:
+		return nil, nil, ErrProxyHeader
+	}
+	// 只关心地址部分，其后的TLV忽略
+	var size int
+	switch hdr[13] {
+	case proxyV2TCP4:
+		size = net.IPv4len
+	case proxyV2TCP6:
+		size = net.IPv6len
+	default:
+		return nil, nil, nil
+	}
+	if len(body) < size*2+4 {
+		return nil, nil, ErrProxyHeader
+	}
+	srcIP, _ := netip.AddrFromSlice(body[:size])
+	dstIP, _ := netip.AddrFromSlice(body[size : size*2])
+	srcPort := binary.BigEndian.Uint16(body[size*2:])
+	dstPort := binary.BigEndian.Uint16(body[size*2+2:])
+	return net.TCPAddrFromAddrPort(netip.AddrPortFrom(srcIP, srcPort)),
+		net.TCPAddrFromAddrPort(netip.AddrPortFrom(dstIP, dstPort)), nil
+}
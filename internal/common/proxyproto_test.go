@@ -0,0 +1,65 @@
+package common
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"testing"
+)
+
+func TestProxyHeaderRoundTrip(t *testing.T) {
+	cases := []struct{ src, dst string }{
+		{"203.0.113.7:51000", "10.0.0.1:443"},
+		{"[2001:db8::7]:51000", "[2001:db8::1]:443"},
+		{"[::ffff:203.0.113.7]:51000", "10.0.0.1:443"},
+	}
+	for _, version := range []string{ProxyProtocolV1, ProxyProtocolV2} {
+		for _, c := range cases {
+			hdr, err := EncodeProxyHeader(version, c.src, c.dst)
+			if err != nil {
+				t.Fatal(err)
+			}
+			reader := bufio.NewReader(bytes.NewReader(append(hdr, "payload"...)))
+			src, dst, err := ReadProxyHeader(reader)
+			if err != nil {
+				t.Fatalf("%s %s: %v", version, c.src, err)
+			}
+			want, _ := EncodeProxyHeader(version, src.String(), dst.String())
+			if !bytes.Equal(want, hdr) {
+				t.Fatalf("%s %s: addresses changed: %s %s", version, c.src, src, dst)
+			}
+			rest := make([]byte, 7)
+			if _, err := reader.Read(rest); err != nil || string(rest) != "payload" {
+				t.Fatalf("%s: payload lost: %q %v", version, rest, err)
+			}
+		}
+	}
+}
+
+func TestProxyHeaderV1Text(t *testing.T) {
+	hdr, _ := EncodeProxyHeader(ProxyProtocolV1, "192.168.0.1:56324", "192.168.0.11:443")
+	if string(hdr) != "PROXY TCP4 192.168.0.1 192.168.0.11 56324 443\r\n" {
+		t.Fatalf("unexpected header %q", hdr)
+	}
+	hdr, _ = EncodeProxyHeader(ProxyProtocolV1, "192.168.0.1:56324", "[2001:db8::1]:443")
+	if string(hdr) != "PROXY UNKNOWN\r\n" {
+		t.Fatalf("mixed families must be UNKNOWN, got %q", hdr)
+	}
+}
+
+func TestProxyHeaderUnknown(t *testing.T) {
+	for _, version := range []string{ProxyProtocolV1, ProxyProtocolV2} {
+		hdr, _ := EncodeProxyHeader(version, "", "")
+		src, dst, err := ReadProxyHeader(bufio.NewReader(bytes.NewReader(hdr)))
+		if err != nil || src != nil || dst != nil {
+			t.Fatalf("%s: %v %v %v", version, src, dst, err)
+		}
+	}
+}
+
+func TestProxyHeaderMissing(t *testing.T) {
+	_, _, err := ReadProxyHeader(bufio.NewReader(bytes.NewReader([]byte("GET / HTTP/1.1\r\n\r\n"))))
+	if !errors.Is(err, ErrProxyHeader) {
+		t.Fatalf("expect ErrProxyHeader, got %v", err)
+	}
+}
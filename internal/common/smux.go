@@ -0,0 +1,82 @@
+package common
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/xtaci/smux"
+)
+
+// SmuxParams smux会话参数，零值字段表示沿用服务端的配置
+type SmuxParams struct {
+	Version           int
+	KeepAliveInterval time.Duration
+	KeepAliveTimeout  time.Duration
+	MaxFrameSize      int
+	MaxReceiveBuffer  int
+	MaxStreamBuffer   int
+}
+
+func DefaultSmuxParams() SmuxParams {
+	conf := smux.DefaultConfig()
+	return SmuxParams{
+		Version:           conf.Version,
+		KeepAliveInterval: 1 * time.Second,
+		KeepAliveTimeout:  2 * time.Second,
+		MaxFrameSize:      conf.MaxFrameSize,
+		MaxReceiveBuffer:  conf.MaxReceiveBuffer,
+		MaxStreamBuffer:   conf.MaxStreamBuffer,
+	}
+}
+
+// Merge fills the zero fields of p with the values of def.
+func (p SmuxParams) Merge(def SmuxParams) SmuxParams {
+	if p.Version == 0 {
+		p.Version = def.Version
+	}
+	if p.KeepAliveInterval == 0 {
+		p.KeepAliveInterval = def.KeepAliveInterval
+	}
+	if p.KeepAliveTimeout == 0 {
+		p.KeepAliveTimeout = def.KeepAliveTimeout
+	}
+	if p.MaxFrameSize == 0 {
+		p.MaxFrameSize = def.MaxFrameSize
+	}
+	if p.MaxReceiveBuffer == 0 {
+		p.MaxReceiveBuffer = def.MaxReceiveBuffer
+	}
+	if p.MaxStreamBuffer == 0 {
+		p.MaxStreamBuffer = def.MaxStreamBuffer
+	}
+	return p
+}
+
+func (p SmuxParams) Config() (*smux.Config, error) {
+	conf := smux.DefaultConfig()
+	conf.Version = p.Version
+	conf.KeepAliveInterval = p.KeepAliveInterval
+	conf.KeepAliveTimeout = p.KeepAliveTimeout
+	conf.MaxFrameSize = p.MaxFrameSize
+	conf.MaxReceiveBuffer = p.MaxReceiveBuffer
+	conf.MaxStreamBuffer = p.MaxStreamBuffer
+	if err := smux.VerifyConfig(conf); err != nil {
+		return nil, fmt.Errorf("invalid smux config: %w", err)
+	}
+	return conf, nil
+}
+
+// CheckPeer reports whether a session using p can talk to a peer using peer
+// without either side timing the other out.
+func (p SmuxParams) CheckPeer(peer SmuxParams) error {
+	if p.Version != peer.Version {
+		return fmt.Errorf("smux version mismatch: %d vs %d", p.Version, peer.Version)
+	}
+	if peer.KeepAliveInterval >= p.KeepAliveTimeout {
+		return fmt.Errorf("keepalive interval %v must be less than peer keepalive timeout %v", peer.KeepAliveInterval, p.KeepAliveTimeout)
+	}
+	if p.KeepAliveInterval >= peer.KeepAliveTimeout {
+		return fmt.Errorf("keepalive timeout %v must be greater than peer keepalive interval %v", peer.KeepAliveTimeout, p.KeepAliveInterval)
+	}
+	return nil
+}
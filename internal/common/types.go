@@ -1,94 +1,189 @@
 package common
 
 import (
+	"crypto/hmac"
+	"crypto/sha256"
 	"encoding/binary"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"io"
+	"math"
 )
 
 const (
-	version      = 0
-	cmdVP        = 0x0
-	cmdHandshake = 0x1
-	cmdHandudp   = 0x2
+	version          = 0 // 帧头的格式版本，旧版本只接受0，协议版本改为在握手中协商
+	versionLong      = 1 // 帧体长度为uint32的stream帧，见FrameLong
+	cmdVP            = 0x0
+	cmdHandshake     = 0x1
+	cmdHandudp       = 0x2
+	cmdStatus        = 0x3
+	cmdHandshakeResp = 0x5
+	cmdUDPMux        = 0x6
+	cmdVisitor       = 0x7
+	cmdP2PResp       = 0x8
+	cmdReverse       = 0x9
 )
 
 const (
 	cmdEncrypt   = 0x4
 	cmdEncryptOn = 0x1
 	cmdEncryptOf = 0x0
+	// EncryptProtocl的格式版本，与引入该格式的协议版本相同。
+	// 旧格式第2个字节即为标志，取值不会是2
+	encryptVersion = 0x2
 )
 
 var (
-	ErrVersion   = errors.New("Invalid vp version error")
-	ErrCmd       = errors.New("Invalid vp cmd error")
-	ErrHandshake = errors.New("Invalid vp handshake error")
-	ErrHandudp   = errors.New("Invalid vp Handudp error")
+	ErrVersion       = errors.New("Invalid vp version error")
+	ErrCmd           = errors.New("Invalid vp cmd error")
+	ErrHandshake     = errors.New("Invalid vp handshake error")
+	ErrHandudp       = errors.New("Invalid vp Handudp error")
+	ErrStatus        = errors.New("Invalid vp status error")
+	ErrHandshakeResp = errors.New("Invalid vp handshake response error")
+	ErrUDPMux        = errors.New("Invalid vp udp mux error")
+	ErrDatagramSize  = errors.New("udp datagram too large")
+	ErrVisitor       = errors.New("Invalid vp visitor error")
+	ErrP2PResp       = errors.New("Invalid vp p2p response error")
+	ErrReverse       = errors.New("Invalid vp reverse error")
+	ErrFrameTooLarge = errors.New("vp frame body too large")
 
 	ErrEncrypt = errors.New("Invalid vp Encrypt error")
 )
 
-// VeilinkProtocol Veilink协议
-type VeilinkProtocol struct {
-	ClientID       string // 客户端ID
-	PublicProtocol string // 外网协议
-	PublicIP       string // 外网IP
-	PublicPort     uint16 // 外网端口
-	InternalIP     string // 内网IP
-	InternalPort   uint16 // 内网端口
+// ProtocolVersion 握手时交换的协议版本，协议有不兼容的变化时递增。
+// 版本2起EncryptProtocl带有格式版本，stream内的控制消息帧长度为uint32，见CapLongFrames
+const ProtocolVersion = 2
+
+// MinProtocolVersion 仍能互通的最低协议版本，握手中未声明版本的旧版本视为0。
+// 版本0的客户端不读取握手回复、不回复StreamStatus且UDP帧长度为uint16，无法互通；
+// 版本1的对端不声明CapLongFrames，stream内改用旧的帧格式
+const MinProtocolVersion = 1
+
+// Capability 握手时声明的可选功能，对端不支持的功能降级不用
+type Capability uint64
+
+const (
+	CapCompression  Capability = 1 << iota // 隧道stream压缩，见EncryptProtocl
+	CapBinaryFrames                        // VeilinkProtocol及StreamStatus可使用二进制编码
+	CapStreamStatus                        // 客户端在收到VeilinkProtocol后回复StreamStatus
+	CapReverse                             // 服务端接受客户端为反向隧道打开的stream
+	CapLongFrames                          // stream内的控制消息使用FrameLong格式，协议版本2起支持
+)
+
+// Capabilities 本端支持的所有功能
+const Capabilities = CapCompression | CapBinaryFrames | CapStreamStatus | CapReverse | CapLongFrames
+
+func (c Capability) Has(flag Capability) bool {
+	return c&flag == flag
 }
 
-func (vp *VeilinkProtocol) Encode() ([]byte, error) {
-	header := make([]byte, 4)
-	header[0] = version
-	header[1] = cmdVP
+// FrameFormat stream内控制消息的帧格式，读取时两种格式都接受
+type FrameFormat byte
+
+const (
+	FrameShort FrameFormat = iota // 协议版本1：帧体长度为uint16，EncryptProtocl没有格式版本
+	FrameLong                     // 协议版本2：帧体长度为uint32，EncryptProtocl带格式版本
+)
+
+// FrameFormat returns the frame format to write to a peer with the capabilities c.
+func (c Capability) FrameFormat() FrameFormat {
+	if c.Has(CapLongFrames) {
+		return FrameLong
+	}
+	return FrameShort
+}
 
-	body, err := json.Marshal(vp)
+// CheckVersion returns an error when the peer speaks a protocol version this side can not talk to.
+func CheckVersion(peer int) error {
+	if peer < MinProtocolVersion {
+		return fmt.Errorf("protocol version %d is older than the minimum supported version %d", peer, MinProtocolVersion)
+	}
+	return nil
+}
+
+// encodeFrame encodes v as the JSON body of a frame, the body length must fit in the uint16 of the header.
+// The handshake keeps this header so that peers of any version can read it.
+func encodeFrame(cmd byte, v any) ([]byte, error) {
+	body, err := json.Marshal(v)
 	if err != nil {
 		return nil, err
 	}
+	if len(body) > math.MaxUint16 {
+		return nil, fmt.Errorf("%w: %d bytes", ErrFrameTooLarge, len(body))
+	}
+	hdr := make([]byte, 4, 4+len(body))
+	hdr[0] = version
+	hdr[1] = cmd
+	binary.BigEndian.PutUint16(hdr[2:4], uint16(len(body)))
+	return append(hdr, body...), nil
+}
 
-	binary.BigEndian.PutUint16(header[2:4], uint16(len(body)))
-	return append(header, body...), nil
+// VeilinkProtocol Veilink协议
+type VeilinkProtocol struct {
+	ClientID       string   // 客户端ID
+	PublicProtocol string   // 外网协议
+	PublicIP       string   // 外网IP
+	PublicPort     uint16   // 外网端口
+	InternalIP     string   // 内网IP
+	InternalPort   uint16   // 内网端口
+	UDPMux         bool     `json:",omitempty"` // UDP流复用同一个stream，数据包使用UDPDatagram封装
+	P2P            *P2PInfo `json:",omitempty"` // 非空时客户端不拨号内网服务，而是与访问者打洞
+	Target         string   `json:",omitempty"` // socks5隧道中代理请求的目标地址，host:port
+	ProxyProtocol  string   `json:",omitempty"` // 非空时客户端向内网服务先发送该版本的PROXY协议头
+	RemoteAddr     string   `json:",omitempty"` // 公网连接的来源地址
+	LocalAddr      string   `json:",omitempty"` // 公网连接的目的地址
+}
+
+func (vp *VeilinkProtocol) Encode(format FrameFormat) ([]byte, error) {
+	return encodeStreamFrame(cmdVP, vp, format)
 }
 
+// Decode reads a veilink protocol in either the JSON or the binary encoding.
 func (vp *VeilinkProtocol) Decode(reader io.Reader) error {
-	header := make([]byte, 4)
-	if _, err := io.ReadFull(reader, header); err != nil {
+	buf := getFrameBuffer()
+	defer putFrameBuffer(buf, *buf)
+	cmd, body, err := readFrame(reader, *buf)
+	if err != nil {
 		return err
 	}
-	if header[0] != version {
-		return ErrVersion
-	}
-	if header[1] != cmdVP {
+	switch cmd {
+	case cmdVP:
+		return json.Unmarshal(body, vp)
+	case cmdVPBinary:
+		return vp.decodeBinary(body)
+	default:
 		return ErrCmd
 	}
-
-	bodyLen := binary.BigEndian.Uint16(header[2:4])
-	body := make([]byte, bodyLen)
-	if _, err := io.ReadFull(reader, body); err != nil {
-		return err
-	}
-	return json.Unmarshal(body, vp)
 }
 
 type HandshakeReq struct {
-	ClientID string
+	ClientID     string
+	Version      int          `json:",omitempty"` // 客户端的协议版本
+	Capabilities Capability   `json:",omitempty"` // 客户端支持的可选功能
+	Smux         *SmuxParams  `json:",omitempty"` // 客户端期望的smux参数
+	Tunnels      []TunnelSpec `json:",omitempty"` // 客户端声明的隧道
 }
 
-func (req *HandshakeReq) Encode() ([]byte, error) {
-	hdr := make([]byte, 4)
-	hdr[0] = version
-	hdr[1] = cmdHandshake
+// TunnelSpec 客户端声明的隧道，服务端按该客户端的策略创建临时监听，会话全部断开后移除
+type TunnelSpec struct {
+	PublicProtocol string
+	PublicPort     uint16
+	InternalIP     string
+	InternalPort   uint16
+	Encrypt        bool `json:",omitempty"`
+}
 
-	body, err := json.Marshal(req)
-	if err != nil {
-		return nil, err
-	}
+// TunnelResult 客户端声明的隧道的创建结果，与请求中的TunnelSpec一一对应
+type TunnelResult struct {
+	TunnelID   string `json:",omitempty"`
+	PublicPort uint16 `json:",omitempty"` // 实际监听的外网端口，声明为0时由服务端分配
+	Error      string `json:",omitempty"`
+}
 
-	binary.BigEndian.PutUint16(hdr[2:4], uint16(len(body)))
-	return append(hdr, body...), nil
+func (req *HandshakeReq) Encode() ([]byte, error) {
+	return encodeFrame(cmdHandshake, req)
 }
 
 func (req *HandshakeReq) Decode(reader io.Reader) error {
@@ -119,74 +214,236 @@ func (req *HandshakeReq) Decode(reader io.Reader) error {
 	return nil
 }
 
-type UDPpacket []byte
+// VisitorReq 访问者连接gateway后发送的请求，用于访问不对外开放端口的stcp隧道
+type VisitorReq struct {
+	ClientID  string // 隧道所属的客户端
+	Name      string // 隧道名称
+	Timestamp int64
+	Nonce     string // 每个请求随机生成，服务端在签名有效期内拒绝重复的nonce
+	Sign      string // VisitorSign(secret, ClientID, Name, Timestamp, Nonce)
+	P2PToken  string `json:",omitempty"` // 非空时请求打洞，访问者已用该标识向服务端发送UDP探测包
+}
+
+func (req *VisitorReq) Encode() ([]byte, error) {
+	return encodeFrame(cmdVisitor, req)
+}
 
-func (pkt UDPpacket) Encode() ([]byte, error) {
+func (req *VisitorReq) Decode(reader io.Reader) error {
 	hdr := make([]byte, 4)
-	hdr[0] = version
-	hdr[1] = cmdHandudp
+	if _, err := io.ReadFull(reader, hdr); err != nil {
+		return err
+	}
+	if hdr[1] != cmdVisitor {
+		return ErrVisitor
+	}
+
+	bodyLen := binary.BigEndian.Uint16(hdr[2:4])
+	body := make([]byte, bodyLen)
+	if _, err := io.ReadFull(reader, body); err != nil {
+		return err
+	}
+	return json.Unmarshal(body, req)
+}
+
+// VisitorSign 使用共享密钥对访问请求签名，密钥本身不在网络上传输
+func VisitorSign(secret string, clientID string, name string, timestamp int64, nonce string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "%s\n%s\n%d\n%s", clientID, name, timestamp, nonce)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// IsVisitorReq reports whether the command byte of a gateway connection starts a visitor request.
+func IsVisitorReq(cmd byte) bool {
+	return cmd == cmdVisitor
+}
+
+// P2PResp 服务端对打洞请求的回复，携带观察到的目标客户端地址
+type P2PResp struct {
+	PeerAddr string // 目标客户端的UDP地址
+	Error    string // 打洞协商失败的原因，访问者随后改为经服务端转发
+}
 
-	binary.BigEndian.PutUint16(hdr[2:4], uint16(len(pkt)))
-	return append(hdr, pkt...), nil
+func (resp *P2PResp) Encode() ([]byte, error) {
+	return encodeFrame(cmdP2PResp, resp)
 }
 
-func (pkt *UDPpacket) Decode(reader io.Reader) error {
+func (resp *P2PResp) Decode(reader io.Reader) error {
 	hdr := make([]byte, 4)
-	hdr[0] = version
-	hdr[1] = cmdHandudp
+	if _, err := io.ReadFull(reader, hdr); err != nil {
+		return err
+	}
+	if hdr[1] != cmdP2PResp {
+		return ErrP2PResp
+	}
 
-	_, err := io.ReadFull(reader, hdr)
+	bodyLen := binary.BigEndian.Uint16(hdr[2:4])
+	body := make([]byte, bodyLen)
+	if _, err := io.ReadFull(reader, body); err != nil {
+		return err
+	}
+	return json.Unmarshal(body, resp)
+}
+
+// ReverseReq 反向隧道中客户端打开stream后发送的请求，由服务端拨号目标地址
+type ReverseReq struct {
+	Target string // host:port
+}
+
+func (req *ReverseReq) Encode(format FrameFormat) ([]byte, error) {
+	return encodeStreamFrame(cmdReverse, req, format)
+}
+
+func (req *ReverseReq) Decode(reader io.Reader) error {
+	buf := getFrameBuffer()
+	defer putFrameBuffer(buf, *buf)
+	cmd, body, err := readFrame(reader, *buf)
 	if err != nil {
 		return err
 	}
+	if cmd != cmdReverse {
+		return ErrReverse
+	}
+	return json.Unmarshal(body, req)
+}
 
-	cmd := hdr[1]
-	if cmd != cmdHandudp {
-		return ErrHandudp
+// StreamStatus 客户端在收到VeilinkProtocol后回复的拨号结果
+type StreamStatus struct {
+	OK     bool   // 是否成功连接内网服务
+	Error  string // 失败原因
+	Denied bool   `json:",omitempty"` // 代理的目标不在客户端的允许列表中
+}
+
+func (st *StreamStatus) Encode(format FrameFormat) ([]byte, error) {
+	return encodeStreamFrame(cmdStatus, st, format)
+}
+
+// Decode reads a stream status in either the JSON or the binary encoding.
+func (st *StreamStatus) Decode(reader io.Reader) error {
+	buf := getFrameBuffer()
+	defer putFrameBuffer(buf, *buf)
+	cmd, body, err := readFrame(reader, *buf)
+	if err != nil {
+		return err
+	}
+	switch cmd {
+	case cmdStatus:
+		return json.Unmarshal(body, st)
+	case cmdStatusBinary:
+		return st.decodeBinary(body)
+	default:
+		return ErrStatus
+	}
+}
+
+// 握手结果
+const (
+	HandshakeOK            = iota // 握手成功
+	HandshakeUnknownClient        // 客户端ID不存在
+	HandshakeClientOnline         // 客户端已在线
+	HandshakeRejected             // 服务端拒绝该客户端
+	HandshakeIncompatible         // 协议版本不兼容
+)
+
+// HandshakeResp 服务端对握手请求的回复
+type HandshakeResp struct {
+	Code         int
+	Error        string
+	Version      int            `json:",omitempty"` // 服务端的协议版本
+	Capabilities Capability     `json:",omitempty"` // 服务端支持的可选功能
+	Smux         *SmuxParams    `json:",omitempty"` // 协商后客户端应使用的smux参数
+	Tunnels      []TunnelResult `json:",omitempty"` // 客户端声明的隧道的创建结果
+}
+
+func (resp *HandshakeResp) Encode() ([]byte, error) {
+	return encodeFrame(cmdHandshakeResp, resp)
+}
+
+func (resp *HandshakeResp) Decode(reader io.Reader) error {
+	hdr := make([]byte, 4)
+	if _, err := io.ReadFull(reader, hdr); err != nil {
+		return err
+	}
+	if hdr[1] != cmdHandshakeResp {
+		return ErrHandshakeResp
 	}
 
 	bodyLen := binary.BigEndian.Uint16(hdr[2:4])
 	body := make([]byte, bodyLen)
-	_, err = io.ReadFull(reader, body)
-	if err != nil {
+	if _, err := io.ReadFull(reader, body); err != nil {
 		return err
 	}
-	*pkt = body
+	return json.Unmarshal(body, resp)
+}
 
-	return nil
+// Err returns nil when the handshake was accepted.
+func (resp *HandshakeResp) Err() error {
+	if resp.Code == HandshakeOK {
+		return nil
+	}
+	return &HandshakeError{Code: resp.Code, Msg: resp.Error}
+}
+
+// HandshakeError 握手被服务端拒绝
+type HandshakeError struct {
+	Code int
+	Msg  string
+}
+
+func (e *HandshakeError) Error() string {
+	return "handshake refused: " + e.Msg
 }
 
+// Fatal reports whether retrying the handshake can never succeed.
+func (e *HandshakeError) Fatal() bool {
+	return e.Code == HandshakeUnknownClient || e.Code == HandshakeRejected || e.Code == HandshakeIncompatible
+}
+
+// EncryptProtocl 每个stream开头的加密标志：命令字、格式版本、标志，FrameShort格式没有格式版本。
+// 标志的高4位为压缩算法，仅在对端声明CapCompression时非0
 type EncryptProtocl []byte
 
-func (ep EncryptProtocl) Encode(envOn bool) []byte {
-	hdr := make([]byte, 2)
-	hdr[0] = cmdEncrypt
+func (ep EncryptProtocl) Encode(envOn bool, compression Compression, format FrameFormat) []byte {
+	hdr := []byte{cmdEncrypt}
+	if format == FrameLong {
+		hdr = append(hdr, encryptVersion)
+	}
+	flags := byte(cmdEncryptOf)
 	if envOn {
-		hdr[1] = cmdEncryptOn
-	} else {
-		hdr[1] = cmdEncryptOf
+		flags = cmdEncryptOn
 	}
-	return hdr
+	return append(hdr, flags|byte(compression)<<4)
 }
 
-func (ep EncryptProtocl) Check(reader io.Reader) (bool, error) {
-	hdr := make([]byte, 2)
-	_, err := io.ReadFull(reader, hdr)
+// Check reads the header in either format, a legacy flag byte never equals the format version.
+func (ep EncryptProtocl) Check(reader io.Reader) (bool, Compression, error) {
+	hdr := make([]byte, 3)
+	_, err := io.ReadFull(reader, hdr[:2])
 	if err != nil {
-		return false, err
+		return false, CompressionNone, err
 	}
 
 	cmd := hdr[0]
 	if cmd != cmdEncrypt {
-		return false, ErrEncrypt
+		return false, CompressionNone, ErrEncrypt
+	}
+	flags := hdr[1]
+	if flags == encryptVersion {
+		if _, err := io.ReadFull(reader, hdr[2:]); err != nil {
+			return false, CompressionNone, err
+		}
+		flags = hdr[2]
 	}
 
-	encrypt := hdr[1]
+	compression := Compression(flags >> 4)
+	if compression > CompressionZstd {
+		return false, CompressionNone, fmt.Errorf("unsupported compression %v", compression)
+	}
+	encrypt := flags & 0x0f
 	if encrypt == cmdEncryptOn {
-		return true, nil
+		return true, compression, nil
 	} else if encrypt == cmdEncryptOf {
-		return false, nil
+		return false, compression, nil
 	} else {
-		return false, ErrEncrypt
+		return false, CompressionNone, ErrEncrypt
 	}
 }
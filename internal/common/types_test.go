@@ -0,0 +1,130 @@
+package common
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestFrameTooLarge(t *testing.T) {
+	// FrameLong格式的帧长度为uint32，超过65535字节的帧体可以编码
+	vp := &VeilinkProtocol{Target: strings.Repeat("a", 70000)}
+	buf, err := vp.Encode(FrameLong)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if buf[0] != versionLong {
+		t.Fatalf("header version %d", buf[0])
+	}
+	got := &VeilinkProtocol{}
+	if err := got.Decode(bytes.NewReader(buf)); err != nil || got.Target != vp.Target {
+		t.Fatalf("decoded %d bytes, %v", len(got.Target), err)
+	}
+	if _, err := vp.AppendBinary(nil, FrameLong); err != nil {
+		t.Fatal(err)
+	}
+	// 发给协议版本1的对端时仍受uint16限制
+	if _, err := vp.Encode(FrameShort); !errors.Is(err, ErrFrameTooLarge) {
+		t.Fatalf("got %v", err)
+	}
+	if _, err := vp.AppendBinary(nil, FrameShort); !errors.Is(err, ErrFrameTooLarge) {
+		t.Fatalf("got %v", err)
+	}
+
+	vp.Target = strings.Repeat("a", maxStreamFrameBody)
+	if _, err := vp.Encode(FrameLong); !errors.Is(err, ErrFrameTooLarge) {
+		t.Fatalf("got %v", err)
+	}
+	if _, err := vp.AppendBinary(nil, FrameLong); !errors.Is(err, ErrFrameTooLarge) {
+		t.Fatalf("got %v", err)
+	}
+	if _, err := (&HandshakeReq{ClientID: strings.Repeat("a", 70000)}).Encode(); !errors.Is(err, ErrFrameTooLarge) {
+		t.Fatalf("got %v", err)
+	}
+}
+
+func TestHandshakeVersion(t *testing.T) {
+	// 旧版本客户端不声明版本及功能
+	buf, err := (&HandshakeReq{ClientID: "c1"}).Encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := &HandshakeReq{}
+	if err := req.Decode(bytes.NewReader(buf)); err != nil {
+		t.Fatal(err)
+	}
+	if req.Version != 0 || req.Capabilities.Has(CapCompression) {
+		t.Fatalf("legacy request decoded as %+v", req)
+	}
+	// 版本0的UDP帧长度等与当前版本不兼容，只能拒绝
+	if err := CheckVersion(req.Version); err == nil {
+		t.Fatal("version 0 accepted")
+	}
+	// 版本1不声明CapLongFrames，降级使用旧的帧格式
+	for _, v := range []int{1, ProtocolVersion} {
+		if err := CheckVersion(v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	v1 := CapCompression | CapBinaryFrames | CapStreamStatus | CapReverse
+	if v1.FrameFormat() != FrameShort || Capabilities.FrameFormat() != FrameLong {
+		t.Fatal("frame format not negotiated from the capabilities")
+	}
+	if !(&HandshakeError{Code: HandshakeIncompatible}).Fatal() {
+		t.Fatal("incompatible version should not be retried")
+	}
+}
+
+func TestVeilinkProtocolBinary(t *testing.T) {
+	vp := &VeilinkProtocol{
+		ClientID:       "c1",
+		PublicProtocol: "stcp",
+		PublicPort:     7000,
+		InternalIP:     "127.0.0.1",
+		InternalPort:   22,
+		UDPMux:         true,
+		P2P:            &P2PInfo{Token: "t", PeerAddr: "203.0.113.7:4000", Key: []byte{1, 2, 3}},
+		ProxyProtocol:  ProxyProtocolV2,
+		RemoteAddr:     "203.0.113.7:52311",
+	}
+	var buf bytes.Buffer
+	// 两种帧格式都能读取
+	for _, format := range []FrameFormat{FrameShort, FrameLong} {
+		if err := vp.WriteBinary(&buf, format); err != nil {
+			t.Fatal(err)
+		}
+		got := &VeilinkProtocol{}
+		if err := got.Decode(&buf); err != nil {
+			t.Fatal(err)
+		}
+		if got.P2P == nil || !bytes.Equal(got.P2P.Key, vp.P2P.Key) || got.P2P.PeerAddr != vp.P2P.PeerAddr {
+			t.Fatalf("p2p info changed: %+v", got.P2P)
+		}
+		got.P2P = vp.P2P
+		if *got != *vp {
+			t.Fatalf("got %+v, want %+v", got, vp)
+		}
+
+		st := &StreamStatus{Error: "destination is not allowed", Denied: true}
+		if err := st.WriteBinary(&buf, format); err != nil {
+			t.Fatal(err)
+		}
+		gotStatus := &StreamStatus{}
+		if err := gotStatus.Decode(&buf); err != nil || *gotStatus != *st {
+			t.Fatalf("got %+v, %v", gotStatus, err)
+		}
+	}
+
+	// 截断的帧体返回错误而不是越界
+	frame, _ := (&VeilinkProtocol{ClientID: "c1"}).AppendBinary(nil, FrameLong)
+	frame[5] -= 2
+	if err := new(VeilinkProtocol).Decode(bytes.NewReader(frame[:len(frame)-2])); !errors.Is(err, ErrBinaryFrame) {
+		t.Fatalf("got %v", err)
+	}
+	// 未知的帧头版本
+	frame[0] = 0x7
+	if err := new(VeilinkProtocol).Decode(bytes.NewReader(frame)); !errors.Is(err, ErrVersion) {
+		t.Fatalf("got %v", err)
+	}
+}
@@ -0,0 +1,197 @@
+package common
+
+import (
+	"encoding/binary"
+	"io"
+	"sync"
+	"time"
+)
+
+// MaxUDPPayload 单个UDP数据包负载的上限
+const MaxUDPPayload = 65535
+
+const (
+	udpFrameHeaderSize = 6 // version(1) cmd(1) length(4)
+	udpDatagramHdrSize = 6 // flags(1) flowID(4) addrLen(1)
+	// 帧体长度超过该值说明stream已经错位，无法再找到下一帧的边界
+	maxUDPFrameBody = udpDatagramHdrSize + 0xff + MaxUDPPayload
+)
+
+const udpDatagramFlagClose = 0x1
+
+// UDPpacket 独占stream时携带的UDP数据包
+type UDPpacket []byte
+
+func (pkt UDPpacket) Encode() ([]byte, error) {
+	return pkt.AppendFrame(nil)
+}
+
+// AppendFrame appends the frame of the packet to dst.
+func (pkt UDPpacket) AppendFrame(dst []byte) ([]byte, error) {
+	if len(pkt) > MaxUDPPayload {
+		return dst, ErrDatagramSize
+	}
+	dst = appendUDPFrameHeader(dst, cmdHandudp, len(pkt))
+	return append(dst, pkt...), nil
+}
+
+// Decode reads one packet into the capacity of pkt, overwriting the previous packet.
+// An oversized packet is skipped and reported as ErrDatagramSize, the next call continues with the following packet.
+func (pkt *UDPpacket) Decode(reader io.Reader) error {
+	body, err := readUDPFrame(reader, cmdHandudp, ErrHandudp, MaxUDPPayload, *pkt)
+	if err != nil {
+		return err
+	}
+	*pkt = body
+	return nil
+}
+
+// UDPDatagram 复用stream时携带的UDP数据包，按流ID区分不同的来源地址
+type UDPDatagram struct {
+	FlowID uint32
+	Addr   string // 公网来源地址，只随流的第一个数据包发送
+	Close  bool   // 通知对端关闭该流
+	Data   []byte
+
+	buf []byte // Decode读取帧体的缓冲区，在多次调用间复用
+}
+
+func (dg *UDPDatagram) Encode() ([]byte, error) {
+	return dg.AppendFrame(nil)
+}
+
+// AppendFrame appends the frame of the datagram to dst.
+func (dg *UDPDatagram) AppendFrame(dst []byte) ([]byte, error) {
+	if len(dg.Addr) > 0xff {
+		return dst, ErrUDPMux
+	}
+	if len(dg.Data) > MaxUDPPayload {
+		return dst, ErrDatagramSize
+	}
+	dst = appendUDPFrameHeader(dst, cmdUDPMux, udpDatagramHdrSize+len(dg.Addr)+len(dg.Data))
+	var flags byte
+	if dg.Close {
+		flags = udpDatagramFlagClose
+	}
+	dst = append(dst, flags)
+	dst = binary.BigEndian.AppendUint32(dst, dg.FlowID)
+	dst = append(dst, byte(len(dg.Addr)))
+	dst = append(dst, dg.Addr...)
+	return append(dst, dg.Data...), nil
+}
+
+// Decode reads one datagram. An oversized datagram is skipped and reported as
+// ErrDatagramSize, the next call continues with the following datagram.
+// The buffer is reused across calls on the same dg, so Data is only valid until the next call.
+// Addr keeps its string while the peer repeats the same address.
+func (dg *UDPDatagram) Decode(reader io.Reader) error {
+	body, err := readUDPFrame(reader, cmdUDPMux, ErrUDPMux, maxUDPFrameBody, dg.buf)
+	if err != nil {
+		return err
+	}
+	dg.buf = body
+	if len(body) < udpDatagramHdrSize {
+		return ErrUDPMux
+	}
+	addrLen := int(body[5])
+	if udpDatagramHdrSize+addrLen > len(body) {
+		return ErrUDPMux
+	}
+	if len(body)-udpDatagramHdrSize-addrLen > MaxUDPPayload {
+		return ErrDatagramSize
+	}
+	dg.Close = body[0]&udpDatagramFlagClose != 0
+	dg.FlowID = binary.BigEndian.Uint32(body[1:5])
+	if addr := body[udpDatagramHdrSize : udpDatagramHdrSize+addrLen]; string(addr) != dg.Addr {
+		dg.Addr = string(addr)
+	}
+	dg.Data = body[udpDatagramHdrSize+addrLen:]
+	return nil
+}
+
+func appendUDPFrameHeader(dst []byte, cmd byte, bodyLen int) []byte {
+	dst = append(dst, version, cmd)
+	return binary.BigEndian.AppendUint32(dst, uint32(bodyLen))
+}
+
+// readUDPFrame reads the body of the next frame into the capacity of buf, growing it when needed.
+// Bodies longer than limit are discarded so that the stream stays aligned on frame boundaries.
+func readUDPFrame(reader io.Reader, cmd byte, errCmd error, limit int, buf []byte) ([]byte, error) {
+	if cap(buf) < frameBufferSize {
+		buf = make([]byte, frameBufferSize)
+	}
+	hdr := buf[:udpFrameHeaderSize]
+	if _, err := io.ReadFull(reader, hdr); err != nil {
+		return nil, err
+	}
+	if hdr[0] != version {
+		return nil, ErrVersion
+	}
+	if hdr[1] != cmd {
+		return nil, errCmd
+	}
+
+	bodyLen := binary.BigEndian.Uint32(hdr[2:udpFrameHeaderSize])
+	if bodyLen > maxUDPFrameBody {
+		return nil, errCmd
+	}
+	if int(bodyLen) > limit {
+		if _, err := io.CopyN(io.Discard, reader, int64(bodyLen)); err != nil {
+			return nil, err
+		}
+		return nil, ErrDatagramSize
+	}
+	if cap(buf) < int(bodyLen) {
+		buf = make([]byte, bodyLen)
+	}
+	body := buf[:bodyLen]
+	if _, err := io.ReadFull(reader, body); err != nil {
+		return nil, err
+	}
+	return body, nil
+}
+
+// UDPFrameWriter 以整帧为单位写入stream，可被多个协程并发使用。
+// smux的stream不保证并发写入的原子性，同一stream上的所有UDP帧都应经由它写出。
+type UDPFrameWriter struct {
+	mu      sync.Mutex
+	conn    VeilConn
+	timeout time.Duration
+}
+
+func NewUDPFrameWriter(conn VeilConn, timeout time.Duration) *UDPFrameWriter {
+	return &UDPFrameWriter{conn: conn, timeout: timeout}
+}
+
+// 帧在池中的缓冲区里组装，整帧一次写入
+func (w *UDPFrameWriter) WritePacket(p []byte) (int, error) {
+	buf := getFrameBuffer()
+	frame, err := UDPpacket(p).AppendFrame(*buf)
+	n := 0
+	if err == nil {
+		n, err = w.write(frame)
+	}
+	putFrameBuffer(buf, frame)
+	return n, err
+}
+
+func (w *UDPFrameWriter) WriteDatagram(dg *UDPDatagram) (int, error) {
+	buf := getFrameBuffer()
+	frame, err := dg.AppendFrame(*buf)
+	n := 0
+	if err == nil {
+		n, err = w.write(frame)
+	}
+	putFrameBuffer(buf, frame)
+	return n, err
+}
+
+func (w *UDPFrameWriter) write(frame []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.timeout > 0 {
+		w.conn.SetWriteDeadline(time.Now().Add(w.timeout))
+		defer w.conn.SetWriteDeadline(time.Time{})
+	}
+	return w.conn.Write(frame)
+}
@@ -0,0 +1,220 @@
+package common
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestUDPPacketSizes(t *testing.T) {
+	for _, size := range []int{0, 1, 1400, MaxUDPPayload} {
+		pkt := bytes.Repeat([]byte{0xab}, size)
+		frame, err := UDPpacket(pkt).Encode()
+		if err != nil {
+			t.Fatalf("encode %d bytes: %v", size, err)
+		}
+		got := UDPpacket{}
+		if err := got.Decode(bytes.NewReader(frame)); err != nil {
+			t.Fatalf("decode %d bytes: %v", size, err)
+		}
+		if !bytes.Equal(got, pkt) {
+			t.Fatalf("packet of %d bytes changed", size)
+		}
+	}
+	if _, err := UDPpacket(make([]byte, MaxUDPPayload+1)).Encode(); !errors.Is(err, ErrDatagramSize) {
+		t.Fatalf("oversized packet encoded: %v", err)
+	}
+}
+
+func TestUDPDatagramMaxPayload(t *testing.T) {
+	dg := &UDPDatagram{FlowID: 7, Addr: "[2001:db8::1]:65535", Data: bytes.Repeat([]byte{0xcd}, MaxUDPPayload)}
+	frame, err := dg.Encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := UDPDatagram{}
+	if err := got.Decode(bytes.NewReader(frame)); err != nil {
+		t.Fatal(err)
+	}
+	if got.FlowID != dg.FlowID || got.Addr != dg.Addr || !bytes.Equal(got.Data, dg.Data) {
+		t.Fatal("datagram changed")
+	}
+}
+
+func TestUDPDatagramDecodeAllocs(t *testing.T) {
+	frame, _ := (&UDPDatagram{FlowID: 1, Addr: "203.0.113.7:4000", Data: bytes.Repeat([]byte{0xcd}, 1200)}).Encode()
+	reader := bytes.NewReader(frame)
+	dg := UDPDatagram{}
+	// 对端重复发送同一个来源地址时不再为它分配字符串
+	allocs := testing.AllocsPerRun(100, func() {
+		reader.Reset(frame)
+		if err := dg.Decode(reader); err != nil {
+			t.Fatal(err)
+		}
+	})
+	if allocs != 0 || dg.Addr != "203.0.113.7:4000" {
+		t.Fatalf("%v allocs per datagram, addr %q", allocs, dg.Addr)
+	}
+}
+
+func TestUDPDatagramReusesBuffer(t *testing.T) {
+	frame, _ := (&UDPDatagram{FlowID: 1, Data: bytes.Repeat([]byte{0xcd}, 1200)}).Encode()
+	var reader bytes.Reader
+	dg := UDPDatagram{}
+	allocs := testing.AllocsPerRun(100, func() {
+		reader.Reset(frame)
+		if err := dg.Decode(&reader); err != nil || len(dg.Data) != 1200 {
+			t.Fatalf("got %d bytes, %v", len(dg.Data), err)
+		}
+	})
+	if allocs != 0 {
+		t.Fatalf("decode allocates %v times per datagram", allocs)
+	}
+}
+
+func TestUDPPacketSkipOversized(t *testing.T) {
+	// A peer may still send a frame above the limit; it must be skipped without losing the next one.
+	oversized := make([]byte, udpFrameHeaderSize+MaxUDPPayload+1)
+	oversized[0] = version
+	oversized[1] = cmdHandudp
+	binary.BigEndian.PutUint32(oversized[2:udpFrameHeaderSize], MaxUDPPayload+1)
+	next, _ := UDPpacket("next").Encode()
+	r := bytes.NewReader(append(oversized, next...))
+
+	pkt := UDPpacket{}
+	if err := pkt.Decode(r); !errors.Is(err, ErrDatagramSize) {
+		t.Fatalf("expect ErrDatagramSize, got %v", err)
+	}
+	if err := pkt.Decode(r); err != nil || string(pkt) != "next" {
+		t.Fatalf("next packet lost: %q %v", pkt, err)
+	}
+}
+
+// chunkedConn returns at most a few bytes per Read, splitting frames and nonces.
+type chunkedConn struct {
+	net.Conn
+	rnd *rand.Rand
+}
+
+func (c *chunkedConn) Read(p []byte) (int, error) {
+	if n := 1 + c.rnd.Intn(7); n < len(p) {
+		p = p[:n]
+	}
+	return c.Conn.Read(p)
+}
+
+// encryptedPair returns both ends of a loopback TCP connection wrapped in Chacha20Stream.
+func encryptedPair(t *testing.T, chunked bool) (*Chacha20Stream, *Chacha20Stream) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, _ := ln.Accept()
+		accepted <- conn
+	}()
+	a, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := <-accepted
+	if b == nil {
+		t.Fatal("accept failed")
+	}
+	t.Cleanup(func() { a.Close(); b.Close() })
+
+	key, _ := GenChacha20Key()
+	enc, err := NewChacha20Stream(key, a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var readSide net.Conn = b
+	if chunked {
+		readSide = &chunkedConn{Conn: b, rnd: rand.New(rand.NewSource(1))}
+	}
+	dec, err := NewChacha20Stream(key, readSide)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return enc, dec
+}
+
+func TestUDPPacketEncryptedPartialReads(t *testing.T) {
+	enc, dec := encryptedPair(t, true)
+	rnd := rand.New(rand.NewSource(2))
+	sizes := []int{0, 1, MaxUDPPayload, 512, 3}
+	for i := 0; i < 50; i++ {
+		sizes = append(sizes, rnd.Intn(4096))
+	}
+
+	go func() {
+		w := NewUDPFrameWriter(enc, time.Second)
+		for i, size := range sizes {
+			w.WritePacket(bytes.Repeat([]byte{byte(i)}, size))
+		}
+	}()
+
+	dec.SetReadDeadline(time.Now().Add(10 * time.Second))
+	for i, size := range sizes {
+		pkt := UDPpacket{}
+		if err := pkt.Decode(dec); err != nil {
+			t.Fatalf("packet %d: %v", i, err)
+		}
+		if !bytes.Equal(pkt, bytes.Repeat([]byte{byte(i)}, size)) {
+			t.Fatalf("packet %d: boundary lost, got %d bytes want %d", i, len(pkt), size)
+		}
+	}
+}
+
+func TestUDPDatagramEncryptedConcurrentWriters(t *testing.T) {
+	enc, dec := encryptedPair(t, false)
+	const writers, perWriter = 8, 200
+	w := NewUDPFrameWriter(enc, 5*time.Second)
+
+	payload := func(flow, seq int) []byte {
+		size := (flow*131 + seq*17) % 9000
+		return bytes.Repeat([]byte(fmt.Sprintf("%d-%d;", flow, seq)), size/8+1)
+	}
+
+	var wg sync.WaitGroup
+	for flow := 0; flow < writers; flow++ {
+		wg.Add(1)
+		go func(flow int) {
+			defer wg.Done()
+			for seq := 0; seq < perWriter; seq++ {
+				dg := &UDPDatagram{FlowID: uint32(flow), Addr: "127.0.0.1:1", Data: payload(flow, seq)}
+				if _, err := w.WriteDatagram(dg); err != nil {
+					t.Errorf("flow %d write: %v", flow, err)
+					return
+				}
+			}
+		}(flow)
+	}
+
+	dec.SetReadDeadline(time.Now().Add(10 * time.Second))
+	next := make([]int, writers)
+	for i := 0; i < writers*perWriter; i++ {
+		dg := UDPDatagram{}
+		if err := dg.Decode(dec); err != nil {
+			t.Fatalf("datagram %d: %v", i, err)
+		}
+		flow := int(dg.FlowID)
+		if flow >= writers {
+			t.Fatalf("unexpected flow id %d", flow)
+		}
+		if !bytes.Equal(dg.Data, payload(flow, next[flow])) {
+			t.Fatalf("flow %d datagram %d corrupted", flow, next[flow])
+		}
+		next[flow]++
+	}
+	wg.Wait()
+}
@@ -1,23 +1,41 @@
 package common
 
 import (
+	"errors"
 	"io"
+	"net"
 	"sync"
+	"sync/atomic"
 
 	"github.com/sirupsen/logrus"
 )
 
-// Join two connections together and return the number of bytes transferred
+// Join two connections together and return the number of bytes transferred.
+// When a direction reaches EOF its write side is shut down if the destination supports
+// CloseWrite, so half closed TCP connections keep receiving; both connections are closed
+// once both directions finish, or as soon as one fails or can not be half closed.
 func Join(c1 io.ReadWriteCloser, c2 io.ReadWriteCloser) (inCount int64, outCount int64) {
 	var wait sync.WaitGroup
+	var closeOnce sync.Once
+	var finished atomic.Int32
 	pipe := func(to io.ReadWriteCloser, from io.ReadWriteCloser, count *int64) {
 		defer wait.Done()
 
+		buf := getRelayBuffer()
+		defer putRelayBuffer(buf)
 		var err error
-		*count, err = io.Copy(to, from)
-		if err != nil {
+		*count, err = io.CopyBuffer(to, from, *buf)
+		if err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, net.ErrClosed) && !errors.Is(err, io.ErrClosedPipe) {
 			logrus.Errorf("Join conns error: %v", err)
 		}
+		// smux stream等无法半关闭的连接只能整体关闭，否则对端永远等不到EOF
+		if err == nil && closeWrite(to) == nil && finished.Add(1) < 2 {
+			return
+		}
+		closeOnce.Do(func() {
+			c1.Close()
+			c2.Close()
+		})
 	}
 
 	wait.Add(2)
@@ -26,3 +44,10 @@ func Join(c1 io.ReadWriteCloser, c2 io.ReadWriteCloser) (inCount int64, outCount
 	wait.Wait()
 	return
 }
+
+func closeWrite(conn io.ReadWriteCloser) error {
+	if cw, ok := conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return errors.ErrUnsupported
+}
@@ -0,0 +1,49 @@
+package common
+
+import (
+	"io"
+	"net"
+	"testing"
+)
+
+func TestJoinHalfClose(t *testing.T) {
+	client, in := tcpPair(t)
+	out, server := tcpPair(t)
+	done := make(chan struct{})
+	go func() {
+		Join(in, out)
+		close(done)
+	}()
+
+	// 客户端发完请求后半关闭，仍能收到服务端读到EOF之后才发送的响应
+	go func() {
+		req, _ := io.ReadAll(server)
+		server.Write(append([]byte("re: "), req...))
+		server.Close()
+	}()
+	client.Write([]byte("ping"))
+	if err := client.(*net.TCPConn).CloseWrite(); err != nil {
+		t.Fatal(err)
+	}
+	resp, err := io.ReadAll(client)
+	if err != nil || string(resp) != "re: ping" {
+		t.Fatalf("got %q, %v", resp, err)
+	}
+	<-done
+}
+
+func TestJoinClosesWhenHalfCloseUnsupported(t *testing.T) {
+	c1, peer1 := net.Pipe()
+	c2, peer2 := net.Pipe()
+	done := make(chan struct{})
+	go func() {
+		Join(c1, c2)
+		close(done)
+	}()
+	// net.Pipe不支持半关闭，一个方向结束后两端都被关闭
+	peer1.Close()
+	if _, err := peer2.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("got %v", err)
+	}
+	<-done
+}
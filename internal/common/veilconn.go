@@ -7,6 +7,7 @@ type VeilConn interface {
 	Write(p []byte) (int, error)
 	Close() error
 	SetWriteDeadline(t time.Time) error
+	SetReadDeadline(t time.Time) error
 }
 
 type ConnWithClose interface {
@@ -1,6 +1,8 @@
 package config
 
 import (
+	"time"
+
 	"github.com/spf13/viper"
 	"gopkg.in/yaml.v3"
 )
@@ -12,6 +14,63 @@ type ClientConfig struct {
 	LogLevel   string `mapstructure:"level" yaml:"level"`
 	Encrypt    bool   `mapstructure:"encrypt" yaml:"encrypt"`
 	Key        string `mapstructure:"tcp_key" yaml:"tcp_key"`
+	PoolSize   int    `mapstructure:"pool_size" yaml:"pool_size"` // 与服务端保持的会话数
+
+	ReconnectInitial time.Duration  `mapstructure:"reconnect_initial" yaml:"reconnect_initial"` // 首次重连等待时间
+	ReconnectMax     time.Duration  `mapstructure:"reconnect_max" yaml:"reconnect_max"`         // 最大重连等待时间
+	ReconnectJitter  float64        `mapstructure:"reconnect_jitter" yaml:"reconnect_jitter"`   // 重连等待时间抖动比例
+	StatusAddr       string         `mapstructure:"status_addr" yaml:"status_addr"`             // 本地状态接口监听地址
+	StatusFile       string         `mapstructure:"status_file" yaml:"status_file"`             // 状态文件路径
+	Smux             Smux           `mapstructure:"smux" yaml:"smux,omitempty"`
+	Tunnels          []ClientTunnel `mapstructure:"tunnels" yaml:"tunnels,omitempty"`             // 连接时向服务端注册的隧道
+	Visitor          *Visitor       `mapstructure:"visitor" yaml:"visitor,omitempty"`             // 设置后以访问者模式运行
+	ProxyAllow       []string       `mapstructure:"proxy_allow" yaml:"proxy_allow,omitempty"`     // socks5隧道允许访问的目标，如10.0.0.0/8、192.168.1.10:22、10.0.0.0/8:8000-9000
+	Reverse          []Reverse      `mapstructure:"reverse" yaml:"reverse,omitempty"`             // 反向隧道，在本地监听并经由服务端访问服务端网络中的服务
+	WebSocketURL     string         `mapstructure:"websocket_url" yaml:"websocket_url,omitempty"` // 经WebSocket连接服务端，如 wss://example.com/veilink
+	Proxy            string         `mapstructure:"proxy" yaml:"proxy,omitempty"`                 // 连接服务端时使用的HTTP或SOCKS5代理，为空时读取HTTPS_PROXY、ALL_PROXY等环境变量
+	Transport        string         `mapstructure:"transport" yaml:"transport,omitempty"`         // 连接服务端的方式：tcp(默认)、websocket 或 kcp，设置websocket_url时默认websocket
+	KCP              KCP            `mapstructure:"kcp" yaml:"kcp,omitempty"`                     // kcp传输的服务端地址及FEC参数
+}
+
+// KCP kcp传输的参数，FEC分片数需与对端一致
+type KCP struct {
+	Addr         string `mapstructure:"addr" yaml:"addr,omitempty"`                   // 服务端的UDP地址，需与gateway端口不同，gateway的UDP端口用于打洞
+	DataShards   int    `mapstructure:"data_shards" yaml:"data_shards,omitempty"`     // FEC数据分片数，0关闭FEC
+	ParityShards int    `mapstructure:"parity_shards" yaml:"parity_shards,omitempty"` // FEC校验分片数
+}
+
+// Reverse 反向隧道，需服务端为该客户端配置reverse_allow
+type Reverse struct {
+	BindAddr string `mapstructure:"bind_addr" yaml:"bind_addr"` // 本地监听地址
+	Target   string `mapstructure:"target" yaml:"target"`       // 由服务端拨号的目标地址，host:port
+}
+
+// Visitor 访问者模式，在本地监听端口并经由服务端访问其他客户端的stcp隧道
+type Visitor struct {
+	ClientID  string `mapstructure:"client_id" yaml:"client_id"` // 隧道所属的客户端
+	Name      string `mapstructure:"name" yaml:"name"`           // 隧道名称
+	SecretKey string `mapstructure:"secret_key" yaml:"secret_key"`
+	BindAddr  string `mapstructure:"bind_addr" yaml:"bind_addr"` // 本地监听地址
+	P2P       bool   `mapstructure:"p2p" yaml:"p2p,omitempty"`   // 优先与目标客户端UDP打洞直连，失败时经服务端转发
+}
+
+// ClientTunnel 客户端声明的隧道，需服务端为该客户端配置client_tunnels
+type ClientTunnel struct {
+	PublicProtocol string `mapstructure:"public_protocol" yaml:"public_protocol"`
+	PublicPort     uint16 `mapstructure:"public_port" yaml:"public_port"`
+	InternalIP     string `mapstructure:"internal_ip" yaml:"internal_ip"`
+	InternalPort   uint16 `mapstructure:"internal_port" yaml:"internal_port"`
+	Encrypt        bool   `mapstructure:"encrypt" yaml:"encrypt"`
+}
+
+// Smux smux会话参数，未填写的字段使用默认值(客户端则沿用服务端的值)
+type Smux struct {
+	Version           int           `mapstructure:"version" yaml:"version,omitempty" json:"version,omitempty"`
+	KeepAliveInterval time.Duration `mapstructure:"keepalive_interval" yaml:"keepalive_interval,omitempty" json:"keepalive_interval,omitempty"`
+	KeepAliveTimeout  time.Duration `mapstructure:"keepalive_timeout" yaml:"keepalive_timeout,omitempty" json:"keepalive_timeout,omitempty"`
+	MaxFrameSize      int           `mapstructure:"max_frame_size" yaml:"max_frame_size,omitempty" json:"max_frame_size,omitempty"`
+	MaxReceiveBuffer  int           `mapstructure:"max_receive_buffer" yaml:"max_receive_buffer,omitempty" json:"max_receive_buffer,omitempty"`
+	MaxStreamBuffer   int           `mapstructure:"max_stream_buffer" yaml:"max_stream_buffer,omitempty" json:"max_stream_buffer,omitempty"`
 }
 
 type ServerConfig struct {
@@ -19,6 +78,18 @@ type ServerConfig struct {
 	WebUI    WebUI     `mapstructure:"webui" yaml:"webui"`
 	Gateway  Gateway   `mapstructure:"gateway" yaml:"gateway"`
 	Clients  []*Client `mapstructure:"clients" yaml:"clients"`
+
+	PortRanges []string `mapstructure:"port_ranges" yaml:"port_ranges,omitempty"` // public_port为0的隧道从中自动分配端口，如 20000-30000
+	ACME       *ACME    `mapstructure:"acme" yaml:"acme,omitempty"`               // 为配置了tls域名的http隧道自动申请证书
+}
+
+// ACME 证书自动申请，隧道需监听443端口(TLS-ALPN-01)或配置http_addr(HTTP-01)
+type ACME struct {
+	Email     string `mapstructure:"email" yaml:"email,omitempty"`
+	Directory string `mapstructure:"directory" yaml:"directory,omitempty"` // ACME目录地址，默认Let's Encrypt
+	CacheDir  string `mapstructure:"cache_dir" yaml:"cache_dir,omitempty"` // 证书缓存目录，默认certs
+	HTTPAddr  string `mapstructure:"http_addr" yaml:"http_addr,omitempty"` // HTTP-01验证的监听地址，如 :80
+	CACert    string `mapstructure:"ca_cert" yaml:"ca_cert,omitempty"`     // 访问ACME目录时信任的CA证书，用于pebble等测试服务
 }
 
 type WebUI struct {
@@ -31,37 +102,114 @@ type Gateway struct {
 	Ip        string `mapstructure:"ip" yaml:"ip"`
 	Port      int    `mapstructure:"port" yaml:"port"`
 	DebugInfo bool   `mapstructure:"debug_info" yaml:"debug_info"`
+	Smux      Smux   `mapstructure:"smux" yaml:"smux,omitempty"`
+
+	WebSocket *WebSocket `mapstructure:"websocket" yaml:"websocket,omitempty"` // 允许客户端经WebSocket连接，用于只允许HTTP(S)出站的网络
+	KCP       *KCP       `mapstructure:"kcp" yaml:"kcp,omitempty"`             // 允许客户端经kcp连接，适合丢包较多的线路
+}
+
+// WebSocket gateway的WebSocket入口，连接后的握手及会话与TCP连接相同
+type WebSocket struct {
+	Path     string `mapstructure:"path" yaml:"path,omitempty"`           // 默认/veilink
+	Addr     string `mapstructure:"addr" yaml:"addr,omitempty"`           // 单独监听的地址，为空时在webui端口上提供
+	CertFile string `mapstructure:"cert_file" yaml:"cert_file,omitempty"` // 单独监听时可选，设置后提供wss
+	KeyFile  string `mapstructure:"key_file" yaml:"key_file,omitempty"`
 }
 
 type Client struct {
 	ClientID  string      `mapstructure:"client_id" yaml:"client_id" json:"client_id"`
+	Smux      *Smux       `mapstructure:"smux" yaml:"smux,omitempty" json:"smux,omitempty"` // 覆盖gateway的smux参数
 	Listeners []*Listener `mapstructure:"listeners" yaml:"listeners" json:"listeners"`
+
+	MaxSessions    int    `mapstructure:"max_sessions" yaml:"max_sessions,omitempty" json:"max_sessions,omitempty"`          // 同时保持的会话数上限，默认1
+	ReplaceStale   bool   `mapstructure:"replace_stale" yaml:"replace_stale,omitempty" json:"replace_stale,omitempty"`       // 会话数已满时新连接替换失效或空闲的会话
+	SessionBalance string `mapstructure:"session_balance" yaml:"session_balance,omitempty" json:"session_balance,omitempty"` // least_streams 或 round_robin
+
+	ClientTunnels *ClientTunnelPolicy `mapstructure:"client_tunnels" yaml:"client_tunnels,omitempty" json:"client_tunnels,omitempty"` // 允许客户端自行注册隧道
+	ReverseAllow  []string            `mapstructure:"reverse_allow" yaml:"reverse_allow,omitempty" json:"reverse_allow,omitempty"`    // 客户端反向隧道允许服务端拨号的目标，为空时不允许反向隧道
+}
+
+// ClientTunnelPolicy 客户端连接时自行注册隧道的限制
+type ClientTunnelPolicy struct {
+	PublicIP   string   `mapstructure:"public_ip" yaml:"public_ip,omitempty" json:"public_ip,omitempty"`       // 监听的IP，默认0.0.0.0
+	PortRanges []string `mapstructure:"port_ranges" yaml:"port_ranges" json:"port_ranges"`                     // 允许的外网端口，如 6000-6100 或 7000
+	Protocols  []string `mapstructure:"protocols" yaml:"protocols,omitempty" json:"protocols,omitempty"`       // 允许的协议，默认全部
+	MaxTunnels int      `mapstructure:"max_tunnels" yaml:"max_tunnels,omitempty" json:"max_tunnels,omitempty"` // 同时存在的隧道上限，0不限制
 }
 
 type Listener struct {
-	Uuid           string `yaml:"-" json:"uuid"` // only use for webui
+	Uuid           string `yaml:"-" json:"uuid"`                // only use for webui
+	Temporary      bool   `yaml:"-" json:"temporary,omitempty"` // 由客户端注册，会话断开后移除
 	ClientID       string `mapstructure:"client_id" yaml:"client_id" json:"client_id"`
 	Encrypt        bool   `mapstructure:"encrypt" yaml:"encrypt" json:"encrypt"`
+	Compression    string `mapstructure:"compression" yaml:"compression,omitempty" json:"compression,omitempty"` // snappy 或 zstd，压缩隧道stream上的数据，需客户端支持
 	DebugInfo      bool   `mapstructure:"debug_info" yaml:"debug_info" json:"debug_info"`
 	PublicProtocol string `mapstructure:"public_protocol" yaml:"public_protocol" json:"public_protocol"`
 	PublicIP       string `mapstructure:"public_ip" yaml:"public_ip" json:"public_ip"`
 	PublicPort     uint16 `mapstructure:"public_port" yaml:"public_port" json:"public_port"`
 	InternalIP     string `mapstructure:"internal_ip" yaml:"internal_ip" json:"internal_ip"`
 	InternalPort   uint16 `mapstructure:"internal_port" yaml:"internal_port" json:"internal_port"`
+	PortCount      uint16 `mapstructure:"port_count" yaml:"port_count,omitempty" json:"port_count,omitempty"` // 从public_port/internal_port起映射的连续端口数，默认1
+	Name           string `mapstructure:"name" yaml:"name,omitempty" json:"name,omitempty"`                   // stcp隧道名称，访问者按客户端ID和名称访问
+	SecretKey      string `mapstructure:"secret_key" yaml:"secret_key,omitempty" json:"secret_key,omitempty"` // stcp隧道的共享密钥
+	P2P            bool   `mapstructure:"p2p" yaml:"p2p,omitempty" json:"p2p,omitempty"`                      // 允许stcp访问者与客户端打洞直连
+	Username       string `mapstructure:"username" yaml:"username,omitempty" json:"username,omitempty"`       // socks5隧道的代理认证或http隧道basic auth的用户名，为空时不认证
+	Password       string `mapstructure:"password" yaml:"password,omitempty" json:"password,omitempty"`
+	ProxyProtocol  string `mapstructure:"proxy_protocol" yaml:"proxy_protocol,omitempty" json:"proxy_protocol,omitempty"`                      // v1 或 v2，向内网服务发送PROXY协议头以传递访问者地址
+	AcceptProxy    bool   `mapstructure:"accept_proxy_protocol" yaml:"accept_proxy_protocol,omitempty" json:"accept_proxy_protocol,omitempty"` // 公网连接需以PROXY协议头开始，用于部署在负载均衡之后
+
+	HTTP *HTTPOptions `mapstructure:"http" yaml:"http,omitempty" json:"http,omitempty"` // http隧道作为反向代理时的改写及认证选项
+	TLS  *TLSOptions  `mapstructure:"tls" yaml:"tls,omitempty" json:"tls,omitempty"`    // 设置后http隧道以https提供服务
+
+	Backends    []string `mapstructure:"backends" yaml:"backends,omitempty" json:"backends,omitempty"`             // 同样提供该服务的其他客户端
+	LoadBalance string   `mapstructure:"load_balance" yaml:"load_balance,omitempty" json:"load_balance,omitempty"` // round_robin, least_conn 或 source_hash
+
+	UDPIdleTimeout time.Duration `mapstructure:"udp_idle_timeout" yaml:"udp_idle_timeout,omitempty" json:"udp_idle_timeout,omitempty"` // UDP流空闲回收时间，默认60s
+	UDPMaxFlows    int           `mapstructure:"udp_max_flows" yaml:"udp_max_flows,omitempty" json:"udp_max_flows,omitempty"`          // 同时存在的UDP流上限，0不限制
+	UDPMux         bool          `mapstructure:"udp_mux" yaml:"udp_mux,omitempty" json:"udp_mux,omitempty"`                            // 所有UDP流复用一个stream
+}
+
+// TLSOptions https隧道的证书来源，手动提供的证书优先于ACME
+type TLSOptions struct {
+	Domains  []string `mapstructure:"domains" yaml:"domains,omitempty" json:"domains,omitempty"`       // 通过ACME申请证书的域名
+	CertFile string   `mapstructure:"cert_file" yaml:"cert_file,omitempty" json:"cert_file,omitempty"` // PEM格式的证书链
+	KeyFile  string   `mapstructure:"key_file" yaml:"key_file,omitempty" json:"key_file,omitempty"`
+}
+
+// HTTPOptions http隧道的路由及转发请求时对请求及响应头的改写
+type HTTPOptions struct {
+	Domains               []string          `mapstructure:"domains" yaml:"domains,omitempty" json:"domains,omitempty"`                                                 // 按Host分发请求时匹配的域名，为空时匹配所有域名
+	Location              string            `mapstructure:"location" yaml:"location,omitempty" json:"location,omitempty"`                                              // 路径前缀，默认/，同一端口上的隧道按最长前缀匹配
+	StripPrefix           bool              `mapstructure:"strip_prefix" yaml:"strip_prefix,omitempty" json:"strip_prefix,omitempty"`                                  // 转发前去掉路径前缀
+	HostRewrite           bool              `mapstructure:"host_rewrite" yaml:"host_rewrite,omitempty" json:"host_rewrite,omitempty"`                                  // 将Host改写为内网地址
+	SetHeaders            map[string]string `mapstructure:"set_headers" yaml:"set_headers,omitempty" json:"set_headers,omitempty"`                                     // 添加或覆盖的请求头，Host可指定改写后的主机名
+	RemoveHeaders         []string          `mapstructure:"remove_headers" yaml:"remove_headers,omitempty" json:"remove_headers,omitempty"`                            // 转发前删除的请求头
+	SetResponseHeaders    map[string]string `mapstructure:"set_response_headers" yaml:"set_response_headers,omitempty" json:"set_response_headers,omitempty"`          // 添加或覆盖的响应头
+	RemoveResponseHeaders []string          `mapstructure:"remove_response_headers" yaml:"remove_response_headers,omitempty" json:"remove_response_headers,omitempty"` // 返回前删除的响应头
+	AuthPaths             []string          `mapstructure:"auth_paths" yaml:"auth_paths,omitempty" json:"auth_paths,omitempty"`                                        // 需要basic auth的路径前缀，为空时整个站点都需要认证
 }
 
 func NewServerConfig(configPath string) *ServerConfig {
+	config, err := LoadServerConfig(configPath)
+	if err != nil {
+		panic(err)
+	}
+	return config
+}
+
+// LoadServerConfig reads the server config file at configPath.
+func LoadServerConfig(configPath string) (*ServerConfig, error) {
 	confViper := viper.New()
 
 	confViper.SetConfigFile(configPath)
 	var config ServerConfig
 	if err := confViper.ReadInConfig(); err != nil {
-		panic(err)
+		return nil, err
 	}
 	if err := confViper.Unmarshal(&config); err != nil {
-		panic(err)
+		return nil, err
 	}
-	return &config
+	return &config, nil
 }
 
 func (c *ServerConfig) Marshal() ([]byte, error) {
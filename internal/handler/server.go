@@ -1,6 +1,7 @@
 package handler
 
 import (
+	"errors"
 	"net/http"
 	"strings"
 
@@ -52,8 +53,16 @@ func (s *ServerHandler) GetClients(ctx *gin.Context) {
 }
 
 func (s *ServerHandler) AddClient(ctx *gin.Context) {
-	clientID := ctx.Param("clientID")
-	if err := s.app.AddClient(clientID); err != nil {
+	// 请求体可选，携带smux及会话池等客户端设置
+	var client config.Client
+	if ctx.Request.ContentLength != 0 {
+		if err := ctx.ShouldBindJSON(&client); err != nil {
+			ctx.String(http.StatusBadRequest, err.Error())
+			return
+		}
+	}
+	client.ClientID = ctx.Param("clientID")
+	if err := s.app.AddClient(client); err != nil {
 		ctx.String(http.StatusInternalServerError, err.Error())
 	} else {
 		ctx.String(http.StatusOK, "client added")
@@ -85,7 +94,11 @@ func (s *ServerHandler) GetClientTunnels(ctx *gin.Context) {
 	if err != nil {
 		ctx.String(http.StatusInternalServerError, err.Error())
 	}
-	ctx.JSON(http.StatusOK, tunnels)
+	redacted := make([]*config.Listener, 0, len(tunnels))
+	for _, tunnel := range tunnels {
+		redacted = append(redacted, redact(tunnel))
+	}
+	ctx.JSON(http.StatusOK, redacted)
 }
 
 func (s *ServerHandler) GetClientOnline(ctx *gin.Context) {
@@ -103,8 +116,20 @@ func (s *ServerHandler) GetClientTunnel(ctx *gin.Context) {
 	tunnel, err := s.app.GetClientTunnel(clientID, tunnelID)
 	if err != nil {
 		ctx.String(http.StatusInternalServerError, err.Error())
+		return
 	}
-	ctx.JSON(http.StatusOK, tunnel)
+	ctx.JSON(http.StatusOK, redact(tunnel))
+}
+
+func (s *ServerHandler) GetClientTunnelStats(ctx *gin.Context) {
+	clientID := ctx.Param("clientID")
+	tunnelID := ctx.Param("tunnelID")
+	stats, err := s.app.GetClientTunnelStats(clientID, tunnelID)
+	if err != nil {
+		ctx.String(errorStatus(err), err.Error())
+		return
+	}
+	ctx.JSON(http.StatusOK, stats)
 }
 
 func (s *ServerHandler) AddClientTunnel(ctx *gin.Context) {
@@ -114,11 +139,12 @@ func (s *ServerHandler) AddClientTunnel(ctx *gin.Context) {
 		ctx.String(http.StatusBadRequest, err.Error())
 		return
 	}
-	if err := s.app.AddClientTunnel(clientID, tunnel); err != nil {
+	added, err := s.app.AddClientTunnel(clientID, tunnel)
+	if err != nil {
 		ctx.String(http.StatusInternalServerError, err.Error())
-	} else {
-		ctx.String(http.StatusOK, "tunnel added")
+		return
 	}
+	ctx.JSON(http.StatusOK, redact(added))
 }
 
 func (s *ServerHandler) RemoveClientTunnel(ctx *gin.Context) {
@@ -145,16 +171,62 @@ func (s *ServerHandler) UpdateClientTunnel(ctx *gin.Context) {
 		return
 	}
 
+	// 接口返回的隧道不含密钥，未重新填写时沿用原来的密钥
+	if tunnel.SecretKey == "" {
+		tunnel.SecretKey = oldTunnel.SecretKey
+	}
+	if tunnel.Password == "" && tunnel.Username == oldTunnel.Username {
+		tunnel.Password = oldTunnel.Password
+	}
+
 	if err := s.app.RemoveClientTunnel(clientID, tunnelID); err != nil {
 		ctx.String(http.StatusInternalServerError, err.Error())
 		return
 	}
 
-	if err := s.app.AddClientTunnel(clientID, tunnel); err != nil {
+	updated, err := s.app.AddClientTunnel(clientID, tunnel)
+	if err != nil {
 		ctx.String(http.StatusInternalServerError, err.Error())
 		s.app.AddClientTunnel(clientID, *oldTunnel)
-	} else {
-		ctx.String(http.StatusOK, "tunnel updated")
+		return
 	}
+	ctx.JSON(http.StatusOK, redact(updated))
+}
+
+// SetClientTunnelCert uploads the certificate and key of an https tunnel in PEM format.
+func (s *ServerHandler) SetClientTunnelCert(ctx *gin.Context) {
+	clientID := ctx.Param("clientID")
+	tunnelID := ctx.Param("tunnelID")
+	var body struct {
+		Cert string `json:"cert" binding:"required"`
+		Key  string `json:"key" binding:"required"`
+	}
+	if err := ctx.ShouldBindJSON(&body); err != nil {
+		ctx.String(http.StatusBadRequest, err.Error())
+		return
+	}
+	if err := s.app.SetTunnelCert(clientID, tunnelID, []byte(body.Cert), []byte(body.Key)); err != nil {
+		ctx.String(errorStatus(err), err.Error())
+		return
+	}
+	ctx.String(http.StatusOK, "certificate updated")
+}
+
+// errorStatus returns the HTTP status for an error of the app.
+func errorStatus(err error) int {
+	if errors.Is(err, server.ErrTunnelNotFound) {
+		return http.StatusNotFound
+	}
+	if errors.Is(err, server.ErrNoTLS) {
+		return http.StatusBadRequest
+	}
+	return http.StatusInternalServerError
+}
 
+// redact returns a copy of the tunnel without its secrets, the webui may be served over plain http.
+func redact(tunnel *config.Listener) *config.Listener {
+	redacted := *tunnel
+	redacted.SecretKey = ""
+	redacted.Password = ""
+	return &redacted
 }
@@ -0,0 +1,178 @@
+package handler
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/atopos31/go-veilink/internal/config"
+	"github.com/atopos31/go-veilink/internal/server"
+	"github.com/gin-gonic/gin"
+)
+
+func newTestApp(t *testing.T) *server.App {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "server.yaml")
+	if err := os.WriteFile(path, []byte("level: error\nclients: []\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return server.NewApp(path)
+}
+
+func TestGetClientTunnelStats(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	app := newTestApp(t)
+	if err := app.AddClient(config.Client{ClientID: "c1"}); err != nil {
+		t.Fatal(err)
+	}
+	tunnel, err := app.AddClientTunnel("c1", config.Listener{
+		PublicProtocol: server.STCP,
+		Name:           "ssh",
+		SecretKey:      "secret",
+		InternalIP:     "127.0.0.1",
+		InternalPort:   22,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := gin.New()
+	r.GET("/api/clients/:clientID/tunnels/:tunnelID/stats", NewServerHandler(app).GetClientTunnelStats)
+	get := func(path string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+		return w
+	}
+
+	w := get("/api/clients/c1/tunnels/" + tunnel.Uuid + "/stats")
+	if w.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", w.Code, w.Body)
+	}
+	var stats server.TunnelStats
+	if err := json.Unmarshal(w.Body.Bytes(), &stats); err != nil || stats.DialErrors != 0 {
+		t.Fatalf("got %s, %v", w.Body, err)
+	}
+	for _, path := range []string{"/api/clients/c1/tunnels/missing/stats", "/api/clients/missing/tunnels/" + tunnel.Uuid + "/stats"} {
+		if w := get(path); w.Code != http.StatusNotFound {
+			t.Errorf("%s: status %d", path, w.Code)
+		}
+	}
+}
+
+func TestAddClientSettings(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	app := newTestApp(t)
+	r := gin.New()
+	r.POST("/api/clients/:clientID", NewServerHandler(app).AddClient)
+	post := func(path, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodPost, path, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		r.ServeHTTP(w, req)
+		return w
+	}
+
+	if w := post("/api/clients/c1", ""); w.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", w.Code, w.Body)
+	}
+	if w := post("/api/clients/c2", `{"smux": {"keepalive_timeout": 30000000000}, "max_sessions": 3}`); w.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", w.Code, w.Body)
+	}
+	// 无效的smux参数在添加时拒绝，而不是等到客户端握手
+	if w := post("/api/clients/c3", `{"smux": {"version": 9}}`); w.Code == http.StatusOK {
+		t.Fatal("invalid smux params accepted")
+	}
+	var ids []string
+	for _, client := range app.Config().Clients {
+		ids = append(ids, client.ClientID)
+		if client.ClientID == "c2" && (client.Smux == nil || client.Smux.KeepAliveTimeout != 30*time.Second || client.MaxSessions != 3) {
+			t.Fatalf("settings lost: %+v", client)
+		}
+	}
+	if strings.Join(ids, ",") != "c1,c2" {
+		t.Fatalf("clients %v", ids)
+	}
+}
+
+func TestTunnelSecretsRedacted(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	app := newTestApp(t)
+	if err := app.AddClient(config.Client{ClientID: "c1"}); err != nil {
+		t.Fatal(err)
+	}
+	tunnel, err := app.AddClientTunnel("c1", config.Listener{
+		PublicProtocol: server.STCP,
+		Name:           "ssh",
+		SecretKey:      "secret",
+		InternalIP:     "127.0.0.1",
+		InternalPort:   22,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := NewServerHandler(app)
+	r := gin.New()
+	r.GET("/api/clients/:clientID/tunnels", h.GetClientTunnels)
+	r.GET("/api/clients/:clientID/tunnels/:tunnelID", h.GetClientTunnel)
+	r.PUT("/api/clients/:clientID/tunnels/:tunnelID", h.UpdateClientTunnel)
+	for _, path := range []string{"/api/clients/c1/tunnels", "/api/clients/c1/tunnels/" + tunnel.Uuid} {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+		if w.Code != http.StatusOK || strings.Contains(w.Body.String(), "secret") {
+			t.Fatalf("%s: %d %s", path, w.Code, w.Body)
+		}
+	}
+
+	// 更新时未填写密钥则沿用原来的密钥
+	w := httptest.NewRecorder()
+	body := `{"public_protocol": "stcp", "name": "ssh", "internal_ip": "127.0.0.1", "internal_port": 2222}`
+	req := httptest.NewRequest(http.MethodPut, "/api/clients/c1/tunnels/"+tunnel.Uuid, strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	r.ServeHTTP(w, req)
+	if w.Code != http.StatusOK || strings.Contains(w.Body.String(), "secret") {
+		t.Fatalf("update: %d %s", w.Code, w.Body)
+	}
+	tunnels, _ := app.GetClientTunnels("c1")
+	if len(tunnels) != 1 || tunnels[0].SecretKey != "secret" || tunnels[0].InternalPort != 2222 {
+		t.Fatalf("got %+v", tunnels)
+	}
+}
+
+func TestSetClientTunnelCertStatus(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	app := newTestApp(t)
+	if err := app.AddClient(config.Client{ClientID: "c1"}); err != nil {
+		t.Fatal(err)
+	}
+	tunnel, err := app.AddClientTunnel("c1", config.Listener{
+		PublicProtocol: server.STCP,
+		Name:           "ssh",
+		SecretKey:      "secret",
+		InternalIP:     "127.0.0.1",
+		InternalPort:   22,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := gin.New()
+	r.PUT("/api/clients/:clientID/tunnels/:tunnelID/cert", NewServerHandler(app).SetClientTunnelCert)
+	body := `{"cert": "cert", "key": "key"}`
+	for path, want := range map[string]int{
+		"/api/clients/c1/tunnels/missing/cert":                  http.StatusNotFound,
+		"/api/clients/missing/tunnels/" + tunnel.Uuid + "/cert": http.StatusNotFound,
+		"/api/clients/c1/tunnels/" + tunnel.Uuid + "/cert":      http.StatusBadRequest,
+	} {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodPut, path, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		r.ServeHTTP(w, req)
+		if w.Code != want {
+			t.Errorf("%s: status %d, want %d", path, w.Code, want)
+		}
+	}
+}
@@ -2,19 +2,22 @@ package server
 
 import (
 	"fmt"
-	"io/fs"
+	"net/http"
 	"os"
+	"path/filepath"
 	"slices"
 	"sync"
 
 	"github.com/atopos31/go-veilink/internal/common"
 	"github.com/atopos31/go-veilink/internal/config"
 	"github.com/google/uuid"
+	"github.com/sirupsen/logrus"
 )
 
 type App struct {
 	configPath  string
 	lock        sync.Mutex
+	saveLock    sync.Mutex // 串行化配置文件的写入，需要时在lock之后获取
 	config      *config.ServerConfig
 	listenerMgr *ListenerMgr
 	gateway     *Gateway
@@ -40,47 +43,79 @@ func NewApp(configPath string) *App {
 	common.InitLogrus(config.LogLevel)
 
 	sessionMgr := NewSessionManager()
-	udpSessionMgr := NewUDPSessionManage()
 	keymap := NewKeyMap()
-	listenerMgr := NewListenerMgr(sessionMgr, udpSessionMgr, keymap)
+	listenerMgr := NewListenerMgr(sessionMgr, keymap)
+	sessionMgr.OnOffline(listenerMgr.RemoveClientTunnels)
 	gw := NewGateway(config.Gateway, listenerMgr, sessionMgr)
 	return &App{configPath: configPath, lock: sync.Mutex{}, config: config, listenerMgr: listenerMgr, gateway: gw}
 }
 
+// WebSocketHandler returns the websocket entry of the gateway when it is served on the webui port.
+func (a *App) WebSocketHandler() (string, http.Handler) {
+	if ws := a.config.Gateway.WebSocket; ws == nil || ws.Addr != "" {
+		return "", nil
+	}
+	return a.gateway.WebSocketPath(), a.gateway.WebSocketHandler()
+}
+
 func (a *App) Config() *config.ServerConfig {
 	return a.config
 }
 
 func (a *App) Start() error {
+	if err := a.listenerMgr.SetPortRanges(a.config.PortRanges); err != nil {
+		return err
+	}
+	if err := a.listenerMgr.SetACME(a.config.ACME); err != nil {
+		return err
+	}
 	if err := a.gateway.Run(); err != nil {
 		return err
 	}
+	// 先注册所有客户端，隧道的backends可能引用后面的客户端
 	for _, client := range a.config.Clients {
 		if err := a.listenerMgr.AddClient(client.ClientID); err != nil {
 			return err
 		}
-		for _, listener := range client.Listeners {
+		a.gateway.SetClientConfig(client.ClientID, client)
+	}
+	allocated := make(map[string]map[int]uint16) // clientID => 隧道序号 => 分配到的端口
+	for _, client := range a.config.Clients {
+		for i, listener := range client.Listeners {
 			listener.Uuid = uuid.New().String()
+			auto := listener.PublicPort == 0 && listener.PublicProtocol != STCP
 			if err := a.listenerMgr.AddListener(client.ClientID, listener); err != nil {
 				return err
 			}
+			if auto {
+				if allocated[client.ClientID] == nil {
+					allocated[client.ClientID] = make(map[int]uint16)
+				}
+				allocated[client.ClientID][i] = listener.PublicPort
+			}
 		}
 	}
+	// 立即保存分配到的端口，重启后隧道保持同一端口
+	if len(allocated) > 0 {
+		a.saveAllocated(allocated)
+	}
 
 	return nil
 }
 
-func (a *App) AddClient(clientID string) error {
-	newClient := config.Client{
-		ClientID:  clientID,
-		Listeners: []*config.Listener{},
+// AddClient adds a client with the session settings of newClient, its listeners are ignored.
+func (a *App) AddClient(newClient config.Client) error {
+	newClient.Listeners = []*config.Listener{}
+	if err := a.gateway.checkClientConfig(&newClient); err != nil {
+		return err
 	}
 	a.lock.Lock()
 	defer a.lock.Unlock()
-	a.config.Clients = append(a.config.Clients, &newClient)
-	if err := a.listenerMgr.AddClient(clientID); err != nil {
+	if err := a.listenerMgr.AddClient(newClient.ClientID); err != nil {
 		return err
 	}
+	a.config.Clients = append(a.config.Clients, &newClient)
+	a.gateway.SetClientConfig(newClient.ClientID, &newClient)
 	return nil
 }
 
@@ -90,6 +125,7 @@ func (a *App) RemoveClient(clientID string) error {
 	if err := a.listenerMgr.RemoveClient(clientID); err != nil {
 		return err
 	}
+	a.gateway.SetClientConfig(clientID, nil)
 	a.config.Clients = slices.DeleteFunc(a.config.Clients, func(c *config.Client) bool {
 		return c.ClientID == clientID
 	})
@@ -120,7 +156,8 @@ func (a *App) GetClientTunnels(clientID string) ([]*config.Listener, error) {
 	defer a.lock.Unlock()
 	for _, client := range a.config.Clients {
 		if client.ClientID == clientID {
-			return client.Listeners, nil
+			// 客户端注册的临时隧道不写入配置文件，仅在查询时一并返回
+			return append(slices.Clone(client.Listeners), a.listenerMgr.ClientTunnels(clientID)...), nil
 		}
 	}
 	return nil, fmt.Errorf("client: %s not found", clientID)
@@ -131,20 +168,22 @@ func (a *App) GetOnline(clientID string) (bool, error) {
 	return ok, nil
 }
 
-func (a *App) AddClientTunnel(clientID string, tunnel config.Listener) error {
+// AddClientTunnel adds the tunnel and returns it with the allocated port when public_port is 0.
+func (a *App) AddClientTunnel(clientID string, tunnel config.Listener) (*config.Listener, error) {
 	a.lock.Lock()
 	defer a.lock.Unlock()
 	for _, client := range a.config.Clients {
 		if client.ClientID == clientID {
 			tunnel.Uuid = uuid.New().String()
+			// 分配到的端口随隧道本身在SaveConfig时保存
 			if err := a.listenerMgr.AddListener(clientID, &tunnel); err != nil {
-				return err
+				return nil, err
 			}
 			client.Listeners = append(client.Listeners, &tunnel)
-			return nil
+			return &tunnel, nil
 		}
 	}
-	return fmt.Errorf("client: %s not found", clientID)
+	return nil, fmt.Errorf("client: %s not found", clientID)
 }
 
 func (a *App) RemoveClientTunnel(clientID string, tunnelID string) error {
@@ -164,10 +203,71 @@ func (a *App) RemoveClientTunnel(clientID string, tunnelID string) error {
 	return nil
 }
 
+func (a *App) GetClientTunnelStats(clientID string, tunnelID string) (TunnelStats, error) {
+	listener, err := a.listenerMgr.GetListener(clientID, tunnelID)
+	if err != nil {
+		return TunnelStats{}, err
+	}
+	return listener.Stats(), nil
+}
+
+// saveAllocated writes the ports allocated at startup into the config file. Only the
+// public_port of those tunnels is changed, the file is read back so that nothing else
+// of the in memory config is saved before SaveConfig.
+func (a *App) saveAllocated(allocated map[string]map[int]uint16) {
+	a.saveLock.Lock()
+	defer a.saveLock.Unlock()
+	onDisk, err := config.LoadServerConfig(a.configPath)
+	if err == nil {
+		for _, client := range onDisk.Clients {
+			for i, port := range allocated[client.ClientID] {
+				if i < len(client.Listeners) && client.Listeners[i].PublicPort == 0 {
+					client.Listeners[i].PublicPort = port
+				}
+			}
+		}
+		err = a.writeConfig(onDisk)
+	}
+	if err != nil {
+		logrus.Warnf("failed to save allocated ports %v", err)
+	}
+}
+
 func (a *App) SaveConfig() error {
-	yaml, err := a.config.Marshal()
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	a.saveLock.Lock()
+	defer a.saveLock.Unlock()
+	return a.writeConfig(a.config)
+}
+
+// writeConfig replaces the config file through a temporary file, so that a failed
+// write never leaves a truncated config behind. The caller holds saveLock.
+func (a *App) writeConfig(conf *config.ServerConfig) error {
+	yaml, err := conf.Marshal()
 	if err != nil {
 		return err
 	}
-	return os.WriteFile(a.configPath, yaml, fs.ModeAppend)
+	tmp, err := os.CreateTemp(filepath.Dir(a.configPath), filepath.Base(a.configPath)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	// 配置中有access_key及隧道密钥，仅所有者可读写
+	if err := tmp.Chmod(0o600); err != nil {
+		tmp.Close()
+		return err
+	}
+	if _, err := tmp.Write(yaml); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), a.configPath)
 }
@@ -0,0 +1,86 @@
+package server
+
+import (
+	"hash/fnv"
+	"net"
+	"sync"
+)
+
+// 隧道在多个客户端间的负载均衡策略
+const (
+	LBRoundRobin = "round_robin"
+	LBLeastConn  = "least_conn"
+	LBSourceHash = "source_hash"
+)
+
+// balancer 为隧道的每个新连接挑选客户端
+type balancer struct {
+	strategy string
+	mu       sync.Mutex
+	next     int
+	active   map[string]int // clientID => 活跃连接数
+}
+
+func newBalancer(strategy string) *balancer {
+	return &balancer{
+		strategy: strategy,
+		active:   make(map[string]int),
+	}
+}
+
+// order returns the online clients in the order they should be tried,
+// so that the caller can fail over to the next one.
+func (b *balancer) order(clients []string, remote net.Addr) []string {
+	if len(clients) <= 1 {
+		return clients
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	start := 0
+	switch b.strategy {
+	case LBLeastConn:
+		for i, clientID := range clients {
+			if b.active[clientID] < b.active[clients[start]] {
+				start = i
+			}
+		}
+	case LBSourceHash:
+		h := fnv.New32a()
+		h.Write([]byte(remoteIP(remote)))
+		start = int(h.Sum32() % uint32(len(clients)))
+	default:
+		start = b.next % len(clients)
+		b.next++
+	}
+
+	ordered := make([]string, 0, len(clients))
+	ordered = append(ordered, clients[start:]...)
+	return append(ordered, clients[:start]...)
+}
+
+func (b *balancer) acquire(clientID string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.active[clientID]++
+}
+
+func (b *balancer) release(clientID string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.active[clientID]--
+	if b.active[clientID] <= 0 {
+		delete(b.active, clientID)
+	}
+}
+
+func remoteIP(addr net.Addr) string {
+	if addr == nil {
+		return ""
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return host
+}
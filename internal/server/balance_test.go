@@ -0,0 +1,60 @@
+package server
+
+import (
+	"net"
+	"testing"
+
+	"github.com/atopos31/go-veilink/internal/common"
+	"github.com/atopos31/go-veilink/internal/config"
+	"github.com/xtaci/smux"
+)
+
+// serveTunnels answers every stream of the client as connected to the internal service.
+func serveTunnels(mux *smux.Session) {
+	for {
+		stream, _, err := acceptTunnel(mux)
+		if err != nil {
+			return
+		}
+		writeStatus(stream, "")
+	}
+}
+
+func TestBalanceFailover(t *testing.T) {
+	remote := &net.TCPAddr{IP: net.IPv4(203, 0, 113, 7), Port: 52311}
+	for _, strategy := range []string{LBLeastConn, LBSourceHash} {
+		t.Run(strategy, func(t *testing.T) {
+			l, sm := newTestListener(&config.Listener{
+				PublicProtocol: TCP,
+				InternalIP:     "127.0.0.1",
+				InternalPort:   22,
+				Backends:       []string{"c2"},
+				LoadBalance:    strategy,
+			})
+			muxes := map[string]*smux.Session{
+				"c1": connectClient(t, sm, "c1", common.Capabilities),
+				"c2": connectClient(t, sm, "c2", common.Capabilities),
+			}
+			for _, mux := range muxes {
+				go serveTunnels(mux)
+			}
+
+			first, conn, err := l.openTunnel(remote, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			conn.Close()
+
+			// 选中的客户端断开后，同一来源的下一个连接转到仍在线的客户端
+			muxes[first].Close()
+			next, conn, err := l.openTunnel(remote, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			conn.Close()
+			if next == first {
+				t.Fatalf("connection went to the closed client %s", first)
+			}
+		})
+	}
+}
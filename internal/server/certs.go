@@ -0,0 +1,243 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/atopos31/go-veilink/internal/config"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+const defaultCertDir = "certs"
+
+var (
+	ErrNoCertificate = errors.New("no certificate for the tunnel")
+	ErrNoTLS         = errors.New("tunnel does not serve tls")
+)
+
+// certManager 为https隧道提供证书，ACME申请的证书缓存在磁盘上，重启后无需重新申请
+type certManager struct {
+	lock  sync.Mutex
+	dir   string
+	acme  *autocert.Manager
+	hosts map[string]int // 各隧道配置的域名及引用数，只为这些域名申请证书
+}
+
+func newCertManager() *certManager {
+	return &certManager{dir: defaultCertDir, hosts: make(map[string]int)}
+}
+
+// SetACME enables certificates from the ACME directory for the tls domains of http tunnels.
+// It must be called before the tunnels are added.
+func (lm *ListenerMgr) SetACME(conf *config.ACME) error {
+	if conf == nil {
+		return nil
+	}
+	return lm.certs.setACME(conf)
+}
+
+func (cm *certManager) setACME(conf *config.ACME) error {
+	if conf.CacheDir != "" {
+		cm.dir = conf.CacheDir
+	}
+	client := &acme.Client{DirectoryURL: conf.Directory}
+	if conf.CACert != "" {
+		pem, err := os.ReadFile(conf.CACert)
+		if err != nil {
+			return err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("no certificate found in %s", conf.CACert)
+		}
+		client.HTTPClient = &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}}}
+	}
+	cm.acme = &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		Cache:      autocert.DirCache(filepath.Join(cm.dir, "acme")),
+		HostPolicy: cm.hostPolicy,
+		Email:      conf.Email,
+		Client:     client,
+	}
+	if conf.HTTPAddr == "" {
+		return nil
+	}
+	// HTTP-01验证端口上的其他请求重定向到https
+	ln, err := net.Listen("tcp", conf.HTTPAddr)
+	if err != nil {
+		return err
+	}
+	go func() {
+		if err := http.Serve(ln, cm.acme.HTTPHandler(nil)); err != nil {
+			logrus.Errorf("acme http server error: %v", err)
+		}
+	}()
+	return nil
+}
+
+func (cm *certManager) hostPolicy(_ context.Context, host string) error {
+	cm.lock.Lock()
+	defer cm.lock.Unlock()
+	if cm.hosts[host] == 0 {
+		return fmt.Errorf("host %q is not configured for any tunnel", host)
+	}
+	return nil
+}
+
+// setup prepares the tls config of an https tunnel, loading its certificate file
+// and allowing ACME for its domains.
+func (cm *certManager) setup(l *Listener) error {
+	opts := l.listenerConfig.TLS
+	if opts == nil {
+		return nil
+	}
+	if (opts.CertFile == "") != (opts.KeyFile == "") {
+		return errors.New("tls requires both cert_file and key_file")
+	}
+	if opts.CertFile == "" && len(opts.Domains) == 0 {
+		return errors.New("tls requires domains or cert_file")
+	}
+	if opts.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(opts.CertFile, opts.KeyFile)
+		if err != nil {
+			return err
+		}
+		l.cert.Store(&cert)
+	}
+
+	cm.lock.Lock()
+	defer cm.lock.Unlock()
+	if len(opts.Domains) > 0 {
+		if cm.acme == nil {
+			return errors.New("tls domains require the acme configuration")
+		}
+		for _, domain := range opts.Domains {
+			cm.hosts[normalizeDomain(domain)]++
+		}
+	}
+	l.certs = cm
+	l.tlsConfig = &tls.Config{
+		GetCertificate: l.getCertificate,
+		NextProtos:     []string{"h2", "http/1.1", acme.ALPNProto},
+		MinVersion:     tls.VersionTLS12,
+	}
+	return nil
+}
+
+func (cm *certManager) release(l *Listener) {
+	cm.lock.Lock()
+	defer cm.lock.Unlock()
+	for _, domain := range l.listenerConfig.TLS.Domains {
+		domain = normalizeDomain(domain)
+		if cm.hosts[domain]--; cm.hosts[domain] <= 0 {
+			delete(cm.hosts, domain)
+		}
+	}
+}
+
+// normalizeDomain 配置中的域名按autocert及SNI使用的形式比较：小写且没有结尾的点
+func normalizeDomain(domain string) string {
+	return strings.ToLower(strings.TrimSuffix(domain, "."))
+}
+
+func (cm *certManager) getCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	if cm.acme == nil {
+		return nil, ErrNoCertificate
+	}
+	return cm.acme.GetCertificate(hello)
+}
+
+// store replaces the certificate of an https tunnel with an uploaded one. The files are
+// kept in the certificate directory and referenced by the tunnel config.
+func (cm *certManager) store(l *Listener, certPEM, keyPEM []byte) error {
+	opts := l.listenerConfig.TLS
+	if opts == nil {
+		return ErrNoTLS
+	}
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return err
+	}
+	// 同一隧道的并发上传写同一组文件
+	cm.lock.Lock()
+	defer cm.lock.Unlock()
+	dir := filepath.Join(cm.dir, "manual")
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return err
+	}
+	name := filepath.Join(dir, fmt.Sprintf("%s-%d", l.listenerConfig.ClientID, l.listenerConfig.PublicPort))
+	if err := os.WriteFile(name+".crt", certPEM, 0o644); err != nil {
+		return err
+	}
+	if err := os.WriteFile(name+".key", keyPEM, 0o600); err != nil {
+		return err
+	}
+	opts.CertFile, opts.KeyFile = name+".crt", name+".key"
+	l.cert.Store(&cert)
+	return nil
+}
+
+// 手动提供的证书优先，ACME的TLS-ALPN-01验证请求始终交给autocert处理
+func (l *Listener) getCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	if cert := l.cert.Load(); cert != nil && !slices.Contains(hello.SupportedProtos, acme.ALPNProto) {
+		return cert, nil
+	}
+	return l.certs.getCertificate(hello)
+}
+
+// SetTunnelCert uploads the certificate and key in PEM format for an https tunnel
+// and writes the new file paths of the tunnel into the config file.
+func (a *App) SetTunnelCert(clientID string, tunnelID string, certPEM, keyPEM []byte) error {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	listener, err := a.listenerMgr.GetListener(clientID, tunnelID)
+	if err != nil {
+		return err
+	}
+	if err := a.listenerMgr.certs.store(listener, certPEM, keyPEM); err != nil {
+		return err
+	}
+	return a.saveTunnelCert(clientID, listener.listenerConfig)
+}
+
+// saveTunnelCert patches the certificate files of the tunnel in the config file, like
+// saveAllocated nothing else is saved. A tunnel not saved yet gets them with SaveConfig.
+// The caller holds a.lock.
+func (a *App) saveTunnelCert(clientID string, tunnel *config.Listener) error {
+	a.saveLock.Lock()
+	defer a.saveLock.Unlock()
+	onDisk, err := config.LoadServerConfig(a.configPath)
+	if err != nil {
+		return err
+	}
+	for _, client := range onDisk.Clients {
+		if client.ClientID != clientID {
+			continue
+		}
+		for _, saved := range client.Listeners {
+			if saved.TLS != nil && sameTunnel(saved, tunnel) {
+				saved.TLS.CertFile, saved.TLS.KeyFile = tunnel.TLS.CertFile, tunnel.TLS.KeyFile
+				return a.writeConfig(onDisk)
+			}
+		}
+	}
+	return nil
+}
+
+// sameTunnel reports whether both configs describe the same public entry and target.
+func sameTunnel(a, b *config.Listener) bool {
+	return a.PublicProtocol == b.PublicProtocol && a.PublicIP == b.PublicIP && a.PublicPort == b.PublicPort &&
+		a.InternalIP == b.InternalIP && a.InternalPort == b.InternalPort
+}
@@ -0,0 +1,364 @@
+package server
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/atopos31/go-veilink/internal/config"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+func selfSigned(t *testing.T, host string) (certPEM, keyPEM []byte) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: host},
+		DNSNames:     []string{host},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+}
+
+func leafName(t *testing.T, cert *tls.Certificate) string {
+	t.Helper()
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return leaf.Subject.CommonName
+}
+
+func TestCertFileAndUpload(t *testing.T) {
+	dir := t.TempDir()
+	certPEM, keyPEM := selfSigned(t, "old.example")
+	os.WriteFile(filepath.Join(dir, "a.crt"), certPEM, 0o644)
+	os.WriteFile(filepath.Join(dir, "a.key"), keyPEM, 0o600)
+
+	cm := newCertManager()
+	cm.dir = dir
+	l := NewListener(&config.Listener{
+		ClientID:       "c1",
+		PublicProtocol: HTTP,
+		PublicPort:     8443,
+		TLS:            &config.TLSOptions{CertFile: filepath.Join(dir, "a.crt"), KeyFile: filepath.Join(dir, "a.key")},
+	}, nil, nil)
+	if err := cm.setup(l); err != nil {
+		t.Fatal(err)
+	}
+	cert, err := l.tlsConfig.GetCertificate(&tls.ClientHelloInfo{ServerName: "old.example"})
+	if err != nil || leafName(t, cert) != "old.example" {
+		t.Fatalf("unexpected certificate: %v", err)
+	}
+
+	certPEM, keyPEM = selfSigned(t, "new.example")
+	if err := cm.store(l, certPEM, []byte("broken")); err == nil {
+		t.Fatal("invalid key accepted")
+	}
+	if err := cm.store(l, certPEM, keyPEM); err != nil {
+		t.Fatal(err)
+	}
+	cert, err = l.tlsConfig.GetCertificate(&tls.ClientHelloInfo{ServerName: "new.example"})
+	if err != nil || leafName(t, cert) != "new.example" {
+		t.Fatalf("certificate not replaced: %v", err)
+	}
+	if _, err := tls.LoadX509KeyPair(l.listenerConfig.TLS.CertFile, l.listenerConfig.TLS.KeyFile); err != nil {
+		t.Fatalf("uploaded files not usable: %v", err)
+	}
+}
+
+func TestCertDomainsRequireACME(t *testing.T) {
+	l := NewListener(&config.Listener{PublicProtocol: HTTP, TLS: &config.TLSOptions{Domains: []string{"a.example"}}}, nil, nil)
+	if err := newCertManager().setup(l); err == nil {
+		t.Fatal("domains accepted without acme")
+	}
+}
+
+func TestCertDomainsNormalized(t *testing.T) {
+	cm := newCertManager()
+	cm.acme = &autocert.Manager{}
+	l := NewListener(&config.Listener{PublicProtocol: HTTP, TLS: &config.TLSOptions{Domains: []string{"Example.COM."}}}, nil, nil)
+	if err := cm.setup(l); err != nil {
+		t.Fatal(err)
+	}
+	// autocert按小写且没有结尾点的SNI检查域名
+	if err := cm.hostPolicy(context.Background(), "example.com"); err != nil {
+		t.Fatal(err)
+	}
+	cm.release(l)
+	if err := cm.hostPolicy(context.Background(), "example.com"); err == nil {
+		t.Fatal("released domain still allowed")
+	}
+}
+
+// fakeACME serves the RFC 8555 requests autocert makes. Orders are ready at once, so no
+// challenge is needed, and the finalize request is answered with a certificate for the CSR.
+// It returns the directory URL and the number of certificates issued.
+func fakeACME(t *testing.T) (string, *atomic.Int32) {
+	t.Helper()
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caTmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "fake acme"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTmpl, caTmpl, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caCert, _ := x509.ParseCertificate(caDER)
+
+	var issued atomic.Int32
+	var chain atomic.Value
+	var url string
+	reply := func(w http.ResponseWriter, code int, location string, v any) {
+		if location != "" {
+			w.Header().Set("Location", url+location)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(code)
+		json.NewEncoder(w).Encode(v)
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/dir", func(w http.ResponseWriter, r *http.Request) {
+		reply(w, http.StatusOK, "", map[string]string{
+			"newNonce":   url + "/nonce",
+			"newAccount": url + "/account",
+			"newOrder":   url + "/order",
+			"revokeCert": url + "/revoke",
+			"keyChange":  url + "/key",
+		})
+	})
+	mux.HandleFunc("/nonce", func(w http.ResponseWriter, r *http.Request) {})
+	mux.HandleFunc("/account", func(w http.ResponseWriter, r *http.Request) {
+		reply(w, http.StatusCreated, "/account/1", map[string]string{"status": "valid"})
+	})
+	mux.HandleFunc("/order", func(w http.ResponseWriter, r *http.Request) {
+		reply(w, http.StatusCreated, "/order/1", map[string]string{"status": "ready", "finalize": url + "/finalize"})
+	})
+	mux.HandleFunc("/finalize", func(w http.ResponseWriter, r *http.Request) {
+		// JWS的签名不做校验，只取出其中的CSR
+		var jws struct{ Payload string }
+		var req struct{ CSR string }
+		json.NewDecoder(r.Body).Decode(&jws)
+		payload, _ := base64.RawURLEncoding.DecodeString(jws.Payload)
+		json.Unmarshal(payload, &req)
+		der, _ := base64.RawURLEncoding.DecodeString(req.CSR)
+		csr, err := x509.ParseCertificateRequest(der)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		leaf, err := x509.CreateCertificate(rand.Reader, &x509.Certificate{
+			SerialNumber: big.NewInt(time.Now().UnixNano()),
+			Subject:      pkix.Name{CommonName: csr.DNSNames[0]},
+			DNSNames:     csr.DNSNames,
+			NotBefore:    time.Now().Add(-time.Hour),
+			NotAfter:     time.Now().Add(24 * time.Hour),
+			KeyUsage:     x509.KeyUsageDigitalSignature,
+			ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		}, caCert, csr.PublicKey, caKey)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		chain.Store(append(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: leaf}),
+			pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: caDER})...))
+		issued.Add(1)
+		reply(w, http.StatusOK, "/order/1", map[string]string{"status": "valid", "certificate": url + "/cert"})
+	})
+	mux.HandleFunc("/cert", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/pem-certificate-chain")
+		w.Write(chain.Load().([]byte))
+	})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Replay-Nonce", fmt.Sprint(time.Now().UnixNano()))
+		mux.ServeHTTP(w, r)
+	}))
+	t.Cleanup(srv.Close)
+	url = srv.URL
+	return url + "/dir", &issued
+}
+
+func TestACMECertificate(t *testing.T) {
+	directory, issued := fakeACME(t)
+	cm := newCertManager()
+	if err := cm.setACME(&config.ACME{Directory: directory, CacheDir: t.TempDir()}); err != nil {
+		t.Fatal(err)
+	}
+	l := NewListener(&config.Listener{PublicProtocol: HTTP, TLS: &config.TLSOptions{Domains: []string{"veilink.test"}}}, nil, nil)
+	if err := cm.setup(l); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		cert, err := l.tlsConfig.GetCertificate(&tls.ClientHelloInfo{ServerName: "veilink.test"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if leafName(t, cert) != "veilink.test" {
+			t.Fatalf("certificate for %s", leafName(t, cert))
+		}
+	}
+	// 第二次使用缓存的证书
+	if n := issued.Load(); n != 1 {
+		t.Fatalf("%d certificates issued", n)
+	}
+	if _, err := l.tlsConfig.GetCertificate(&tls.ClientHelloInfo{ServerName: "other.test"}); err == nil {
+		t.Fatal("certificate issued for a host of no tunnel")
+	}
+	// 移除隧道后不再为其域名申请证书
+	cm.release(l)
+	if err := cm.hostPolicy(context.Background(), "veilink.test"); err == nil {
+		t.Fatal("host allowed after release")
+	}
+}
+
+func TestSetTunnelCertSaved(t *testing.T) {
+	dir := t.TempDir()
+	certPEM, keyPEM := selfSigned(t, "old.example")
+	os.WriteFile(filepath.Join(dir, "a.crt"), certPEM, 0o644)
+	os.WriteFile(filepath.Join(dir, "a.key"), keyPEM, 0o600)
+	path := filepath.Join(dir, "server.yaml")
+	conf := fmt.Sprintf(`level: error
+gateway:
+  ip: 127.0.0.1
+  port: 0
+acme:
+  cache_dir: %s
+clients:
+  - client_id: c1
+    listeners:
+      - client_id: c1
+        public_protocol: http
+        public_ip: 127.0.0.1
+        public_port: %d
+        internal_ip: 127.0.0.1
+        internal_port: 80
+        tls:
+          cert_file: %s
+          key_file: %s
+`, dir, freePort(t), filepath.Join(dir, "a.crt"), filepath.Join(dir, "a.key"))
+	if err := os.WriteFile(path, []byte(conf), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	app := NewApp(path)
+	if err := app.Start(); err != nil {
+		t.Fatal(err)
+	}
+	tunnels, err := app.GetClientTunnels("c1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := app.SetTunnelCert("c1", "missing", certPEM, keyPEM); err != ErrTunnelNotFound {
+		t.Fatalf("got %v", err)
+	}
+	certPEM, keyPEM = selfSigned(t, "new.example")
+	if err := app.SetTunnelCert("c1", tunnels[0].Uuid, certPEM, keyPEM); err != nil {
+		t.Fatal(err)
+	}
+	saved, err := config.LoadServerConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts := saved.Clients[0].Listeners[0].TLS
+	if opts.CertFile == filepath.Join(dir, "a.crt") || opts.CertFile != tunnels[0].TLS.CertFile {
+		t.Fatalf("saved cert_file %s", opts.CertFile)
+	}
+}
+
+// TestACMEPebble obtains a certificate from a local pebble server, run it with
+//
+//	PEBBLE_VA_ALWAYS_VALID=1 pebble -config test/config/pebble-config.json
+//	VEILINK_ACME_DIRECTORY=https://127.0.0.1:14000/dir VEILINK_ACME_CA=test/certs/pebble.minica.pem go test ./internal/server
+func TestACMEPebble(t *testing.T) {
+	directory := os.Getenv("VEILINK_ACME_DIRECTORY")
+	if directory == "" {
+		t.Skip("VEILINK_ACME_DIRECTORY not set")
+	}
+	const domain = "veilink.test"
+	cm := newCertManager()
+	conf := &config.ACME{
+		Directory: directory,
+		CacheDir:  t.TempDir(),
+		CACert:    os.Getenv("VEILINK_ACME_CA"),
+		HTTPAddr:  os.Getenv("VEILINK_ACME_HTTP_ADDR"),
+	}
+	if err := cm.setACME(conf); err != nil {
+		t.Fatal(err)
+	}
+	l := NewListener(&config.Listener{PublicProtocol: HTTP, TLS: &config.TLSOptions{Domains: []string{domain}}}, nil, nil)
+	if err := cm.setup(l); err != nil {
+		t.Fatal(err)
+	}
+	defer cm.release(l)
+
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", l.tlsConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				conn.(*tls.Conn).Handshake()
+			}()
+		}
+	}()
+
+	// pebble每次启动都生成新的签发CA，这里只检查证书的域名
+	conn, err := tls.DialWithDialer(&net.Dialer{Timeout: time.Minute}, "tcp", ln.Addr().String(),
+		&tls.Config{ServerName: domain, InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if err := conn.ConnectionState().PeerCertificates[0].VerifyHostname(domain); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cm.getCertificate(&tls.ClientHelloInfo{ServerName: "other.test"}); err == nil {
+		t.Fatal("certificate issued for a host of no tunnel")
+	}
+}
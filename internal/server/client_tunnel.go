@@ -0,0 +1,164 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+
+	"github.com/atopos31/go-veilink/internal/common"
+	"github.com/atopos31/go-veilink/internal/config"
+	"github.com/google/uuid"
+	"github.com/sirupsen/logrus"
+)
+
+var ErrClientTunnelsDisabled = errors.New("client tunnels are not allowed for this client")
+
+// SetTunnelPolicy sets the limits of the tunnels the client may register, nil disables them.
+func (lm *ListenerMgr) SetTunnelPolicy(clientID string, policy *config.ClientTunnelPolicy) {
+	lm.lock.Lock()
+	defer lm.lock.Unlock()
+	if policy == nil {
+		delete(lm.tunnelPolicies, clientID)
+		return
+	}
+	lm.tunnelPolicies[clientID] = policy
+}
+
+// RegisterClientTunnels creates temporary listeners for the tunnels declared by the client.
+// A tunnel that is already registered with the same target is kept, so every session
+// of the pool may declare the same tunnels.
+func (lm *ListenerMgr) RegisterClientTunnels(clientID string, specs []common.TunnelSpec) []common.TunnelResult {
+	lm.lock.Lock()
+	defer lm.lock.Unlock()
+	results := make([]common.TunnelResult, len(specs))
+	policy := lm.tunnelPolicies[clientID]
+	for i, spec := range specs {
+		listener, err := lm.registerClientTunnel(clientID, policy, spec)
+		if err != nil {
+			logrus.Warnf("client %s register tunnel %s:%d fail: %v", clientID, spec.PublicProtocol, spec.PublicPort, err)
+			results[i].Error = err.Error()
+			continue
+		}
+		results[i].TunnelID = listener.Uuid
+		results[i].PublicPort = listener.listenerConfig.PublicPort
+	}
+	return results
+}
+
+func (lm *ListenerMgr) registerClientTunnel(clientID string, policy *config.ClientTunnelPolicy, spec common.TunnelSpec) (*Listener, error) {
+	if policy == nil {
+		return nil, ErrClientTunnelsDisabled
+	}
+	var temporary int
+	for _, listener := range lm.listenersMap[clientID] {
+		conf := listener.listenerConfig
+		if !conf.Temporary {
+			continue
+		}
+		temporary++
+		if conf.PublicProtocol != spec.PublicProtocol {
+			continue
+		}
+		sameTarget := conf.InternalIP == spec.InternalIP && conf.InternalPort == spec.InternalPort && conf.Encrypt == spec.Encrypt
+		if spec.PublicPort == 0 && sameTarget {
+			// 自动分配端口的隧道按目标地址匹配，会话重连后沿用已分配的端口
+			return listener, nil
+		}
+		if conf.PublicPort == spec.PublicPort {
+			if !sameTarget {
+				return nil, fmt.Errorf("port %d is registered with another target", spec.PublicPort)
+			}
+			return listener, nil
+		}
+	}
+	ranges, err := parsePortRanges(policy.PortRanges)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkTunnelPolicy(policy, ranges, spec); err != nil {
+		return nil, err
+	}
+	if policy.MaxTunnels > 0 && temporary >= policy.MaxTunnels {
+		return nil, fmt.Errorf("max %d client tunnels", policy.MaxTunnels)
+	}
+
+	publicIP := policy.PublicIP
+	if publicIP == "" {
+		publicIP = "0.0.0.0"
+	}
+	listenerConfig := &config.Listener{
+		Uuid:           uuid.New().String(),
+		Temporary:      true,
+		ClientID:       clientID,
+		Encrypt:        spec.Encrypt,
+		PublicProtocol: spec.PublicProtocol,
+		PublicIP:       publicIP,
+		PublicPort:     spec.PublicPort,
+		InternalIP:     spec.InternalIP,
+		InternalPort:   spec.InternalPort,
+	}
+	listener := NewListener(listenerConfig, lm.keymap, lm.sessionMgr)
+	listener.routers = lm.routers
+	// public_port为0时从策略允许的端口中分配
+	if err := lm.listen(listener, ranges); err != nil {
+		return nil, err
+	}
+	lm.listenersMap[clientID] = append(lm.listenersMap[clientID], listener)
+	logrus.Infof("client %s registered tunnel %s %s:%d => %s", clientID, spec.PublicProtocol, publicIP, listenerConfig.PublicPort, listener.internalAddr(0))
+	return listener, nil
+}
+
+// RemoveClientTunnels closes the temporary listeners registered by the client
+// once it has no session left. Tunnels are kept while another handshake of the
+// client is being admitted, it may have just registered them.
+func (lm *ListenerMgr) RemoveClientTunnels(clientID string) {
+	lm.lock.Lock()
+	defer lm.lock.Unlock()
+	if _, ok := lm.listenersMap[clientID]; !ok || lm.sessionMgr.IsOnlineOrAdmitting(clientID) {
+		return
+	}
+	lm.listenersMap[clientID] = slices.DeleteFunc(lm.listenersMap[clientID], func(l *Listener) bool {
+		if l.listenerConfig.Temporary {
+			logrus.Infof("client %s tunnel %s:%d removed", clientID, l.listenerConfig.PublicProtocol, l.listenerConfig.PublicPort)
+			l.Close()
+			return true
+		}
+		return false
+	})
+}
+
+// ClientTunnels returns the configs of the temporary listeners registered by the client.
+func (lm *ListenerMgr) ClientTunnels(clientID string) []*config.Listener {
+	lm.lock.Lock()
+	defer lm.lock.Unlock()
+	var tunnels []*config.Listener
+	for _, listener := range lm.listenersMap[clientID] {
+		if listener.listenerConfig.Temporary {
+			tunnels = append(tunnels, listener.listenerConfig)
+		}
+	}
+	return tunnels
+}
+
+func checkTunnelPolicy(policy *config.ClientTunnelPolicy, ranges []portRange, spec common.TunnelSpec) error {
+	switch spec.PublicProtocol {
+	case TCP, UDP, HTTP:
+	default:
+		return fmt.Errorf("unsupported protocol %q", spec.PublicProtocol)
+	}
+	if len(policy.Protocols) > 0 && !slices.Contains(policy.Protocols, spec.PublicProtocol) {
+		return fmt.Errorf("protocol %s is not allowed", spec.PublicProtocol)
+	}
+	if spec.InternalIP == "" || spec.InternalPort == 0 {
+		return errors.New("internal address is required")
+	}
+	if spec.PublicPort == 0 {
+		return nil
+	}
+	for _, r := range ranges {
+		if r.contains(spec.PublicPort) {
+			return nil
+		}
+	}
+	return fmt.Errorf("port %d is not allowed", spec.PublicPort)
+}
@@ -0,0 +1,133 @@
+package server
+
+import (
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/atopos31/go-veilink/internal/common"
+	"github.com/atopos31/go-veilink/internal/config"
+	"github.com/xtaci/smux"
+)
+
+// freePort returns a TCP port that was free a moment ago.
+func freePort(t *testing.T) uint16 {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	return uint16(ln.Addr().(*net.TCPAddr).Port)
+}
+
+func TestRegisterClientTunnels(t *testing.T) {
+	sm := NewSessionManager()
+	lm := NewListenerMgr(sm, NewKeyMap())
+	if err := lm.AddClient("c1"); err != nil {
+		t.Fatal(err)
+	}
+	spec := common.TunnelSpec{PublicProtocol: TCP, InternalIP: "127.0.0.1", InternalPort: 22}
+	if res := lm.RegisterClientTunnels("c1", []common.TunnelSpec{spec}); res[0].Error != ErrClientTunnelsDisabled.Error() {
+		t.Fatalf("registered without a policy: %+v", res)
+	}
+
+	port := freePort(t)
+	lm.SetTunnelPolicy("c1", &config.ClientTunnelPolicy{
+		PublicIP:   "127.0.0.1",
+		PortRanges: []string{strconv.Itoa(int(port))},
+		Protocols:  []string{TCP},
+		MaxTunnels: 1,
+	})
+	res := lm.RegisterClientTunnels("c1", []common.TunnelSpec{
+		spec,
+		{PublicProtocol: UDP, InternalIP: "127.0.0.1", InternalPort: 53},
+		{PublicProtocol: TCP, PublicPort: port + 1, InternalIP: "127.0.0.1", InternalPort: 80},
+	})
+	if res[0].Error != "" || res[0].PublicPort != port {
+		t.Fatalf("auto port: %+v", res[0])
+	}
+	if !strings.Contains(res[1].Error, "not allowed") || !strings.Contains(res[2].Error, "not allowed") {
+		t.Fatalf("policy not enforced: %+v", res[1:])
+	}
+
+	// 其他会话声明同一隧道时沿用已分配的端口，同一端口的其他目标被拒绝
+	again := lm.RegisterClientTunnels("c1", []common.TunnelSpec{
+		spec,
+		{PublicProtocol: TCP, PublicPort: port, InternalIP: "127.0.0.1", InternalPort: 80},
+		{PublicProtocol: TCP, InternalIP: "127.0.0.1", InternalPort: 80},
+	})
+	if again[0].TunnelID != res[0].TunnelID {
+		t.Fatalf("tunnel registered twice: %+v", again[0])
+	}
+	if !strings.Contains(again[1].Error, "another target") || !strings.Contains(again[2].Error, "max 1") {
+		t.Fatalf("got %+v", again[1:])
+	}
+
+	// 客户端离线后移除临时隧道，端口可以再次使用
+	lm.RemoveClientTunnels("c1")
+	if tunnels := lm.ClientTunnels("c1"); len(tunnels) != 0 {
+		t.Fatalf("%d tunnels left", len(tunnels))
+	}
+	ln, err := net.Listen("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(int(port))))
+	if err != nil {
+		t.Fatalf("port not released: %v", err)
+	}
+	ln.Close()
+}
+
+func TestClientTunnelsKeptForPendingHandshake(t *testing.T) {
+	sm := NewSessionManager()
+	sm.SetPolicy("c1", SessionPolicy{MaxSessions: 2})
+	lm := NewListenerMgr(sm, NewKeyMap())
+	if err := lm.AddClient("c1"); err != nil {
+		t.Fatal(err)
+	}
+	port := freePort(t)
+	lm.SetTunnelPolicy("c1", &config.ClientTunnelPolicy{PublicIP: "127.0.0.1", PortRanges: []string{strconv.Itoa(int(port))}})
+	specs := []common.TunnelSpec{{PublicProtocol: TCP, PublicPort: port, InternalIP: "127.0.0.1", InternalPort: 22}}
+	defer func() {
+		for _, l := range lm.listenersMap["c1"] {
+			l.Close()
+		}
+	}()
+
+	// 与handleConn相同：准入后注册隧道再回复握手，失败时尝试移除临时隧道
+	handshake := func(reply func() error) error {
+		serverConn, clientConn := net.Pipe()
+		t.Cleanup(func() { clientConn.Close() })
+		_, err := sm.AddSession("c1", serverConn, smux.DefaultConfig(), 0, func() error {
+			lm.RegisterClientTunnels("c1", specs)
+			return reply()
+		})
+		if err != nil {
+			lm.RemoveClientTunnels("c1")
+		}
+		return err
+	}
+
+	registered := make(chan struct{})
+	release := make(chan struct{})
+	done := make(chan error, 1)
+	go func() {
+		done <- handshake(func() error {
+			close(registered)
+			<-release
+			return nil
+		})
+	}()
+	<-registered
+	// 另一个会话回复失败时，正在握手的会话注册的隧道不能被移除
+	if err := handshake(func() error { return net.ErrClosed }); !errors.Is(err, net.ErrClosed) {
+		t.Fatalf("got %v", err)
+	}
+	close(release)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if tunnels := lm.ClientTunnels("c1"); len(tunnels) != 1 {
+		t.Fatalf("%d tunnels left", len(tunnels))
+	}
+}
@@ -1,75 +1,458 @@
 package server
 
 import (
+	"bytes"
+	"crypto/hmac"
+	"errors"
 	"fmt"
+	"io"
 	"net"
+	"strconv"
+	"sync"
+	"time"
 
 	"github.com/atopos31/go-veilink/internal/common"
 	"github.com/atopos31/go-veilink/internal/config"
 	"github.com/sirupsen/logrus"
+	"github.com/xtaci/smux"
 )
 
+const (
+	handshakeTimeout = time.Second * 10
+	visitorSignTTL   = time.Minute * 5 // 访问请求签名的有效期
+	maxP2PToken      = 64
+)
+
+var errVisitorRefused = errors.New("visitor refused")
+
 type Gateway struct {
-	addr        string
-	listenerMgr *ListenerMgr
-	sessionMgr  *SessionManager
+	addr         string
+	listenerMgr  *ListenerMgr
+	sessionMgr   *SessionManager
+	smux         common.SmuxParams
+	clientSmux   sync.Map // clientID => common.SmuxParams
+	rendezvous   *rendezvous
+	reverseAllow sync.Map // clientID => common.Allowlist
+	websocket    *config.WebSocket
+	ws           *wsListener // WebSocket处理函数收到的连接
+	kcp          *config.KCP
+	nonces       *nonceCache // 签名有效期内已使用的访问请求nonce
 }
 
 func NewGateway(conf config.Gateway, listenerMgr *ListenerMgr, sessionMgr *SessionManager) *Gateway {
-	addr := fmt.Sprintf("%s:%d", conf.Ip, conf.Port)
+	addr := net.JoinHostPort(conf.Ip, strconv.Itoa(conf.Port))
+	var ws *wsListener
+	if conf.WebSocket != nil {
+		ws = newWSListener()
+	}
 	return &Gateway{
 		addr:        addr,
 		listenerMgr: listenerMgr,
 		sessionMgr:  sessionMgr,
+		smux:        smuxParamsFromConfig(conf.Smux).Merge(common.DefaultSmuxParams()),
+		websocket:   conf.WebSocket,
+		ws:          ws,
+		kcp:         conf.KCP,
+		nonces:      newNonceCache(),
+	}
+}
+
+// SetClientConfig applies the per client session settings, nil restores the defaults.
+func (g *Gateway) SetClientConfig(clientID string, conf *config.Client) {
+	if conf == nil {
+		g.clientSmux.Delete(clientID)
+		g.sessionMgr.SetPolicy(clientID, SessionPolicy{})
+		g.listenerMgr.SetTunnelPolicy(clientID, nil)
+		g.setReverseAllow(clientID, nil)
+		return
+	}
+	if conf.Smux != nil {
+		g.clientSmux.Store(clientID, smuxParamsFromConfig(*conf.Smux).Merge(g.smux))
+	} else {
+		g.clientSmux.Delete(clientID)
+	}
+	switch conf.SessionBalance {
+	case "", BalanceLeastStreams, BalanceRoundRobin:
+	default:
+		logrus.Warnf("client %s unknown session_balance %q, use %s", clientID, conf.SessionBalance, BalanceLeastStreams)
+	}
+	g.sessionMgr.SetPolicy(clientID, SessionPolicy{
+		MaxSessions: conf.MaxSessions,
+		Replace:     conf.ReplaceStale,
+		Balance:     conf.SessionBalance,
+	})
+	g.listenerMgr.SetTunnelPolicy(clientID, conf.ClientTunnels)
+	g.setReverseAllow(clientID, conf.ReverseAllow)
+}
+
+// checkClientConfig reports whether the per client session settings can be applied.
+func (g *Gateway) checkClientConfig(conf *config.Client) error {
+	if conf.Smux == nil {
+		return nil
+	}
+	_, err := smuxParamsFromConfig(*conf.Smux).Merge(g.smux).Config()
+	return err
+}
+
+func smuxParamsFromConfig(conf config.Smux) common.SmuxParams {
+	return common.SmuxParams{
+		Version:           conf.Version,
+		KeepAliveInterval: conf.KeepAliveInterval,
+		KeepAliveTimeout:  conf.KeepAliveTimeout,
+		MaxFrameSize:      conf.MaxFrameSize,
+		MaxReceiveBuffer:  conf.MaxReceiveBuffer,
+		MaxStreamBuffer:   conf.MaxStreamBuffer,
+	}
+}
+
+func (g *Gateway) smuxParams(clientID string) common.SmuxParams {
+	if params, ok := g.clientSmux.Load(clientID); ok {
+		return params.(common.SmuxParams)
 	}
+	return g.smux
 }
 
+// Run listens on every transport enabled for the gateway, the connections of all
+// transports go through the same handshake.
 func (g *Gateway) Run() error {
 	gateWayListener, err := net.Listen("tcp", g.addr)
 	if err != nil {
 		return err
 	}
-
-	logrus.Debugf("Gateway is running on %s", g.addr)
-	go func() {
-		defer gateWayListener.Close()
-		for {
-			conn, err := gateWayListener.Accept()
-			if err != nil {
-				logrus.Errorf("failed to accept connection %v", err)
-				continue
+	var kcpListener net.Listener
+	if g.kcp != nil {
+		if kcpListener, err = g.listenKCP(); err != nil {
+			gateWayListener.Close()
+			return err
+		}
+	}
+	if g.websocket != nil && g.websocket.Addr != "" {
+		if err := g.listenWebSocket(); err != nil {
+			gateWayListener.Close()
+			if kcpListener != nil {
+				kcpListener.Close()
 			}
-			logrus.Debugf("accept connection from %s", conn.RemoteAddr())
-			go g.handleConn(conn)
+			return err
 		}
-	}()
+	}
+
+	// 打洞协商使用与gateway相同的UDP端口，监听失败时stcp访问者只能经服务端转发
+	if g.rendezvous, err = newRendezvous(g.addr); err != nil {
+		logrus.Warnf("p2p rendezvous disabled: %v", err)
+	}
+
+	g.serve(gateWayListener, "tcp")
+	if kcpListener != nil {
+		g.serve(kcpListener, "kcp")
+	}
+	if g.ws != nil {
+		g.serve(g.ws, "websocket")
+	}
 	return nil
 }
 
 func (g *Gateway) handleConn(conn net.Conn) {
+	// 会话建立后连接由smux会话关闭，其他情况返回时即关闭连接，
+	// WebSocket的处理函数等到连接关闭才返回
+	var sess *Session
+	defer func() {
+		if sess == nil {
+			conn.Close()
+		}
+	}()
+
+	// 根据命令字区分客户端握手和访问者请求，已读取的头部交还给解码器。
+	// 读取整个请求的时间都受handshakeTimeout限制，解码后再清除
+	hdr := make([]byte, 2)
+	conn.SetReadDeadline(time.Now().Add(handshakeTimeout))
+	_, err := io.ReadFull(conn, hdr)
+	if err != nil {
+		logrus.Errorf("failed to read request header %v", err)
+		return
+	}
+	reader := io.MultiReader(bytes.NewReader(hdr), conn)
+	if common.IsVisitorReq(hdr[1]) {
+		g.handleVisitor(conn, reader)
+		return
+	}
+
 	handshakeReq := &common.HandshakeReq{}
-	if err := handshakeReq.Decode(conn); err != nil {
+	err = handshakeReq.Decode(reader)
+	conn.SetReadDeadline(time.Time{})
+	if err != nil {
 		logrus.Errorf("failed to decode handshake request %v", err)
-		conn.Close()
 		return
 	}
 
 	if !g.listenerMgr.CheckExist(handshakeReq.ClientID) {
 		logrus.Errorf("invalid client id %v", handshakeReq.ClientID)
-		conn.Close()
+		g.refuse(conn, handshakeReq, common.HandshakeUnknownClient, "unknown client id "+handshakeReq.ClientID)
 		return
 	}
 
 	logrus.Debugf("handshake request %v", handshakeReq)
 
-	if _, err := g.sessionMgr.AddSession(handshakeReq.ClientID, conn); err != nil {
+	if err := common.CheckVersion(handshakeReq.Version); err != nil {
+		logrus.Errorf("client %v refused: %v, upgrade the client", handshakeReq.ClientID, err)
+		g.refuse(conn, handshakeReq, common.HandshakeIncompatible, fmt.Sprintf("client %v, upgrade the client", err))
+		return
+	}
+	// 双方都支持的功能，旧版本客户端不声明功能，相关功能降级不用
+	caps := handshakeReq.Capabilities & common.Capabilities
+	if missing := common.Capabilities &^ caps; missing != 0 {
+		logrus.Warnf("client %v speaks protocol version %d without capabilities %#x, they are disabled for it",
+			handshakeReq.ClientID, handshakeReq.Version, uint64(missing))
+	}
+
+	// 协商smux参数，客户端未指定的字段沿用服务端配置
+	serverParams := g.smuxParams(handshakeReq.ClientID)
+	clientParams := serverParams
+	if handshakeReq.Smux != nil {
+		clientParams = handshakeReq.Smux.Merge(serverParams)
+	}
+	if _, err := clientParams.Config(); err != nil {
+		logrus.Errorf("client %v smux params rejected %v", handshakeReq.ClientID, err)
+		g.refuse(conn, handshakeReq, common.HandshakeRejected, err.Error())
+		return
+	}
+	if err := serverParams.CheckPeer(clientParams); err != nil {
+		logrus.Errorf("client %v smux params rejected %v", handshakeReq.ClientID, err)
+		g.refuse(conn, handshakeReq, common.HandshakeRejected, "incompatible smux params: "+err.Error())
+		return
+	}
+	smuxConf, err := serverParams.Config()
+	if err != nil {
+		logrus.Errorf("server smux params invalid %v", err)
+		g.refuse(conn, handshakeReq, common.HandshakeRejected, "server misconfigured")
+		return
+	}
+
+	// 准入由AddSession在会话锁内判定，通过后再注册客户端隧道并回复握手
+	accept := func() error {
+		resp := &common.HandshakeResp{
+			Code:         common.HandshakeOK,
+			Version:      common.ProtocolVersion,
+			Capabilities: common.Capabilities,
+			Smux:         &clientParams,
+		}
+		if len(handshakeReq.Tunnels) > 0 {
+			resp.Tunnels = g.listenerMgr.RegisterClientTunnels(handshakeReq.ClientID, handshakeReq.Tunnels)
+		}
+		if err := g.reply(conn, resp); err != nil {
+			return fmt.Errorf("failed to send handshake response %w", err)
+		}
+		return nil
+	}
+	sess, err = g.sessionMgr.AddSession(handshakeReq.ClientID, conn, smuxConf, caps, accept)
+	if errors.Is(err, ErrClientIsOnline) {
+		logrus.Errorf("client %v is already online", handshakeReq.ClientID)
+		g.refuse(conn, handshakeReq, common.HandshakeClientOnline, err.Error())
+		return
+	}
+	if err != nil {
 		logrus.Errorf("failed to add session %v", err)
+		g.listenerMgr.RemoveClientTunnels(handshakeReq.ClientID)
+		return
+	}
+	if caps.Has(common.CapReverse) {
+		go g.serveReverse(sess)
+	}
+}
+
+// handleVisitor checks the signature of a visitor request and relays it to the stcp tunnel.
+func (g *Gateway) handleVisitor(conn net.Conn, reader io.Reader) {
+	req := &common.VisitorReq{}
+	err := req.Decode(reader)
+	conn.SetReadDeadline(time.Time{})
+	if err != nil {
+		logrus.Errorf("failed to decode visitor request %v", err)
+		conn.Close()
 		return
 	}
+	listener, err := g.listenerMgr.FindSecretTunnel(req.ClientID, req.Name)
+	if err == nil {
+		err = checkVisitorSign(listener.listenerConfig.SecretKey, req, g.nonces)
+	}
+	if err != nil {
+		logrus.Warnf("visitor %s for %s/%s refused: %v", conn.RemoteAddr(), req.ClientID, req.Name, err)
+		// 不区分隧道不存在和密钥错误，避免被用来探测隧道名称
+		sendStreamStatus(conn, errVisitorRefused, common.FrameShort)
+		conn.Close()
+		return
+	}
+	if req.P2PToken != "" {
+		g.handleP2P(conn, listener, req.P2PToken)
+		return
+	}
+	listener.ServeVisitor(conn)
+}
+
+// handleP2P exchanges the UDP addresses the visitor and the target client probed the rendezvous from.
+func (g *Gateway) handleP2P(conn net.Conn, listener *Listener, token string) {
+	defer conn.Close()
+	resp := &common.P2PResp{}
+	peerAddr, err := g.negotiateP2P(conn.RemoteAddr(), listener, token)
+	if err != nil {
+		logrus.Warnf("visitor %s p2p fail: %v", conn.RemoteAddr(), err)
+		resp.Error = err.Error()
+	} else {
+		resp.PeerAddr = peerAddr.String()
+	}
+	buf, err := resp.Encode()
+	if err != nil {
+		return
+	}
+	conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+	conn.Write(buf)
+}
+
+func (g *Gateway) negotiateP2P(remote net.Addr, listener *Listener, token string) (net.Addr, error) {
+	if g.rendezvous == nil {
+		return nil, errors.New("p2p is not available")
+	}
+	if !listener.listenerConfig.P2P {
+		return nil, errors.New("p2p is not enabled for the tunnel")
+	}
+	// 签名校验通过后才签发token，未签发的token的探测包不会被记录
+	if err := g.rendezvous.issue(token); err != nil {
+		return nil, err
+	}
+	defer g.rendezvous.release(token)
+	visitorAddr, err := g.rendezvous.wait(token, common.P2PRoleVisitor)
+	if err != nil {
+		return nil, err
+	}
+	info := &common.P2PInfo{
+		Token:    token,
+		PeerAddr: visitorAddr.String(),
+		Key:      common.P2PKey(listener.listenerConfig.SecretKey, token),
+	}
+	clientID, stream, err := listener.OpenP2P(remote, info)
+	if err != nil {
+		return nil, err
+	}
+	defer stream.Close()
+	clientAddr, err := g.rendezvous.wait(token, common.P2PRoleClient)
+	if err != nil {
+		return nil, err
+	}
+	logrus.Infof("p2p visitor %s <=> client %s %s", visitorAddr, clientID, clientAddr)
+	return clientAddr, nil
+}
+
+// checkVisitorSign verifies the signature of the request and rejects a request whose
+// nonce was already used, a captured request can not be replayed within its TTL.
+func checkVisitorSign(secret string, req *common.VisitorReq, nonces *nonceCache) error {
+	signedAt := time.Unix(req.Timestamp, 0)
+	skew := time.Since(signedAt)
+	if skew > visitorSignTTL || skew < -visitorSignTTL {
+		return errors.New("visitor request expired")
+	}
+	if req.Nonce == "" {
+		return errors.New("visitor request without nonce, upgrade the visitor")
+	}
+	sign := common.VisitorSign(secret, req.ClientID, req.Name, req.Timestamp, req.Nonce)
+	if !hmac.Equal([]byte(sign), []byte(req.Sign)) {
+		return errors.New("invalid visitor sign")
+	}
+	// 签名校验通过后才记录nonce，没有密钥无法填充缓存
+	if !nonces.add(req.ClientID+"/"+req.Name+"/"+req.Nonce, signedAt.Add(visitorSignTTL)) {
+		return errors.New("visitor request replayed")
+	}
+	return nil
+}
+
+// nonceCache 记录访问请求的nonce直到其签名过期
+type nonceCache struct {
+	mu      sync.Mutex
+	expires map[string]time.Time
+	swept   time.Time
+}
+
+func newNonceCache() *nonceCache {
+	return &nonceCache{expires: make(map[string]time.Time), swept: time.Now()}
+}
+
+// add records the nonce until expire and reports whether it was not seen before.
+// Expired nonces are swept at most once per visitorSignTTL.
+func (c *nonceCache) add(nonce string, expire time.Time) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	if now.Sub(c.swept) >= visitorSignTTL {
+		for n, exp := range c.expires {
+			if now.After(exp) {
+				delete(c.expires, n)
+			}
+		}
+		c.swept = now
+	}
+	if exp, ok := c.expires[nonce]; ok && !now.After(exp) {
+		return false
+	}
+	c.expires[nonce] = expire
+	return true
+}
+
+// Tell the client why its handshake was refused and drop the connection.
+// Clients that declare no protocol version never read a reply, they are only disconnected.
+func (g *Gateway) refuse(conn net.Conn, req *common.HandshakeReq, code int, reason string) {
+	defer conn.Close()
+	if req.Version == 0 {
+		refuseLegacy(conn)
+		return
+	}
+	if err := g.reply(conn, &common.HandshakeResp{Code: code, Error: reason}); err != nil {
+		logrus.Errorf("failed to send handshake response %v", err)
+	}
+}
+
+// legacyRefusalHost 版本0的客户端不读取握手回复，只能让它拨号该地址，在拨号失败的日志中提示升级
+const legacyRefusalHost = "veilink-server-refused-upgrade-the-client.invalid"
+
+// refuseLegacy tells a version 0 client why it was refused in the only format it reads:
+// a stream asking it to dial legacyRefusalHost, which fails with the host name in its log.
+func refuseLegacy(conn net.Conn) {
+	// 版本0的客户端使用smux的默认配置
+	mux, err := smux.Server(conn, smux.DefaultConfig())
+	if err != nil {
+		return
+	}
+	defer mux.Close()
+	stream, err := mux.OpenStream()
+	if err != nil {
+		return
+	}
+	defer stream.Close()
+	vp := &common.VeilinkProtocol{PublicProtocol: TCP, InternalIP: legacyRefusalHost, InternalPort: 1}
+	buf, err := vp.Encode(common.FrameShort)
+	if err != nil {
+		return
+	}
+	stream.SetWriteDeadline(time.Now().Add(writeTimeout))
+	_, err = stream.Write(append((common.EncryptProtocl{}).Encode(false, common.CompressionNone, common.FrameShort), buf...))
+	if err != nil {
+		logrus.Errorf("failed to send legacy refusal %v", err)
+		return
+	}
+	// 客户端拨号失败后关闭stream，此前关闭会话会使它只记录会话断开
+	stream.SetReadDeadline(time.Now().Add(handshakeTimeout))
+	io.Copy(io.Discard, stream)
+}
+
+func (g *Gateway) reply(conn net.Conn, resp *common.HandshakeResp) error {
+	buf, err := resp.Encode()
+	if err != nil {
+		return err
+	}
+	conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+	_, err = conn.Write(buf)
+	conn.SetWriteDeadline(time.Time{})
+	return err
 }
 
 func (g *Gateway) IsOnline(clientID string) bool {
-	return g.sessionMgr.sessions[clientID] != nil
+	return g.sessionMgr.IsOnline(clientID)
 }
 
 // func (gw *Gateway) DebugInfoTicker(d time.Duration) {
@@ -0,0 +1,133 @@
+package server
+
+import (
+	"encoding/json"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/atopos31/go-veilink/internal/common"
+	"github.com/atopos31/go-veilink/internal/config"
+	"github.com/xtaci/smux"
+)
+
+func signedVisitorReq(secret string, timestamp time.Time, nonce string) *common.VisitorReq {
+	req := &common.VisitorReq{ClientID: "c1", Name: "ssh", Timestamp: timestamp.Unix(), Nonce: nonce}
+	req.Sign = common.VisitorSign(secret, req.ClientID, req.Name, req.Timestamp, req.Nonce)
+	return req
+}
+
+func TestCheckVisitorSign(t *testing.T) {
+	nonces := newNonceCache()
+	now := time.Now()
+	if err := checkVisitorSign("secret", signedVisitorReq("secret", now, "n1"), nonces); err != nil {
+		t.Fatal(err)
+	}
+
+	tampered := signedVisitorReq("secret", now, "n2")
+	tampered.Name = "db"
+	for name, tc := range map[string]struct {
+		req  *common.VisitorReq
+		want string
+	}{
+		"wrong secret": {signedVisitorReq("other", now, "n3"), "invalid visitor sign"},
+		"tampered":     {tampered, "invalid visitor sign"},
+		"expired":      {signedVisitorReq("secret", now.Add(-visitorSignTTL-time.Minute), "n4"), "expired"},
+		"future":       {signedVisitorReq("secret", now.Add(visitorSignTTL+time.Minute), "n5"), "expired"},
+		"no nonce":     {signedVisitorReq("secret", now, ""), "without nonce"},
+		"replayed":     {signedVisitorReq("secret", now, "n1"), "replayed"},
+	} {
+		if err := checkVisitorSign("secret", tc.req, nonces); err == nil || !strings.Contains(err.Error(), tc.want) {
+			t.Errorf("%s: got %v", name, err)
+		}
+	}
+	// 签名错误的请求不占用nonce
+	if err := checkVisitorSign("secret", signedVisitorReq("secret", now, "n3"), nonces); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestNonceCacheExpiry(t *testing.T) {
+	nonces := newNonceCache()
+	if !nonces.add("a", time.Now().Add(-time.Second)) {
+		t.Fatal("new nonce refused")
+	}
+	// 过期的nonce不再拒绝，并在下次清理时删除
+	if !nonces.add("a", time.Now().Add(time.Minute)) {
+		t.Fatal("expired nonce refused")
+	}
+	if nonces.add("a", time.Now().Add(time.Minute)) {
+		t.Fatal("nonce accepted twice")
+	}
+	nonces.add("b", time.Now().Add(-time.Second))
+	nonces.swept = time.Now().Add(-visitorSignTTL)
+	nonces.add("c", time.Now().Add(time.Minute))
+	if _, ok := nonces.expires["b"]; ok || len(nonces.expires) != 2 {
+		t.Fatalf("expired nonces kept: %v", nonces.expires)
+	}
+}
+
+func TestRefuseLegacyClient(t *testing.T) {
+	sm := NewSessionManager()
+	lm := NewListenerMgr(sm, NewKeyMap())
+	if err := lm.AddClient("c1"); err != nil {
+		t.Fatal(err)
+	}
+	g := NewGateway(config.Gateway{}, lm, sm)
+	serverConn, clientConn := net.Pipe()
+	defer clientConn.Close()
+	go g.handleConn(serverConn)
+
+	// 与版本0的客户端相同：不声明版本，发送握手后直接创建smux会话
+	buf, _ := (&common.HandshakeReq{ClientID: "c1"}).Encode()
+	if _, err := clientConn.Write(buf); err != nil {
+		t.Fatal(err)
+	}
+	mux, err := smux.Client(clientConn, smux.DefaultConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mux.Close()
+	stream, err := mux.AcceptStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stream.SetReadDeadline(time.Now().Add(2 * time.Second))
+	// 版本0只能读取2字节的加密标志及uint16长度的JSON帧
+	hdr := make([]byte, 6)
+	if _, err := io.ReadFull(stream, hdr); err != nil {
+		t.Fatal(err)
+	}
+	if hdr[0] != 0x4 || hdr[1] != 0 || hdr[2] != 0 || hdr[3] != 0 {
+		t.Fatalf("legacy header %x", hdr)
+	}
+	body := make([]byte, int(hdr[4])<<8|int(hdr[5]))
+	if _, err := io.ReadFull(stream, body); err != nil {
+		t.Fatal(err)
+	}
+	vp := &common.VeilinkProtocol{}
+	if err := json.Unmarshal(body, vp); err != nil || vp.PublicProtocol != TCP || vp.InternalIP != legacyRefusalHost {
+		t.Fatalf("got %+v, %v", vp, err)
+	}
+	if sm.IsOnline("c1") {
+		t.Fatal("legacy client admitted")
+	}
+
+	// 客户端拨号失败关闭stream后，服务端关闭会话
+	stream.Close()
+	done := make(chan error, 1)
+	go func() {
+		_, err := mux.AcceptStream()
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Fatal("session kept open")
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("session kept open")
+	}
+}
@@ -0,0 +1,294 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"html"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/netip"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/atopos31/go-veilink/internal/common"
+	"github.com/atopos31/go-veilink/internal/config"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	httpIdleTimeout     = time.Second * 90
+	httpMaxIdlePerHost  = 32
+	httpReadHeaderLimit = time.Second * 30
+)
+
+// 请求的公网地址，经transport拨号时用于挑选客户端及生成PROXY协议头
+type httpConnAddrKey struct{}
+
+type httpConnAddr struct {
+	remote net.Addr
+	local  net.Addr
+}
+
+// listenHTTP routes the requests for the tunnel on every port of the range. Http tunnels
+// share the entry on a port, each is a route matched by host and path prefix.
+func (l *Listener) listenHTTP() error {
+	opts := l.httpOptions()
+	domains := make([]string, 0, len(opts.Domains))
+	for _, domain := range opts.Domains {
+		domains = append(domains, strings.ToLower(domain))
+	}
+	for offset := 0; offset < l.PortCount(); offset++ {
+		addr, err := httpRouterAddr(l.publicAddr(uint16(offset)))
+		if err != nil {
+			l.detachRoutes()
+			return err
+		}
+		route := &httpRoute{
+			listener: l,
+			addr:     addr,
+			domains:  domains,
+			location: normalizeLocation(opts.Location),
+			handler:  l.httpHandler(uint16(offset)),
+		}
+		if err := l.routers.attach(route); err != nil {
+			l.detachRoutes()
+			return err
+		}
+		l.routes = append(l.routes, route)
+	}
+	return nil
+}
+
+func (l *Listener) detachRoutes() {
+	for _, route := range l.routes {
+		l.routers.detach(route)
+	}
+	l.routes = nil
+}
+
+func (l *Listener) httpOptions() *config.HTTPOptions {
+	if l.listenerConfig.HTTP == nil {
+		return &config.HTTPOptions{}
+	}
+	return l.listenerConfig.HTTP
+}
+
+func (l *Listener) httpHandler(offset uint16) http.Handler {
+	opts := l.httpOptions()
+	location := normalizeLocation(opts.Location)
+	internal := l.internalAddr(offset)
+	transport := &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return l.dialHTTP(ctx, offset)
+		},
+		MaxIdleConnsPerHost: httpMaxIdlePerHost,
+		IdleConnTimeout:     httpIdleTimeout,
+		// PROXY协议头描述的是单个访问者，按来源挑选客户端时stream也只属于一个访问者，
+		// 此时stream不能被其他访问者的请求复用
+		DisableKeepAlives: l.listenerConfig.ProxyProtocol != "" || l.listenerConfig.LoadBalance == LBSourceHash,
+	}
+	proxy := &httputil.ReverseProxy{
+		Rewrite: func(pr *httputil.ProxyRequest) {
+			pr.SetXForwarded()
+			if ip, _, err := net.SplitHostPort(pr.In.RemoteAddr); err == nil {
+				pr.Out.Header.Set("X-Real-IP", ip)
+			}
+			pr.Out.URL.Scheme = "http"
+			pr.Out.URL.Host = internal
+			if opts.StripPrefix {
+				pr.Out.URL.Path = stripLocation(location, pr.Out.URL.Path)
+				pr.Out.URL.RawPath = stripLocation(location, pr.Out.URL.RawPath)
+			}
+			if opts.HostRewrite {
+				pr.Out.Host = internal
+			}
+			for _, name := range opts.RemoveHeaders {
+				pr.Out.Header.Del(name)
+			}
+			for name, value := range opts.SetHeaders {
+				if http.CanonicalHeaderKey(name) == "Host" {
+					pr.Out.Host = value
+					continue
+				}
+				pr.Out.Header.Set(name, value)
+			}
+		},
+		Transport: transport,
+		ModifyResponse: func(resp *http.Response) error {
+			for _, name := range opts.RemoveResponseHeaders {
+				resp.Header.Del(name)
+			}
+			for name, value := range opts.SetResponseHeaders {
+				resp.Header.Set(name, value)
+			}
+			return nil
+		},
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			logrus.Warnf("http %s %s from %s fail: %v", r.Method, r.URL.Path, r.RemoteAddr, err)
+			writeErrorPage(w, http.StatusBadGateway, err.Error())
+		},
+		ErrorLog: log.New(logrus.StandardLogger().WriterLevel(logrus.DebugLevel), "", 0),
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !l.checkBasicAuth(r, opts.AuthPaths) {
+			w.Header().Set("WWW-Authenticate", `Basic realm="veilink", charset="UTF-8"`)
+			writeErrorPage(w, http.StatusUnauthorized, "authentication required")
+			return
+		}
+		addr := httpConnAddr{remote: parseTCPAddr(r.RemoteAddr), local: &net.TCPAddr{}}
+		if local, ok := r.Context().Value(http.LocalAddrContextKey).(net.Addr); ok {
+			addr.local = local
+		}
+		proxy.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), httpConnAddrKey{}, addr)))
+	})
+}
+
+// 未配置用户名时不认证，配置了auth_paths时只保护这些路径前缀。
+// 路径先经path.Clean再按路径段匹配，//admin、/./admin 与 /admin 相同，/administrator 不匹配 /admin
+func (l *Listener) checkBasicAuth(r *http.Request, authPaths []string) bool {
+	if l.listenerConfig.Username == "" {
+		return true
+	}
+	if len(authPaths) > 0 {
+		reqPath := path.Clean("/" + r.URL.Path)
+		protected := false
+		for _, prefix := range authPaths {
+			if matchLocation(normalizeLocation(path.Clean("/"+prefix)), reqPath) {
+				protected = true
+				break
+			}
+		}
+		if !protected {
+			return true
+		}
+	}
+	username, password, ok := r.BasicAuth()
+	return ok && l.checkProxyAuth(username, password)
+}
+
+// dialHTTP opens a tunnel stream for the transport of an http tunnel. The stream is
+// counted as an active connection of its client until the transport closes it.
+func (l *Listener) dialHTTP(ctx context.Context, offset uint16) (net.Conn, error) {
+	addr, ok := ctx.Value(httpConnAddrKey{}).(httpConnAddr)
+	if !ok {
+		addr = httpConnAddr{remote: &net.TCPAddr{}, local: &net.TCPAddr{}}
+	}
+	clientID, tunnelConn, err := l.openTunnelWith(addr.remote, l.connProtocol(offset, addr.remote, addr.local))
+	if err != nil {
+		return nil, err
+	}
+	l.balancer.acquire(clientID)
+	logrus.Debugf("%s http stream opened for %s", clientID, addr.remote)
+	return &httpTunnelConn{VeilConn: tunnelConn, listener: l, clientID: clientID, local: addr.local, remote: addr.remote}, nil
+}
+
+func parseTCPAddr(addr string) net.Addr {
+	addrPort, err := netip.ParseAddrPort(addr)
+	if err != nil {
+		return &net.TCPAddr{}
+	}
+	return net.TCPAddrFromAddrPort(addrPort)
+}
+
+// httpTunnelConn 供http.Transport使用的隧道stream，记录流量并在关闭时释放连接计数
+type httpTunnelConn struct {
+	common.VeilConn
+	listener  *Listener
+	clientID  string
+	local     net.Addr
+	remote    net.Addr
+	closeOnce sync.Once
+}
+
+func (c *httpTunnelConn) Read(p []byte) (int, error) {
+	n, err := c.VeilConn.Read(p)
+	c.listener.ioData.AddInput(int64(n))
+	return n, err
+}
+
+func (c *httpTunnelConn) Write(p []byte) (int, error) {
+	n, err := c.VeilConn.Write(p)
+	c.listener.ioData.AddOutput(int64(n))
+	return n, err
+}
+
+func (c *httpTunnelConn) Close() error {
+	err := c.VeilConn.Close()
+	c.closeOnce.Do(func() {
+		c.listener.balancer.release(c.clientID)
+		logrus.Debugf("%s http stream closed for %s", c.clientID, c.remote)
+	})
+	return err
+}
+
+func (c *httpTunnelConn) LocalAddr() net.Addr  { return c.local }
+func (c *httpTunnelConn) RemoteAddr() net.Addr { return c.remote }
+
+func (c *httpTunnelConn) SetDeadline(t time.Time) error {
+	if err := c.VeilConn.SetReadDeadline(t); err != nil {
+		return err
+	}
+	return c.VeilConn.SetWriteDeadline(t)
+}
+
+// proxyProtoListener 在各自的协程中读取PROXY协议头，避免慢速连接阻塞Accept
+type proxyProtoListener struct {
+	net.Listener
+	conns chan net.Conn
+	done  chan struct{}
+	err   error
+}
+
+func newProxyProtoListener(ln net.Listener) net.Listener {
+	pl := &proxyProtoListener{Listener: ln, conns: make(chan net.Conn), done: make(chan struct{})}
+	go pl.acceptLoop()
+	return pl
+}
+
+func (pl *proxyProtoListener) acceptLoop() {
+	defer close(pl.done)
+	for {
+		conn, err := pl.Listener.Accept()
+		if err != nil {
+			pl.err = err
+			return
+		}
+		go func() {
+			conn, remote, local, err := acceptProxyHeader(conn)
+			if err != nil {
+				logrus.Warnf("proxy protocol from %s: %v", conn.RemoteAddr(), err)
+				conn.Close()
+				return
+			}
+			buffered := conn.(*bufferedConn)
+			buffered.remote, buffered.local = remote, local
+			select {
+			case pl.conns <- buffered:
+			case <-pl.done:
+				conn.Close()
+			}
+		}()
+	}
+}
+
+func (pl *proxyProtoListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-pl.conns:
+		return conn, nil
+	case <-pl.done:
+		return nil, pl.err
+	}
+}
+
+// writeErrorPage answers a public http request with the veilink error page.
+func writeErrorPage(w http.ResponseWriter, code int, reason string) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(code)
+	fmt.Fprintf(w, "<html><head><title>%d %s</title></head><body><h1>%d %s</h1><p>veilink: %s</p></body></html>",
+		code, http.StatusText(code), code, http.StatusText(code), html.EscapeString(reason))
+}
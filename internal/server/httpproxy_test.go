@@ -0,0 +1,152 @@
+package server
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/atopos31/go-veilink/internal/common"
+	"github.com/atopos31/go-veilink/internal/config"
+)
+
+func TestHTTPBasicAuthPaths(t *testing.T) {
+	l, _ := newTestListener(&config.Listener{
+		PublicProtocol: HTTP,
+		InternalIP:     "127.0.0.1",
+		InternalPort:   80,
+		Username:       "user",
+		Password:       "pass",
+		HTTP:           &config.HTTPOptions{AuthPaths: []string{"/admin/"}},
+	})
+	handler := l.httpHandler(0)
+	for _, tc := range []struct {
+		path string
+		auth bool
+	}{
+		{"/admin", true},
+		{"/admin/users", true},
+		{"//admin", true},
+		{"/./admin", true},
+		{"/static/../admin/users", true},
+		{"/administrator", false},
+		{"/", false},
+	} {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, tc.path, nil))
+		if got := rec.Code == http.StatusUnauthorized; got != tc.auth {
+			t.Errorf("%s: status %d", tc.path, rec.Code)
+		}
+	}
+	// 认证通过后转发，客户端不在线时返回502错误页
+	req := httptest.NewRequest(http.MethodGet, "//admin", nil)
+	req.SetBasicAuth("user", "pass")
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	if rec.Code != http.StatusBadGateway || !strings.Contains(rec.Body.String(), "veilink: "+ErrNoClientOnline.Error()) {
+		t.Fatalf("status %d: %s", rec.Code, rec.Body)
+	}
+}
+
+func TestHTTPHeaderRewrite(t *testing.T) {
+	l, sm := newTestListener(&config.Listener{
+		PublicProtocol: HTTP,
+		InternalIP:     "127.0.0.1",
+		InternalPort:   8080,
+		HTTP: &config.HTTPOptions{
+			Location:              "/api",
+			StripPrefix:           true,
+			SetHeaders:            map[string]string{"X-Test": "1", "Host": "internal.example"},
+			RemoveHeaders:         []string{"Cookie"},
+			SetResponseHeaders:    map[string]string{"X-Resp": "1"},
+			RemoveResponseHeaders: []string{"Server"},
+		},
+	})
+	mux := connectClient(t, sm, "c1", common.Capabilities)
+	received := make(chan *http.Request, 1)
+	go func() {
+		stream, _, err := acceptTunnel(mux)
+		if err != nil {
+			return
+		}
+		defer stream.Close()
+		writeStatus(stream, "")
+		req, err := http.ReadRequest(bufio.NewReader(stream))
+		if err != nil {
+			return
+		}
+		received <- req
+		stream.Write([]byte("HTTP/1.1 200 OK\r\nServer: internal\r\nContent-Length: 2\r\nConnection: close\r\n\r\nok"))
+	}()
+
+	req := httptest.NewRequest(http.MethodGet, "http://public.example/api/users", nil)
+	req.Header.Set("Cookie", "session=1")
+	rec := httptest.NewRecorder()
+	l.httpHandler(0).ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK || rec.Body.String() != "ok" {
+		t.Fatalf("status %d %q", rec.Code, rec.Body.String())
+	}
+	if rec.Header().Get("X-Resp") != "1" || rec.Header().Get("Server") != "" {
+		t.Fatalf("response headers %v", rec.Header())
+	}
+	got := <-received
+	if got.URL.Path != "/users" || got.Host != "internal.example" {
+		t.Fatalf("got %s %s", got.Host, got.URL.Path)
+	}
+	if got.Header.Get("X-Test") != "1" || got.Header.Get("Cookie") != "" {
+		t.Fatalf("request headers %v", got.Header)
+	}
+	if got.Header.Get("X-Real-IP") != "192.0.2.1" || got.Header.Get("X-Forwarded-For") != "192.0.2.1" {
+		t.Fatalf("forwarded headers %v", got.Header)
+	}
+}
+
+func TestProxyProtoListener(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pl := newProxyProtoListener(ln)
+	defer pl.Close()
+
+	// 协议头错误的连接被丢弃，不影响之后的连接
+	bad, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bad.Close()
+	bad.Write([]byte("GET / HTTP/1.1\r\n\r\n"))
+
+	hdr, err := common.EncodeProxyHeader(common.ProxyProtocolV2, "[2001:db8::7]:52311", "[2001:db8::1]:443")
+	if err != nil {
+		t.Fatal(err)
+	}
+	good, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer good.Close()
+	good.Write(append(hdr, "hello"...))
+
+	conn, err := pl.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if conn.RemoteAddr().String() != "[2001:db8::7]:52311" || conn.LocalAddr().String() != "[2001:db8::1]:443" {
+		t.Fatalf("addresses %v => %v", conn.RemoteAddr(), conn.LocalAddr())
+	}
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	payload := make([]byte, 5)
+	if _, err := io.ReadFull(conn, payload); err != nil || string(payload) != "hello" {
+		t.Fatalf("payload %q, %v", payload, err)
+	}
+	bad.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := bad.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("connection with a bad header got %v", err)
+	}
+}
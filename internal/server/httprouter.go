@@ -0,0 +1,260 @@
+package server
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/netip"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+	"golang.org/x/crypto/acme"
+)
+
+// httpRouters 按公网地址共享的http入口，同一端口上的多个http隧道按域名及路径前缀分发请求
+type httpRouters struct {
+	lock    sync.Mutex
+	routers map[string]*httpRouter // 规范化后的公网地址 => 入口
+}
+
+func newHTTPRouters() *httpRouters {
+	return &httpRouters{routers: make(map[string]*httpRouter)}
+}
+
+// httpRoute 一个http隧道在某个端口上的路由
+type httpRoute struct {
+	listener *Listener
+	addr     string   // 规范化后的公网地址，见httpRouterAddr
+	domains  []string // 为空时匹配所有域名
+	location string   // 路径前缀
+	handler  http.Handler
+}
+
+// httpRouterAddr canonicalizes a listen address, so that tunnels written as
+// ":80", "0.0.0.0:80" or "[::]:80" share one entry instead of failing to listen.
+func httpRouterAddr(addr string) (string, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", err
+	}
+	portNum, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return "", fmt.Errorf("invalid port %q", port)
+	}
+	if ip, err := netip.ParseAddr(host); err == nil {
+		// 未指定地址时监听所有地址
+		if ip = ip.Unmap(); ip.IsUnspecified() {
+			host = ""
+		} else {
+			host = ip.String()
+		}
+	} else {
+		host = strings.ToLower(strings.TrimSuffix(host, "."))
+	}
+	return net.JoinHostPort(host, strconv.FormatUint(portNum, 10)), nil
+}
+
+// attach adds the route to the entry on its address, listening on the address
+// when it is the first route there.
+func (rs *httpRouters) attach(route *httpRoute) error {
+	rs.lock.Lock()
+	defer rs.lock.Unlock()
+	router := rs.routers[route.addr]
+	if router == nil {
+		ln, err := net.Listen("tcp", route.addr)
+		if err != nil {
+			return err
+		}
+		router = newHTTPRouter(ln, route.listener)
+		rs.routers[route.addr] = router
+		go router.serve(ln)
+	} else if err := router.compatible(route.listener); err != nil {
+		return err
+	}
+	return router.add(route)
+}
+
+// detach removes the route, the entry stops listening once its last route is gone.
+func (rs *httpRouters) detach(route *httpRoute) {
+	rs.lock.Lock()
+	defer rs.lock.Unlock()
+	router := rs.routers[route.addr]
+	if router == nil {
+		return
+	}
+	if router.remove(route) == 0 {
+		router.server.Close()
+		delete(rs.routers, route.addr)
+	}
+}
+
+type httpRouter struct {
+	server      *http.Server
+	tls         bool
+	acceptProxy bool
+	lock        sync.RWMutex
+	routes      []*httpRoute
+}
+
+// 入口是否使用https及是否接受PROXY协议头由第一个隧道决定，之后的隧道需与其一致
+func newHTTPRouter(ln net.Listener, first *Listener) *httpRouter {
+	router := &httpRouter{
+		tls:         first.tlsConfig != nil,
+		acceptProxy: first.listenerConfig.AcceptProxy,
+	}
+	router.server = &http.Server{
+		Handler:           router,
+		ReadHeaderTimeout: httpReadHeaderLimit,
+		IdleTimeout:       httpIdleTimeout,
+		ErrorLog:          log.New(logrus.StandardLogger().WriterLevel(logrus.DebugLevel), "", 0),
+	}
+	if router.tls {
+		router.server.TLSConfig = &tls.Config{
+			GetCertificate: router.getCertificate,
+			NextProtos:     []string{"h2", "http/1.1", acme.ALPNProto},
+			MinVersion:     tls.VersionTLS12,
+		}
+	}
+	return router
+}
+
+func (r *httpRouter) serve(ln net.Listener) {
+	if r.acceptProxy {
+		ln = newProxyProtoListener(ln)
+	}
+	if r.tls {
+		r.server.ServeTLS(ln, "", "")
+		return
+	}
+	r.server.Serve(ln)
+}
+
+func (r *httpRouter) compatible(l *Listener) error {
+	if r.tls != (l.tlsConfig != nil) {
+		return errors.New("http and https tunnels can not share a port")
+	}
+	if r.acceptProxy != l.listenerConfig.AcceptProxy {
+		return errors.New("tunnels sharing a port must agree on accept_proxy_protocol")
+	}
+	return nil
+}
+
+func (r *httpRouter) add(route *httpRoute) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	for _, other := range r.routes {
+		if other.location == route.location && domainsOverlap(other.domains, route.domains) {
+			return fmt.Errorf("route %s%s is already used by another tunnel", strings.Join(route.domains, ","), route.location)
+		}
+	}
+	r.routes = append(r.routes, route)
+	return nil
+}
+
+func (r *httpRouter) remove(route *httpRoute) int {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.routes = slices.DeleteFunc(r.routes, func(other *httpRoute) bool { return other == route })
+	return len(r.routes)
+}
+
+// 不限域名的路由只与另一个不限域名的路由冲突，指定了域名的路由优先
+func domainsOverlap(a, b []string) bool {
+	if len(a) == 0 || len(b) == 0 {
+		return len(a) == len(b)
+	}
+	for _, domain := range a {
+		if slices.Contains(b, domain) {
+			return true
+		}
+	}
+	return false
+}
+
+// match picks the route with the longest location matching the request, a route
+// listing the host wins over a route for all hosts with the same location.
+func (r *httpRouter) match(host, path string) *httpRoute {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	var best *httpRoute
+	for _, route := range r.routes {
+		if !route.matchHost(host) || !matchLocation(route.location, path) {
+			continue
+		}
+		if best == nil || len(route.location) > len(best.location) ||
+			(len(route.location) == len(best.location) && len(route.domains) > 0 && len(best.domains) == 0) {
+			best = route
+		}
+	}
+	return best
+}
+
+func (route *httpRoute) matchHost(host string) bool {
+	return len(route.domains) == 0 || slices.Contains(route.domains, host)
+}
+
+func (r *httpRouter) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	host := req.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	route := r.match(strings.ToLower(host), req.URL.Path)
+	if route == nil {
+		writeErrorPage(w, http.StatusNotFound, "no tunnel for "+host+req.URL.Path)
+		return
+	}
+	route.handler.ServeHTTP(w, req)
+}
+
+// 按SNI挑选隧道的证书，配置了该域名的隧道优先，其次是不限域名的隧道；
+// 都没有时握手失败，不会用其他域名的证书应答
+func (r *httpRouter) getCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	serverName := strings.ToLower(strings.TrimSuffix(hello.ServerName, "."))
+	r.lock.RLock()
+	var picked *httpRoute
+	for _, route := range r.routes {
+		tlsDomains := route.listener.listenerConfig.TLS.Domains
+		sameName := func(domain string) bool { return normalizeDomain(domain) == serverName }
+		if slices.Contains(route.domains, serverName) || slices.ContainsFunc(tlsDomains, sameName) {
+			picked = route
+			break
+		}
+		if picked == nil && len(route.domains) == 0 && len(tlsDomains) == 0 {
+			picked = route
+		}
+	}
+	r.lock.RUnlock()
+	if picked == nil {
+		return nil, fmt.Errorf("%w: no tunnel for server name %q", ErrNoCertificate, serverName)
+	}
+	return picked.listener.getCertificate(hello)
+}
+
+// normalizeLocation 路径前缀以/开始，除根路径外不以/结尾
+func normalizeLocation(location string) string {
+	if location == "" || location == "/" {
+		return "/"
+	}
+	return "/" + strings.Trim(location, "/")
+}
+
+// 前缀按路径段匹配，/api 匹配 /api 及 /api/x，不匹配 /apix
+func matchLocation(location, path string) bool {
+	return location == "/" || path == location || strings.HasPrefix(path, location+"/")
+}
+
+func stripLocation(location, path string) string {
+	if location == "/" || !matchLocation(location, path) {
+		return path
+	}
+	if path = strings.TrimPrefix(path, location); path == "" {
+		return "/"
+	}
+	return path
+}
@@ -0,0 +1,138 @@
+package server
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"testing"
+
+	"github.com/atopos31/go-veilink/internal/config"
+)
+
+func TestHTTPRouteMatch(t *testing.T) {
+	root := &httpRoute{location: "/"}
+	api := &httpRoute{location: "/api"}
+	apiV2 := &httpRoute{location: "/api/v2"}
+	appAPI := &httpRoute{location: "/api", domains: []string{"app.example"}}
+	router := &httpRouter{}
+	for _, route := range []*httpRoute{root, api, apiV2, appAPI} {
+		if err := router.add(route); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := router.add(&httpRoute{location: "/api", domains: []string{"app.example"}}); err == nil {
+		t.Fatal("duplicate route accepted")
+	}
+
+	cases := []struct {
+		host, path string
+		want       *httpRoute
+	}{
+		{"other.example", "/", root},
+		{"other.example", "/apix", root},
+		{"other.example", "/api", api},
+		{"other.example", "/api/users", api},
+		{"other.example", "/api/v2/users", apiV2},
+		{"app.example", "/api/users", appAPI},
+		{"app.example", "/api/v2", apiV2},
+	}
+	for _, c := range cases {
+		if got := router.match(c.host, c.path); got != c.want {
+			t.Errorf("%s%s matched %+v", c.host, c.path, got)
+		}
+	}
+}
+
+func TestStripLocation(t *testing.T) {
+	cases := []struct{ location, path, want string }{
+		{"/", "/a", "/a"},
+		{"/api", "/api", "/"},
+		{"/api", "/api/users", "/users"},
+		{"/api", "/apix", "/apix"},
+		{normalizeLocation("api/"), "/api/x", "/x"},
+	}
+	for _, c := range cases {
+		if got := stripLocation(c.location, c.path); got != c.want {
+			t.Errorf("strip %s from %s: got %s, want %s", c.location, c.path, got, c.want)
+		}
+	}
+}
+
+func TestHTTPRouterAddr(t *testing.T) {
+	cases := map[string]string{
+		":80":                 ":80",
+		"0.0.0.0:80":          ":80",
+		"[::]:80":             ":80",
+		"127.0.0.1:080":       "127.0.0.1:80",
+		"[::ffff:1.2.3.4]:80": "1.2.3.4:80",
+		"[::1]:443":           "[::1]:443",
+		"Example.COM.:8080":   "example.com:8080",
+	}
+	for addr, want := range cases {
+		if got, err := httpRouterAddr(addr); err != nil || got != want {
+			t.Errorf("%s: got %s, %v", addr, got, err)
+		}
+	}
+	for _, addr := range []string{"127.0.0.1", "127.0.0.1:70000", "127.0.0.1:http"} {
+		if _, err := httpRouterAddr(addr); err == nil {
+			t.Errorf("%s accepted", addr)
+		}
+	}
+
+	// 写法不同的同一地址共用一个入口
+	port := strconv.Itoa(int(freePort(t)))
+	rs := newHTTPRouters()
+	var routes []*httpRoute
+	for i, host := range []string{"", "0.0.0.0", "::"} {
+		addr, err := httpRouterAddr(net.JoinHostPort(host, port))
+		if err != nil {
+			t.Fatal(err)
+		}
+		route := &httpRoute{listener: NewListener(&config.Listener{}, nil, nil), addr: addr, location: fmt.Sprintf("/%d", i)}
+		if err := rs.attach(route); err != nil {
+			t.Fatal(err)
+		}
+		routes = append(routes, route)
+	}
+	if len(rs.routers) != 1 {
+		t.Fatalf("%d entries", len(rs.routers))
+	}
+	for _, route := range routes {
+		rs.detach(route)
+	}
+	if len(rs.routers) != 0 {
+		t.Fatalf("%d entries left", len(rs.routers))
+	}
+}
+
+func TestHTTPRouterCertificate(t *testing.T) {
+	route := func(name string, domains ...string) *httpRoute {
+		certPEM, keyPEM := selfSigned(t, name)
+		cert, err := tls.X509KeyPair(certPEM, keyPEM)
+		if err != nil {
+			t.Fatal(err)
+		}
+		l := NewListener(&config.Listener{TLS: &config.TLSOptions{}}, nil, nil)
+		l.cert.Store(&cert)
+		return &httpRoute{listener: l, domains: domains, location: "/" + name}
+	}
+	router := &httpRouter{}
+	router.add(route("a.example", "a.example"))
+	if _, err := router.getCertificate(&tls.ClientHelloInfo{ServerName: "b.example"}); !errors.Is(err, ErrNoCertificate) {
+		t.Fatalf("unknown server name got %v", err)
+	}
+	cert, err := router.getCertificate(&tls.ClientHelloInfo{ServerName: "A.example."})
+	if err != nil || leafName(t, cert) != "a.example" {
+		t.Fatalf("got %v", err)
+	}
+	// 不限域名的隧道应答其他域名
+	router.add(route("any.example"))
+	if cert, err = router.getCertificate(&tls.ClientHelloInfo{ServerName: "b.example"}); err != nil || leafName(t, cert) != "any.example" {
+		t.Fatalf("got %v", err)
+	}
+	if cert, err = router.getCertificate(&tls.ClientHelloInfo{ServerName: "a.example"}); err != nil || leafName(t, cert) != "a.example" {
+		t.Fatalf("got %v", err)
+	}
+}
@@ -1,6 +1,9 @@
 package server
 
-import "sync"
+import (
+	"sync"
+	"time"
+)
 
 // 保存listener输入输出的数据总大小
 type IOdata struct {
@@ -33,3 +36,25 @@ func (io *IOdata) GetOutput() int64 {
 	defer io.outmux.RUnlock()
 	return io.output
 }
+
+// 记录隧道内网拨号失败的次数及最近一次失败原因
+type DialErrors struct {
+	mu        sync.RWMutex
+	count     int64
+	lastError string
+	lastTime  time.Time
+}
+
+func (d *DialErrors) Add(reason string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.count++
+	d.lastError = reason
+	d.lastTime = time.Now()
+}
+
+func (d *DialErrors) Get() (count int64, lastError string, lastTime time.Time) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return d.count, d.lastError, d.lastTime
+}
@@ -1,11 +1,16 @@
 package server
 
 import (
+	"bufio"
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"io"
 	"net"
+	"slices"
+	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/atopos31/go-veilink/internal/common"
@@ -14,229 +19,691 @@ import (
 )
 
 var (
-	writeTimeout = time.Second * 3
+	writeTimeout  = time.Second * 3
+	statusTimeout = time.Second * 10
 )
 
 const (
-	TCP = "tcp"
-	UDP = "udp"
+	TCP  = "tcp"
+	UDP  = "udp"
+	HTTP = "http"
+	STCP = "stcp" // 不开放公网端口，仅供持有共享密钥的访问者经由gateway访问
+	// 在公网端口提供socks5及HTTP CONNECT代理，目标地址由客户端拨号
+	SOCKS5 = "socks5"
 )
 
+// TunnelStats 隧道的流量及错误统计
+type TunnelStats struct {
+	Input           int64     `json:"input"`
+	Output          int64     `json:"output"`
+	DialErrors      int64     `json:"dial_errors"`
+	LastDialError   string    `json:"last_dial_error"`
+	LastDialErrorAt time.Time `json:"last_dial_error_at"`
+	UDPFlows        int       `json:"udp_flows,omitempty"`         // 当前活跃的UDP流
+	UDPFlowsDropped int64     `json:"udp_flows_dropped,omitempty"` // 因超出流数量上限被丢弃的新流
+	UDPOversized    int64     `json:"udp_oversized,omitempty"`     // 因超出长度上限被丢弃的数据包
+	Compression     string    `json:"compression,omitempty"`
+	CompressedBytes int64     `json:"compressed_bytes,omitempty"` // 压缩后经会话收发的字节数
+	CompressRatio   float64   `json:"compress_ratio,omitempty"`   // 压缩前后字节数之比，两个方向合计
+}
+
 type Listener struct {
 	Uuid           string
 	listenerConfig *config.Listener
 	Encrypt        bool
-	Key            []byte
+	keymap         *keymap
 	sessionMgr     *SessionManager
+	balancer       *balancer
 	closeOnce      sync.Once
-	listener       common.ConnWithClose
-	udpSessionMgr  *UDPSessionManage
+	listeners      []common.ConnWithClose // 端口范围内每个端口一个
+	udpFlows       *udpFlowTable
+	udpMuxLock     sync.Mutex
+	udpMuxes       map[string]*udpMux // clientID/端口偏移 => 复用的UDP stream
+	udpOversized   atomic.Int64
 	ioData         *IOdata
+	dialErrors     *DialErrors
+	compression    common.Compression
+	compressStats  *common.CompressStats
+	certs          *certManager                    // https隧道的证书来源
+	cert           atomic.Pointer[tls.Certificate] // 手动提供的证书
+	tlsConfig      *tls.Config
+	routers        *httpRouters // http隧道共享的入口
+	routes         []*httpRoute
 }
 
-func NewListener(listenerConfig *config.Listener, key []byte, sessionMgr *SessionManager, udpSessionMgr *UDPSessionManage) *Listener {
+func NewListener(listenerConfig *config.Listener, keymap *keymap, sessionMgr *SessionManager) *Listener {
+	// 已在添加隧道时校验
+	compression, _ := common.ParseCompression(listenerConfig.Compression)
 	return &Listener{
 		Uuid:           listenerConfig.Uuid,
 		Encrypt:        listenerConfig.Encrypt,
-		Key:            key,
+		keymap:         keymap,
 		listenerConfig: listenerConfig,
 		sessionMgr:     sessionMgr,
-		udpSessionMgr:  udpSessionMgr,
+		balancer:       newBalancer(listenerConfig.LoadBalance),
+		udpMuxes:       make(map[string]*udpMux),
 		ioData:         new(IOdata),
+		dialErrors:     new(DialErrors),
+		compression:    compression,
+		compressStats:  new(common.CompressStats),
 	}
 }
 
+// Clients returns the clients serving this tunnel, the owner first.
+func (l *Listener) Clients() []string {
+	clients := []string{l.listenerConfig.ClientID}
+	for _, clientID := range l.listenerConfig.Backends {
+		if !slices.Contains(clients, clientID) {
+			clients = append(clients, clientID)
+		}
+	}
+	return clients
+}
+
 func (l *Listener) ListenAndServe() error {
 	switch l.listenerConfig.PublicProtocol {
-	case TCP:
+	case TCP, SOCKS5:
 		return l.listenerAndServerTCP()
+	case HTTP:
+		return l.listenHTTP()
 	case UDP:
 		return l.listenerAndServerUDP()
+	case STCP:
+		return nil
 	default:
 		return fmt.Errorf("TODO://")
 	}
 }
 
-func (l *Listener) listenerAndServerTCP() error {
-	addr := fmt.Sprintf("%s:%d", l.listenerConfig.PublicIP, l.listenerConfig.PublicPort)
-	tcpListener, err := net.Listen("tcp", addr)
-	if err != nil {
-		return err
+// PortCount returns the number of consecutive ports mapped by the tunnel.
+func (l *Listener) PortCount() int {
+	if l.listenerConfig.PortCount <= 1 {
+		return 1
 	}
-	l.listener = tcpListener
+	return int(l.listenerConfig.PortCount)
+}
 
-	go func() {
-		defer tcpListener.Close()
-		for {
-			conn, err := tcpListener.Accept()
-			if err != nil {
-				return
+func (l *Listener) publicAddr(offset uint16) string {
+	return net.JoinHostPort(l.listenerConfig.PublicIP, strconv.Itoa(int(l.listenerConfig.PublicPort+offset)))
+}
+
+// 端口范围内的端口要么全部监听成功，要么全部关闭
+func (l *Listener) listenerAndServerTCP() error {
+	tcpListeners := make([]net.Listener, 0, l.PortCount())
+	for offset := 0; offset < l.PortCount(); offset++ {
+		tcpListener, err := net.Listen("tcp", l.publicAddr(uint16(offset)))
+		if err != nil {
+			for _, opened := range tcpListeners {
+				opened.Close()
 			}
-			go l.handleConn(conn)
+			return err
 		}
-	}()
+		tcpListeners = append(tcpListeners, tcpListener)
+	}
+
+	for offset, tcpListener := range tcpListeners {
+		l.listeners = append(l.listeners, tcpListener)
+		go func(tcpListener net.Listener, offset uint16) {
+			defer tcpListener.Close()
+			for {
+				conn, err := tcpListener.Accept()
+				if err != nil {
+					return
+				}
+				go l.handleConn(conn, offset)
+			}
+		}(tcpListener, uint16(offset))
+	}
 	return nil
 }
 
-func (l *Listener) handleConn(conn net.Conn) {
+// handleConn serves a public connection accepted on the offset-th port of the range.
+func (l *Listener) handleConn(conn net.Conn, offset uint16) {
+	remote, local := conn.RemoteAddr(), conn.LocalAddr()
+	if l.listenerConfig.AcceptProxy {
+		var err error
+		if conn, remote, local, err = acceptProxyHeader(conn); err != nil {
+			logrus.Warnf("proxy protocol from %s: %v", conn.RemoteAddr(), err)
+			conn.Close()
+			return
+		}
+	}
+	if l.listenerConfig.PublicProtocol == SOCKS5 {
+		l.serveProxy(conn, remote, local)
+		return
+	}
 	defer conn.Close()
 
-	// search session
-	tunnelConn, err := l.sessionMgr.GetSessionConnByID(l.listenerConfig.ClientID)
+	clientID, tunnelConn, err := l.openTunnelWith(remote, l.connProtocol(offset, remote, local))
 	if err != nil {
-		logrus.Warnf("get session fail: %v", err)
+		logrus.Warnf("open tunnel fail: %v", err)
 		return
 	}
 	defer tunnelConn.Close()
+	l.balancer.acquire(clientID)
+	defer l.balancer.release(clientID)
 
-	if err := l.sendEncryptProtocol(tunnelConn); err != nil {
-		logrus.Warnf("send encrypt protocol fail: %v", err)
-		return
+	in, out := common.Join(conn, tunnelConn)
+	// add io data
+	l.ioData.AddInput(in)
+	l.ioData.AddOutput(out)
+	logrus.Infof("%s in: %d bytes, out: %d bytes", clientID, in, out)
+}
+
+// bufferedConn 读取协议头时bufio可能已读取了后续数据，之后的读取需经过该reader
+type bufferedConn struct {
+	net.Conn
+	reader *bufio.Reader
+	remote net.Addr // PROXY协议头中的原始地址，为空时使用连接本身的地址
+	local  net.Addr
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.reader.Read(p)
+}
+
+func (c *bufferedConn) RemoteAddr() net.Addr {
+	if c.remote != nil {
+		return c.remote
 	}
-	if l.Encrypt {
-		tunnelConn, err = common.NewChacha20Stream(l.Key, tunnelConn)
-		if err != nil {
-			logrus.Warnf("new chacha20 stream fail: %v", err)
-			return
+	return c.Conn.RemoteAddr()
+}
+
+func (c *bufferedConn) LocalAddr() net.Addr {
+	if c.local != nil {
+		return c.local
+	}
+	return c.Conn.LocalAddr()
+}
+
+// acceptProxyHeader reads the PROXY header the load balancer in front of the listener sends,
+// returning the connection to continue with and the addresses of the original connection.
+func acceptProxyHeader(conn net.Conn) (net.Conn, net.Addr, net.Addr, error) {
+	reader := bufio.NewReader(conn)
+	conn.SetReadDeadline(time.Now().Add(handshakeTimeout))
+	src, dst, err := common.ReadProxyHeader(reader)
+	conn.SetReadDeadline(time.Time{})
+	if err != nil {
+		return conn, nil, nil, err
+	}
+	if src == nil {
+		src, dst = conn.RemoteAddr(), conn.LocalAddr()
+	}
+	return &bufferedConn{Conn: conn, reader: reader}, src, dst, nil
+}
+
+// connProtocol builds the veilink protocol of a public connection from remote to local,
+// carrying the addresses when the tunnel sends PROXY headers to the internal service.
+func (l *Listener) connProtocol(offset uint16, remote, local net.Addr) func(clientID string) *common.VeilinkProtocol {
+	return func(clientID string) *common.VeilinkProtocol {
+		vp := l.veilinkProtocol(clientID, offset)
+		if l.listenerConfig.ProxyProtocol != "" {
+			vp.ProxyProtocol = l.listenerConfig.ProxyProtocol
+			vp.RemoteAddr = remote.String()
+			vp.LocalAddr = local.String()
 		}
+		return vp
+	}
+}
+
+// ServeVisitor relays a visitor connection of an stcp tunnel, telling the visitor
+// whether the internal service was reached before any data flows.
+func (l *Listener) ServeVisitor(conn net.Conn) {
+	defer conn.Close()
+
+	clientID, tunnelConn, err := l.openTunnelWith(conn.RemoteAddr(), l.connProtocol(0, conn.RemoteAddr(), conn.LocalAddr()))
+	if err != nil {
+		logrus.Warnf("visitor %s open tunnel fail: %v", conn.RemoteAddr(), err)
+		sendStreamStatus(conn, err, common.FrameShort)
+		return
 	}
-	if err := l.sendVeilinkProtocol(tunnelConn); err != nil {
-		logrus.Warnf("send veilink protocol fail: %v", err)
+	defer tunnelConn.Close()
+	if err := sendStreamStatus(conn, nil, common.FrameShort); err != nil {
+		logrus.Warnf("visitor %s send status fail: %v", conn.RemoteAddr(), err)
 		return
 	}
+	l.balancer.acquire(clientID)
+	defer l.balancer.release(clientID)
 
 	in, out := common.Join(conn, tunnelConn)
-	// add io data
 	l.ioData.AddInput(in)
 	l.ioData.AddOutput(out)
-	logrus.Infof("%s in: %d bytes, out: %d bytes", l.listenerConfig.ClientID, in, out)
+	logrus.Infof("%s visitor %s in: %d bytes, out: %d bytes", clientID, conn.RemoteAddr(), in, out)
 }
 
-func (l *Listener) listenerAndServerUDP() error {
-	addr := fmt.Sprintf("%s:%d", l.listenerConfig.PublicIP, l.listenerConfig.PublicPort)
-	udpListener, err := net.ListenPacket("udp", addr)
-	if err != nil {
-		return err
+// openTunnel picks a client for a new public connection and returns a stream connected to the internal service.
+// Clients that are offline or fail to reach the internal service are skipped.
+func (l *Listener) openTunnel(remote net.Addr, offset uint16) (string, common.VeilConn, error) {
+	return l.openTunnelWith(remote, func(clientID string) *common.VeilinkProtocol {
+		return l.veilinkProtocol(clientID, offset)
+	})
+}
+
+// openTunnelWith is openTunnel with the veilink protocol sent to each client built by vp.
+func (l *Listener) openTunnelWith(remote net.Addr, vp func(clientID string) *common.VeilinkProtocol) (string, common.VeilConn, error) {
+	online := l.onlineClients()
+	if len(online) == 0 {
+		return "", nil, ErrNoClientOnline
 	}
 
-	buffer := make([]byte, 1024*64)
-	l.listener = udpListener
-	go func() {
-		defer udpListener.Close()
-		for {
-			n, remoteAddr, err := udpListener.ReadFrom(buffer)
-			if err != nil {
-				break
-			}
-			udpSess, err := l.udpSessionMgr.Get(remoteAddr.String())
-			if err != nil {
-				// 查询session
-				tunnelConn, err := l.sessionMgr.GetSessionConnByID(l.listenerConfig.ClientID)
-				if err != nil {
-					logrus.Warnf("get session fail: %v", err)
-					continue
-				}
+	var lastErr error
+	for _, clientID := range l.balancer.order(online, remote) {
+		tunnelConn, caps, err := l.sessionMgr.GetSessionConnByID(clientID)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		pp := vp(clientID)
+		tunnelConn, err = l.setupStream(clientID, tunnelConn, caps, pp)
+		if err != nil {
+			logrus.Warnf("client %s tunnel to %s fail: %v", clientID, tunnelTarget(pp), err)
+			lastErr = err
+			continue
+		}
+		return clientID, tunnelConn, nil
+	}
+	return "", nil, lastErr
+}
 
-				if err := l.sendEncryptProtocol(tunnelConn); err != nil {
-					logrus.Warnf("send encrypt protocol fail: %v", err)
-					continue
-				}
+func tunnelTarget(vp *common.VeilinkProtocol) string {
+	switch {
+	case vp.P2P != nil:
+		return "visitor " + vp.P2P.PeerAddr
+	case vp.Target != "":
+		return vp.Target
+	}
+	return net.JoinHostPort(vp.InternalIP, strconv.Itoa(int(vp.InternalPort)))
+}
 
-				if l.Encrypt {
-					tunnelConn, err = common.NewChacha20Stream(l.Key, tunnelConn)
-					if err != nil {
-						logrus.Warnf("new chacha20 stream fail: %v", err)
-						continue
-					}
-				}
+func (l *Listener) onlineClients() []string {
+	var online []string
+	for _, clientID := range l.Clients() {
+		if l.sessionMgr.IsOnline(clientID) {
+			online = append(online, clientID)
+		}
+	}
+	return online
+}
 
-				if err := l.sendVeilinkProtocol(tunnelConn); err != nil {
-					logrus.Warnf("send encrypt protocol fail: %v", err)
-					continue
-				}
+func (l *Listener) openTunnelTo(clientID string, offset uint16) (common.VeilConn, error) {
+	tunnelConn, caps, err := l.sessionMgr.GetSessionConnByID(clientID)
+	if err != nil {
+		return nil, err
+	}
+	return l.setupStream(clientID, tunnelConn, caps, l.veilinkProtocol(clientID, offset))
+}
 
-				udpSess = &UDPsession{
-					tunnelConn: tunnelConn,
-					LocalAddr:  addr,
-					RemoteAddr: remoteAddr.String(),
-				}
-				l.udpSessionMgr.Add(remoteAddr.String(), udpSess)
-				go l.udpReadFormClient(tunnelConn, remoteAddr, udpListener)
-			}
+// OpenP2P asks a client of the stcp tunnel to punch towards the visitor instead of dialing the internal service.
+// The returned stream only has to stay open until the server has seen the probe of the client.
+func (l *Listener) OpenP2P(remote net.Addr, info *common.P2PInfo) (string, common.VeilConn, error) {
+	return l.openTunnelWith(remote, func(clientID string) *common.VeilinkProtocol {
+		vp := l.veilinkProtocol(clientID, 0)
+		vp.P2P = info
+		return vp
+	})
+}
 
-			packet := common.UDPpacket(buffer[:n])
-			body, err := packet.Encode()
-			if err != nil {
-				logrus.Warnf("encode udp packet fail: %v", err)
-				continue
+// Run the per stream exchange: encryption flag, optional chacha20 and compression, veilink protocol and the client's dial status.
+// Compression, the binary encoding and the dial status are skipped for clients that did not announce support for them.
+func (l *Listener) setupStream(clientID string, tunnelConn common.VeilConn, caps common.Capability, vp *common.VeilinkProtocol) (common.VeilConn, error) {
+	compression := l.compression
+	if !caps.Has(common.CapCompression) {
+		compression = common.CompressionNone
+	}
+	// 打洞信息中含有kcp会话密钥，即使隧道未开启加密也要加密传输
+	encrypt := l.Encrypt || vp.P2P != nil
+	if err := l.sendEncryptProtocol(tunnelConn, encrypt, compression, caps.FrameFormat()); err != nil {
+		tunnelConn.Close()
+		return nil, fmt.Errorf("send encrypt protocol: %w", err)
+	}
+	if encrypt {
+		key, err := l.keymap.Get(clientID)
+		if err != nil {
+			tunnelConn.Close()
+			return nil, err
+		}
+		encConn, err := common.NewChacha20Stream(key, tunnelConn)
+		if err != nil {
+			tunnelConn.Close()
+			return nil, fmt.Errorf("new chacha20 stream: %w", err)
+		}
+		tunnelConn = encConn
+	}
+	if compression != common.CompressionNone {
+		compConn, err := common.NewCompressStream(compression, tunnelConn, l.compressStats)
+		if err != nil {
+			tunnelConn.Close()
+			return nil, fmt.Errorf("new compress stream: %w", err)
+		}
+		tunnelConn = compConn
+	}
+	if err := l.sendVeilinkProtocol(tunnelConn, vp, caps); err != nil {
+		tunnelConn.Close()
+		return nil, fmt.Errorf("send veilink protocol: %w", err)
+	}
+	if !caps.Has(common.CapStreamStatus) {
+		return tunnelConn, nil
+	}
+	if err := l.recvStreamStatus(tunnelConn); err != nil {
+		tunnelConn.Close()
+		return nil, err
+	}
+	return tunnelConn, nil
+}
+
+func (l *Listener) listenerAndServerUDP() error {
+	udpListeners := make([]net.PacketConn, 0, l.PortCount())
+	for offset := 0; offset < l.PortCount(); offset++ {
+		udpListener, err := net.ListenPacket("udp", l.publicAddr(uint16(offset)))
+		if err != nil {
+			for _, opened := range udpListeners {
+				opened.Close()
 			}
-			lenbody, err := udpSess.tunnelConn.Write(body)
-			if err != nil {
-				logrus.Warnf("write udp packet fail: %v", err)
+			return err
+		}
+		udpListeners = append(udpListeners, udpListener)
+	}
+
+	// 端口范围内的所有端口共用一个流表，流数量上限及统计按整个隧道计算
+	l.udpFlows = newUDPFlowTable(l.listenerConfig.UDPIdleTimeout, l.listenerConfig.UDPMaxFlows)
+	var wg sync.WaitGroup
+	for offset, udpListener := range udpListeners {
+		l.listeners = append(l.listeners, udpListener)
+		wg.Add(1)
+		go func(udpListener net.PacketConn, offset uint16) {
+			defer wg.Done()
+			l.serveUDP(udpListener, offset)
+		}(udpListener, uint16(offset))
+	}
+	go func() {
+		wg.Wait()
+		l.udpFlows.Close()
+	}()
+	return nil
+}
+
+func (l *Listener) serveUDP(udpListener net.PacketConn, offset uint16) {
+	defer udpListener.Close()
+	// 多留一个字节，用于发现超出长度上限而被截断的数据包
+	buffer := make([]byte, common.MaxUDPPayload+1)
+	for {
+		n, remoteAddr, err := udpListener.ReadFrom(buffer)
+		if err != nil {
+			break
+		}
+		if n > common.MaxUDPPayload {
+			l.udpOversized.Add(1)
+			continue
+		}
+		key := udpFlowKey(offset, remoteAddr)
+		flow := l.udpFlows.Get(key)
+		if flow == nil {
+			if !l.udpFlows.Admit() {
+				logrus.Debugf("udp flow limit reached, drop packet from %s", remoteAddr)
 				continue
 			}
-			l.ioData.AddInput(int64(lenbody))
+			// 连接客户端需等待其拨号结果，放在单独的goroutine中，不阻塞其他来源的数据包
+			flow = newUDPFlow(key, remoteAddr)
+			l.udpFlows.Add(key, flow)
+			go l.connectUDPFlow(flow, udpListener, offset)
 		}
-	}()
 
-	return nil
+		lenbody, err := flow.Write(buffer[:n])
+		if errors.Is(err, common.ErrDatagramSize) {
+			l.udpOversized.Add(1)
+			continue
+		}
+		if errors.Is(err, errUDPFlowPending) || errors.Is(err, errUDPFlowClosed) {
+			logrus.Debugf("drop packet from %s: %v", remoteAddr, err)
+			continue
+		}
+		if err != nil {
+			logrus.Warnf("write udp packet fail: %v", err)
+			l.udpFlows.Remove(key, flow)
+			continue
+		}
+		flow.touch()
+		l.ioData.AddInput(int64(lenbody))
+	}
+}
+
+// 同一来源地址访问范围内不同端口时属于不同的流
+func udpFlowKey(offset uint16, remoteAddr net.Addr) string {
+	return strconv.Itoa(int(offset)) + "/" + remoteAddr.String()
+}
+
+// connectUDPFlow connects a new flow to a client, a flow that can not be connected
+// is removed so the next packet from the source tries again.
+func (l *Listener) connectUDPFlow(flow *udpFlow, pc net.PacketConn, offset uint16) {
+	err := l.attachUDPFlow(flow, pc, offset)
+	if errors.Is(err, errUDPFlowClosed) {
+		return
+	}
+	if err != nil {
+		logrus.Warnf("open tunnel fail: %v", err)
+		l.udpFlows.Remove(flow.key, flow)
+	}
+}
+
+// attachUDPFlow picks a client for a new public source address. In udp_mux mode the flow
+// shares the tunnel's stream to that client, otherwise it gets a stream of its own.
+func (l *Listener) attachUDPFlow(flow *udpFlow, pc net.PacketConn, offset uint16) error {
+	if !l.listenerConfig.UDPMux {
+		clientID, tunnelConn, err := l.openTunnel(flow.remoteAddr, offset)
+		if err != nil {
+			return err
+		}
+		release := l.trackFlow(clientID)
+		if err := flow.attach(clientID, tunnelConn, nil, 0, release); err != nil {
+			// 连接期间流已被回收
+			tunnelConn.Close()
+			release()
+			return err
+		}
+		go l.udpReadFormClient(flow.key, flow, pc)
+		return nil
+	}
+
+	online := l.onlineClients()
+	if len(online) == 0 {
+		return ErrNoClientOnline
+	}
+	var lastErr error
+	for _, clientID := range l.balancer.order(online, flow.remoteAddr) {
+		mux, err := l.udpMuxTo(clientID, pc, offset)
+		if err != nil {
+			logrus.Warnf("client %s udp mux to %s fail: %v", clientID, l.internalAddr(offset), err)
+			lastErr = err
+			continue
+		}
+		release := l.trackFlow(clientID)
+		if err := mux.addFlow(flow, release); err != nil {
+			release()
+			return err
+		}
+		return nil
+	}
+	return lastErr
+}
+
+// Count a flow as an active connection of its client, the returned func releases it.
+func (l *Listener) trackFlow(clientID string) func() {
+	l.balancer.acquire(clientID)
+	return func() { l.balancer.release(clientID) }
+}
+
+// udpMuxTo returns the live mux stream to the client for the offset-th port, opening one if needed.
+func (l *Listener) udpMuxTo(clientID string, pc net.PacketConn, offset uint16) (*udpMux, error) {
+	l.udpMuxLock.Lock()
+	defer l.udpMuxLock.Unlock()
+	muxKey := clientID + "/" + strconv.Itoa(int(offset))
+	if mux := l.udpMuxes[muxKey]; mux != nil && mux.alive() {
+		return mux, nil
+	}
+	tunnelConn, err := l.openTunnelTo(clientID, offset)
+	if err != nil {
+		return nil, err
+	}
+	mux := newUDPMux(clientID, tunnelConn)
+	l.udpMuxes[muxKey] = mux
+	go mux.readLoop(l, pc)
+	return mux, nil
 }
 
-func (l *Listener) udpReadFormClient(tunnelconn common.VeilConn, raddr net.Addr, conn net.PacketConn) {
+func (l *Listener) udpReadFormClient(key string, flow *udpFlow, conn net.PacketConn) {
+	// stream结束(空闲回收或客户端断开)后移除该流，下一个数据包会重新挑选客户端
+	defer l.udpFlows.Remove(key, flow)
 	buffer := common.UDPpacket{}
 	for {
-		err := buffer.Decode(tunnelconn)
+		err := buffer.Decode(flow.tunnelConn)
+		if errors.Is(err, common.ErrDatagramSize) {
+			l.udpOversized.Add(1)
+			continue
+		}
 		if err != nil {
-			if errors.Is(err, io.ErrClosedPipe) {
-				logrus.Warnf("tunnelconn already close: %v", raddr)
+			if errors.Is(err, io.ErrClosedPipe) || errors.Is(err, io.EOF) {
+				logrus.Debugf("udp flow closed: %v", flow.remoteAddr)
 				break
 			}
 			logrus.Warnf("decode udp packet fail: %v", err)
 			break
 		}
 
-		lenbuffer, err := conn.WriteTo(buffer, raddr)
+		lenbuffer, err := conn.WriteTo(buffer, flow.remoteAddr)
 		if err != nil {
 			logrus.Warnf("write udp packet fail: %v", err)
 			break
 		}
+		flow.touch()
 		l.ioData.AddOutput(int64(lenbuffer))
 	}
 }
 
-// Inform the client whether the current connection is encrypted.
-func (l *Listener) sendEncryptProtocol(conn common.VeilConn) error {
+// Inform the client whether the current connection is encrypted and compressed.
+func (l *Listener) sendEncryptProtocol(conn common.VeilConn, encrypt bool, compression common.Compression, format common.FrameFormat) error {
 	enc := &common.EncryptProtocl{}
-	encByte := enc.Encode(l.Encrypt)
+	encByte := enc.Encode(encrypt, compression, format)
 	conn.SetWriteDeadline(time.Now().Add(writeTimeout))
 	_, err := conn.Write(encByte)
 	conn.SetWriteDeadline(time.Time{})
 	return err
 }
 
-// Inform the client of the specific IP and port that need to be tunneled into the internal network.
-func (l *Listener) sendVeilinkProtocol(conn common.VeilConn) error {
-	pp := &common.VeilinkProtocol{
-		ClientID:       l.listenerConfig.ClientID,
+// The specific IP and port that need to be tunneled into the internal network.
+// For port range tunnels the ports are those of the offset-th pair of the ranges.
+func (l *Listener) veilinkProtocol(clientID string, offset uint16) *common.VeilinkProtocol {
+	return &common.VeilinkProtocol{
+		ClientID:       clientID,
 		PublicProtocol: l.listenerConfig.PublicProtocol,
 		PublicIP:       l.listenerConfig.PublicIP,
-		PublicPort:     l.listenerConfig.PublicPort,
+		PublicPort:     l.listenerConfig.PublicPort + offset,
 		InternalIP:     l.listenerConfig.InternalIP,
-		InternalPort:   l.listenerConfig.InternalPort,
+		InternalPort:   l.listenerConfig.InternalPort + offset,
+		UDPMux:         l.listenerConfig.PublicProtocol == UDP && l.listenerConfig.UDPMux,
+	}
+}
+
+// Inform the client of the veilink protocol of the current connection,
+// in the binary encoding and the frame format the client supports.
+func (l *Listener) sendVeilinkProtocol(conn common.VeilConn, pp *common.VeilinkProtocol, caps common.Capability) error {
+	conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+	defer conn.SetWriteDeadline(time.Time{})
+	if caps.Has(common.CapBinaryFrames) {
+		return pp.WriteBinary(conn, caps.FrameFormat())
 	}
-	ppBody, err := pp.Encode()
+	ppBody, err := pp.Encode(caps.FrameFormat())
 	if err != nil {
 		return err
 	}
-	conn.SetWriteDeadline(time.Now().Add(writeTimeout))
 	_, err = conn.Write(ppBody)
+	return err
+}
+
+// Wait for the client to report whether it reached the internal service.
+// A failed dial is recorded in the tunnel stats.
+func (l *Listener) recvStreamStatus(conn common.VeilConn) error {
+	st := &common.StreamStatus{}
+	conn.SetReadDeadline(time.Now().Add(statusTimeout))
+	err := st.Decode(conn)
+	conn.SetReadDeadline(time.Time{})
+	if err != nil {
+		return err
+	}
+	if !st.OK {
+		l.dialErrors.Add(st.Error)
+		if st.Denied {
+			return deniedError(st.Error)
+		}
+		return errors.New(st.Error)
+	}
+	return nil
+}
+
+// deniedError 客户端的允许列表拒绝了代理的目标，可用errors.Is判断为common.ErrTargetDenied
+type deniedError string
+
+func (e deniedError) Error() string { return string(e) }
+
+func (e deniedError) Unwrap() error { return common.ErrTargetDenied }
+
+// sendStreamStatus reports the result of a dial made by the server, visitors are sent the FrameShort format.
+func sendStreamStatus(conn common.VeilConn, err error, format common.FrameFormat) error {
+	st := &common.StreamStatus{OK: err == nil}
+	if err != nil {
+		st.Error = err.Error()
+	}
+	buf, encErr := st.Encode(format)
+	if encErr != nil {
+		return encErr
+	}
+	conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+	_, err = conn.Write(buf)
 	conn.SetWriteDeadline(time.Time{})
 	return err
 }
+
+func (l *Listener) internalAddr(offset uint16) string {
+	return net.JoinHostPort(l.listenerConfig.InternalIP, strconv.Itoa(int(l.listenerConfig.InternalPort+offset)))
+}
+
+func (l *Listener) Stats() TunnelStats {
+	count, lastError, lastTime := l.dialErrors.Get()
+	stats := TunnelStats{
+		Input:           l.ioData.GetInput(),
+		Output:          l.ioData.GetOutput(),
+		DialErrors:      count,
+		LastDialError:   lastError,
+		LastDialErrorAt: lastTime,
+	}
+	if l.udpFlows != nil {
+		stats.UDPFlows = l.udpFlows.Len()
+		stats.UDPFlowsDropped = l.udpFlows.Rejected()
+		stats.UDPOversized = l.udpOversized.Load()
+	}
+	if l.compression != common.CompressionNone {
+		stats.Compression = l.compression.String()
+		stats.CompressedBytes = l.compressStats.Wire()
+		stats.CompressRatio = l.compressStats.Ratio()
+	}
+	return stats
+}
+
 func (l *Listener) Close() {
 	l.closeOnce.Do(func() {
-		if l.listener != nil {
-			l.listener.Close()
+		for _, listener := range l.listeners {
+			listener.Close()
+		}
+		if l.udpFlows != nil {
+			l.udpFlows.Close()
+		}
+		l.udpMuxLock.Lock()
+		for _, mux := range l.udpMuxes {
+			mux.conn.Close()
+		}
+		l.udpMuxLock.Unlock()
+		l.detachRoutes()
+		if l.certs != nil {
+			l.certs.release(l)
 		}
 	})
 }
@@ -2,6 +2,7 @@ package server
 
 import (
 	"errors"
+	"fmt"
 	"slices"
 	"sync"
 
@@ -9,21 +10,28 @@ import (
 	"github.com/atopos31/go-veilink/internal/config"
 )
 
+var ErrTunnelNotFound = errors.New("tunnel not found")
+
 type ListenerMgr struct {
-	sessionMgr    *SessionManager
-	udpSessionMgr *UDPSessionManage
-	keymap        *keymap
-	lock          sync.Mutex
-	listenersMap  map[string][]*Listener
+	sessionMgr     *SessionManager
+	keymap         *keymap
+	lock           sync.Mutex
+	listenersMap   map[string][]*Listener
+	tunnelPolicies map[string]*config.ClientTunnelPolicy // clientID => 客户端注册隧道的限制
+	portRanges     []portRange                           // public_port为0的隧道从中分配端口
+	certs          *certManager
+	routers        *httpRouters
 }
 
-func NewListenerMgr(sessionMgr *SessionManager, udpSessionMgr *UDPSessionManage, keymap *keymap) *ListenerMgr {
+func NewListenerMgr(sessionMgr *SessionManager, keymap *keymap) *ListenerMgr {
 	return &ListenerMgr{
-		sessionMgr:    sessionMgr,
-		udpSessionMgr: udpSessionMgr,
-		keymap:        keymap,
-		lock:          sync.Mutex{},
-		listenersMap:  make(map[string][]*Listener),
+		sessionMgr:     sessionMgr,
+		keymap:         keymap,
+		lock:           sync.Mutex{},
+		listenersMap:   make(map[string][]*Listener),
+		tunnelPolicies: make(map[string]*config.ClientTunnelPolicy),
+		certs:          newCertManager(),
+		routers:        newHTTPRouters(),
 	}
 }
 
@@ -33,12 +41,48 @@ func (lm *ListenerMgr) AddListener(clientID string, listenerConfig *config.Liste
 	if _, ok := lm.listenersMap[clientID]; !ok {
 		return errors.New("client id not found")
 	}
-	key, err := lm.keymap.Get(clientID)
-	if err != nil {
+	for _, backend := range listenerConfig.Backends {
+		if _, ok := lm.listenersMap[backend]; !ok {
+			return fmt.Errorf("backend client %s not found", backend)
+		}
+	}
+	switch listenerConfig.LoadBalance {
+	case "", LBRoundRobin, LBLeastConn, LBSourceHash:
+	default:
+		return fmt.Errorf("unknown load balance strategy %q", listenerConfig.LoadBalance)
+	}
+	if err := checkPortCount(listenerConfig); err != nil {
 		return err
 	}
-	listener := NewListener(listenerConfig, key, lm.sessionMgr, lm.udpSessionMgr)
-	if err := listener.ListenAndServe(); err != nil {
+	if listenerConfig.PublicProtocol == STCP {
+		if listenerConfig.Name == "" || listenerConfig.SecretKey == "" {
+			return errors.New("stcp tunnel requires name and secret_key")
+		}
+		if lm.findSecretTunnel(clientID, listenerConfig.Name) != nil {
+			return fmt.Errorf("stcp tunnel %s already exists", listenerConfig.Name)
+		}
+	}
+	if err := checkProxyProtocol(listenerConfig); err != nil {
+		return err
+	}
+	if (listenerConfig.Username == "") != (listenerConfig.Password == "") {
+		return errors.New("auth requires both username and password")
+	}
+	if _, err := common.ParseCompression(listenerConfig.Compression); err != nil {
+		return err
+	}
+	if (listenerConfig.HTTP != nil || listenerConfig.TLS != nil) && listenerConfig.PublicProtocol != HTTP {
+		return fmt.Errorf("http and tls options are not supported by %s tunnels", listenerConfig.PublicProtocol)
+	}
+	listener := NewListener(listenerConfig, lm.keymap, lm.sessionMgr)
+	listener.routers = lm.routers
+	if err := lm.certs.setup(listener); err != nil {
+		return err
+	}
+	if err := lm.listen(listener, lm.portRanges); err != nil {
+		if listener.certs != nil {
+			lm.certs.release(listener)
+		}
 		return err
 	}
 
@@ -96,3 +140,49 @@ func (lm *ListenerMgr) CheckExist(clientID string) bool {
 	_, ok := lm.listenersMap[clientID]
 	return ok
 }
+
+func (lm *ListenerMgr) GetListener(clientID string, tunnelID string) (*Listener, error) {
+	lm.lock.Lock()
+	defer lm.lock.Unlock()
+	for _, listener := range lm.listenersMap[clientID] {
+		if listener.Uuid == tunnelID {
+			return listener, nil
+		}
+	}
+	return nil, ErrTunnelNotFound
+}
+
+// FindSecretTunnel returns the client's stcp tunnel with the given name.
+func (lm *ListenerMgr) FindSecretTunnel(clientID string, name string) (*Listener, error) {
+	lm.lock.Lock()
+	defer lm.lock.Unlock()
+	if listener := lm.findSecretTunnel(clientID, name); listener != nil {
+		return listener, nil
+	}
+	return nil, ErrTunnelNotFound
+}
+
+func (lm *ListenerMgr) findSecretTunnel(clientID string, name string) *Listener {
+	for _, listener := range lm.listenersMap[clientID] {
+		if listener.listenerConfig.PublicProtocol == STCP && listener.listenerConfig.Name == name {
+			return listener
+		}
+	}
+	return nil
+}
+
+// PROXY协议头只能用于基于TCP的隧道，stcp的公网连接即gateway连接，不接受协议头
+func checkProxyProtocol(conf *config.Listener) error {
+	switch conf.ProxyProtocol {
+	case "", common.ProxyProtocolV1, common.ProxyProtocolV2:
+	default:
+		return fmt.Errorf("unknown proxy_protocol %q, expect v1 or v2", conf.ProxyProtocol)
+	}
+	if conf.ProxyProtocol != "" && conf.PublicProtocol == UDP {
+		return errors.New("proxy_protocol is not supported by udp tunnels")
+	}
+	if conf.AcceptProxy && (conf.PublicProtocol == UDP || conf.PublicProtocol == STCP) {
+		return fmt.Errorf("accept_proxy_protocol is not supported by %s tunnels", conf.PublicProtocol)
+	}
+	return nil
+}
@@ -0,0 +1,266 @@
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/atopos31/go-veilink/internal/common"
+	"github.com/atopos31/go-veilink/internal/config"
+	"github.com/xtaci/smux"
+)
+
+// connectClient adds a session for clientID with the given capabilities and returns the client end of it.
+func connectClient(t *testing.T, sm *SessionManager, clientID string, caps common.Capability) *smux.Session {
+	t.Helper()
+	serverConn, clientConn := net.Pipe()
+	if _, err := sm.AddSession(clientID, serverConn, smux.DefaultConfig(), caps, func() error { return nil }); err != nil {
+		t.Fatal(err)
+	}
+	mux, err := smux.Client(clientConn, smux.DefaultConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { mux.Close() })
+	return mux
+}
+
+// acceptTunnel reads the per stream exchange of the next stream as the client does.
+func acceptTunnel(mux *smux.Session) (*smux.Stream, *common.VeilinkProtocol, error) {
+	stream, err := mux.AcceptStream()
+	if err != nil {
+		return nil, nil, err
+	}
+	if _, _, err := (common.EncryptProtocl{}).Check(stream); err != nil {
+		return nil, nil, err
+	}
+	vp := &common.VeilinkProtocol{}
+	if err := vp.Decode(stream); err != nil {
+		return nil, nil, err
+	}
+	return stream, vp, nil
+}
+
+func writeStatus(stream *smux.Stream, dialErr string) {
+	buf, _ := (&common.StreamStatus{OK: dialErr == "", Error: dialErr}).Encode(common.FrameLong)
+	stream.Write(buf)
+}
+
+func newTestListener(conf *config.Listener) (*Listener, *SessionManager) {
+	sm := NewSessionManager()
+	conf.ClientID = "c1"
+	return NewListener(conf, NewKeyMap(), sm), sm
+}
+
+func TestStreamStatus(t *testing.T) {
+	l, sm := newTestListener(&config.Listener{PublicProtocol: TCP, InternalIP: "127.0.0.1", InternalPort: 22})
+	mux := connectClient(t, sm, "c1", common.Capabilities)
+
+	go func() {
+		if stream, _, err := acceptTunnel(mux); err == nil {
+			writeStatus(stream, "dial tcp 127.0.0.1:22: connection refused")
+		}
+	}()
+	_, err := l.openTunnelTo("c1", 0)
+	if err == nil || !strings.Contains(err.Error(), "connection refused") {
+		t.Fatalf("got %v", err)
+	}
+	stats := l.Stats()
+	if stats.DialErrors != 1 || !strings.Contains(stats.LastDialError, "connection refused") {
+		t.Fatalf("stats %+v", stats)
+	}
+
+	go func() {
+		if stream, _, err := acceptTunnel(mux); err == nil {
+			writeStatus(stream, "")
+		}
+	}()
+	conn, err := l.openTunnelTo("c1", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+}
+
+func TestStreamProtocolVersion1(t *testing.T) {
+	l, sm := newTestListener(&config.Listener{PublicProtocol: TCP, InternalIP: "127.0.0.1", InternalPort: 22})
+	// 协议版本1的客户端不声明CapLongFrames，stream内使用旧的帧格式
+	mux := connectClient(t, sm, "c1", common.Capabilities&^common.CapLongFrames)
+
+	errs := make(chan error, 1)
+	go func() {
+		stream, err := mux.AcceptStream()
+		if err != nil {
+			errs <- err
+			return
+		}
+		hdr := make([]byte, 6)
+		if _, err := io.ReadFull(stream, hdr); err != nil {
+			errs <- err
+			return
+		}
+		want := (common.EncryptProtocl{}).Encode(false, common.CompressionNone, common.FrameShort)
+		if !bytes.Equal(hdr[:2], want) || hdr[2] != 0 {
+			errs <- fmt.Errorf("stream header %x", hdr)
+			return
+		}
+		vp := &common.VeilinkProtocol{}
+		if err := vp.Decode(io.MultiReader(bytes.NewReader(hdr[2:]), stream)); err != nil || vp.InternalPort != 22 {
+			errs <- fmt.Errorf("decoded %+v, %v", vp, err)
+			return
+		}
+		buf, _ := (&common.StreamStatus{OK: true}).Encode(common.FrameShort)
+		_, err = stream.Write(buf)
+		errs <- err
+	}()
+	conn, err := l.openTunnelTo("c1", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	if err := <-errs; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestStreamStatusNotAnnounced(t *testing.T) {
+	l, sm := newTestListener(&config.Listener{PublicProtocol: TCP, InternalIP: "127.0.0.1", InternalPort: 22})
+	// 未声明CapStreamStatus的客户端不回复拨号结果，服务端不等待
+	mux := connectClient(t, sm, "c1", common.Capabilities&^common.CapStreamStatus)
+	go acceptTunnel(mux)
+
+	start := time.Now()
+	conn, err := l.openTunnelTo("c1", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	if waited := time.Since(start); waited > statusTimeout/2 {
+		t.Fatalf("waited %v for a status that is never sent", waited)
+	}
+}
+
+func TestUDPFlowConnectsInBackground(t *testing.T) {
+	l, sm := newTestListener(&config.Listener{
+		PublicProtocol: UDP,
+		PublicIP:       "127.0.0.1",
+		InternalIP:     "127.0.0.1",
+		InternalPort:   53,
+	})
+	mux := connectClient(t, sm, "c1", common.Capabilities)
+	if err := l.ListenAndServe(); err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	public := l.listeners[0].(net.PacketConn).LocalAddr().String()
+
+	// 第一个来源的拨号结果迟迟不返回，期间其他来源的数据包照常转发
+	release := make(chan struct{})
+	packets := make(chan string, 4)
+	go func() {
+		for i := 0; ; i++ {
+			stream, _, err := acceptTunnel(mux)
+			if err != nil {
+				return
+			}
+			go func(slow bool) {
+				if slow {
+					<-release
+				}
+				writeStatus(stream, "")
+				for {
+					pkt := common.UDPpacket{}
+					if err := pkt.Decode(stream); err != nil {
+						return
+					}
+					packets <- string(pkt)
+				}
+			}(i == 0)
+		}
+	}()
+
+	slow, err := net.Dial("udp", public)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer slow.Close()
+	slow.Write([]byte("first"))
+	time.Sleep(50 * time.Millisecond)
+	fast, err := net.Dial("udp", public)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fast.Close()
+	fast.Write([]byte("other"))
+
+	select {
+	case got := <-packets:
+		if got != "other" {
+			t.Fatalf("got %q", got)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("packet of another source blocked by a connecting flow")
+	}
+	// 连接期间暂存的数据包在连接完成后按序发送
+	slow.Write([]byte("second"))
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	for _, want := range []string{"first", "second"} {
+		select {
+		case got := <-packets:
+			if got != want {
+				t.Fatalf("got %q, want %q", got, want)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("queued packet %q lost", want)
+		}
+	}
+}
+
+func TestAcceptProxyHeader(t *testing.T) {
+	l, sm := newTestListener(&config.Listener{
+		PublicProtocol: TCP,
+		InternalIP:     "127.0.0.1",
+		InternalPort:   22,
+		AcceptProxy:    true,
+		ProxyProtocol:  common.ProxyProtocolV2,
+	})
+	mux := connectClient(t, sm, "c1", common.Capabilities)
+
+	// 公网连接的PROXY协议头被剥离，其中的来源地址随VeilinkProtocol发给客户端
+	serverConn, conn := net.Pipe()
+	defer conn.Close()
+	go l.handleConn(serverConn, 0)
+	go conn.Write([]byte("PROXY TCP4 203.0.113.7 198.51.100.1 52311 443\r\nhello"))
+	stream, vp, err := acceptTunnel(mux)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stream.Close()
+	if vp.RemoteAddr != "203.0.113.7:52311" || vp.LocalAddr != "198.51.100.1:443" {
+		t.Fatalf("addresses %s => %s", vp.RemoteAddr, vp.LocalAddr)
+	}
+	writeStatus(stream, "")
+	stream.SetReadDeadline(time.Now().Add(5 * time.Second))
+	payload := make([]byte, 5)
+	if _, err := io.ReadFull(stream, payload); err != nil || string(payload) != "hello" {
+		t.Fatalf("payload %q, %v", payload, err)
+	}
+
+	// 没有协议头的连接被断开，不会打开隧道
+	serverConn, conn = net.Pipe()
+	defer conn.Close()
+	go l.handleConn(serverConn, 0)
+	go conn.Write([]byte("GET / HTTP/1.1\r\n\r\n"))
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("connection without header got %v", err)
+	}
+	if n := mux.NumStreams(); n != 1 {
+		t.Fatalf("%d streams opened", n)
+	}
+}
@@ -0,0 +1,132 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/atopos31/go-veilink/internal/config"
+)
+
+var (
+	ErrNoFreePort   = errors.New("no free port in the port ranges")
+	ErrNoPortRange  = errors.New("public_port is required when no port range is configured")
+	errInvalidPorts = errors.New("invalid port range")
+)
+
+const (
+	maxPortCount = 1024
+	// UDP隧道的每个端口各有一个读取协程及64KiB的缓冲区
+	maxUDPPortCount = 256
+)
+
+type portRange struct {
+	low, high uint16
+}
+
+func (r portRange) contains(port uint16) bool {
+	return port >= r.low && port <= r.high
+}
+
+// parsePortRanges parses ranges such as "6000-6100" or a single port "7000".
+func parsePortRanges(ranges []string) ([]portRange, error) {
+	parsed := make([]portRange, 0, len(ranges))
+	for _, s := range ranges {
+		lowStr, highStr, found := strings.Cut(strings.TrimSpace(s), "-")
+		if !found {
+			highStr = lowStr
+		}
+		low, err := strconv.ParseUint(strings.TrimSpace(lowStr), 10, 16)
+		if err != nil {
+			return nil, fmt.Errorf("%w %q", errInvalidPorts, s)
+		}
+		high, err := strconv.ParseUint(strings.TrimSpace(highStr), 10, 16)
+		if err != nil || high < low || low == 0 {
+			return nil, fmt.Errorf("%w %q", errInvalidPorts, s)
+		}
+		parsed = append(parsed, portRange{low: uint16(low), high: uint16(high)})
+	}
+	return parsed, nil
+}
+
+// SetPortRanges sets the ranges that tunnels with public_port 0 are allocated from.
+func (lm *ListenerMgr) SetPortRanges(ranges []string) error {
+	parsed, err := parsePortRanges(ranges)
+	if err != nil {
+		return err
+	}
+	lm.lock.Lock()
+	defer lm.lock.Unlock()
+	lm.portRanges = parsed
+	return nil
+}
+
+// checkPortCount makes sure both ranges of a port range tunnel stay within valid ports
+// and that the range is small enough to be served port by port.
+func checkPortCount(conf *config.Listener) error {
+	if conf.PortCount <= 1 {
+		return nil
+	}
+	limit := maxPortCount
+	if conf.PublicProtocol == UDP {
+		limit = maxUDPPortCount
+	}
+	if int(conf.PortCount) > limit {
+		return fmt.Errorf("port_count %d exceeds the limit of %d for %s tunnels", conf.PortCount, limit, conf.PublicProtocol)
+	}
+	last := int(conf.PortCount) - 1
+	if int(conf.PublicPort)+last > 65535 || int(conf.InternalPort)+last > 65535 {
+		return fmt.Errorf("port_count %d exceeds the port range", conf.PortCount)
+	}
+	return nil
+}
+
+// listen starts the listener. A public port of 0 is replaced by the lowest block of
+// ranges that no other tunnel uses and that the OS lets us bind.
+func (lm *ListenerMgr) listen(listener *Listener, ranges []portRange) error {
+	conf := listener.listenerConfig
+	if conf.PublicPort != 0 || conf.PublicProtocol == STCP {
+		return listener.ListenAndServe()
+	}
+	if len(ranges) == 0 {
+		return ErrNoPortRange
+	}
+	count := listener.PortCount()
+	for _, r := range ranges {
+		for port := int(r.low); port+count-1 <= int(r.high); port++ {
+			if lm.portInUse(conf.PublicProtocol, uint16(port), count) {
+				continue
+			}
+			conf.PublicPort = uint16(port)
+			if err := listener.ListenAndServe(); err == nil {
+				return nil
+			}
+		}
+	}
+	conf.PublicPort = 0
+	return ErrNoFreePort
+}
+
+// portInUse reports whether a tunnel of the same transport already owns one of count ports from port.
+func (lm *ListenerMgr) portInUse(protocol string, port uint16, count int) bool {
+	for _, listeners := range lm.listenersMap {
+		for _, listener := range listeners {
+			conf := listener.listenerConfig
+			if transport(conf.PublicProtocol) != transport(protocol) || conf.PublicPort == 0 || conf.PublicProtocol == STCP {
+				continue
+			}
+			if int(conf.PublicPort) < int(port)+count && int(port) < int(conf.PublicPort)+listener.PortCount() {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func transport(protocol string) string {
+	if protocol == UDP {
+		return UDP
+	}
+	return TCP
+}
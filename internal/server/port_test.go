@@ -0,0 +1,193 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/atopos31/go-veilink/internal/common"
+	"github.com/atopos31/go-veilink/internal/config"
+)
+
+func TestAllocatePort(t *testing.T) {
+	lm := NewListenerMgr(NewSessionManager(), NewKeyMap())
+	if err := lm.AddClient("c1"); err != nil {
+		t.Fatal(err)
+	}
+	port := freePort(t)
+	if err := lm.SetPortRanges([]string{fmt.Sprint(port)}); err != nil {
+		t.Fatal(err)
+	}
+	add := func() (*config.Listener, error) {
+		conf := &config.Listener{PublicProtocol: TCP, PublicIP: "127.0.0.1", InternalIP: "127.0.0.1", InternalPort: 22}
+		return conf, lm.AddListener("c1", conf)
+	}
+	first, err := add()
+	if err != nil || first.PublicPort != port {
+		t.Fatalf("got port %d, %v", first.PublicPort, err)
+	}
+	// 范围内的端口用尽
+	if _, err := add(); !errors.Is(err, ErrNoFreePort) {
+		t.Fatalf("got %v", err)
+	}
+	listener, err := lm.GetListener("c1", first.Uuid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 移除隧道后端口可以再次分配
+	if err := lm.RemoveListener("c1", listener.Uuid); err != nil {
+		t.Fatal(err)
+	}
+	again, err := add()
+	if err != nil || again.PublicPort != port {
+		t.Fatalf("got port %d, %v", again.PublicPort, err)
+	}
+}
+
+func TestSaveAllocatedPorts(t *testing.T) {
+	port := freePort(t)
+	path := filepath.Join(t.TempDir(), "server.yaml")
+	conf := fmt.Sprintf(`level: error
+gateway:
+  ip: 127.0.0.1
+  port: 0
+port_ranges: ["%d"]
+clients:
+  - client_id: c1
+    listeners:
+      - client_id: c1
+        public_protocol: tcp
+        public_ip: 127.0.0.1
+        public_port: 0
+        internal_ip: 127.0.0.1
+        internal_port: 22
+`, port)
+	if err := os.WriteFile(path, []byte(conf), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	app := NewApp(path)
+	if err := app.Start(); err != nil {
+		t.Fatal(err)
+	}
+	saved, err := config.LoadServerConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := saved.Clients[0].Listeners[0].PublicPort; got != port {
+		t.Fatalf("saved port %d, want %d", got, port)
+	}
+	if info, err := os.Stat(path); err != nil || info.Mode().Perm() != 0o600 {
+		t.Fatalf("config file mode %v, %v", info.Mode(), err)
+	}
+
+	// 只写入分配到的端口，未保存的其他修改不会被一并写入
+	if err := app.AddClient(config.Client{ClientID: "c2"}); err != nil {
+		t.Fatal(err)
+	}
+	app.saveAllocated(map[string]map[int]uint16{"c1": {0: port}})
+	if saved, err = config.LoadServerConfig(path); err != nil || len(saved.Clients) != 1 {
+		t.Fatalf("pending edits saved: %+v, %v", saved, err)
+	}
+	if err := app.SaveConfig(); err != nil {
+		t.Fatal(err)
+	}
+	if saved, err = config.LoadServerConfig(path); err != nil || len(saved.Clients) != 2 {
+		t.Fatalf("config not saved: %+v, %v", saved, err)
+	}
+	if matches, _ := filepath.Glob(path + ".*.tmp"); len(matches) != 0 {
+		t.Fatalf("temporary files left: %v", matches)
+	}
+}
+
+func TestParsePortRanges(t *testing.T) {
+	ranges, err := parsePortRanges([]string{"6000-6100", " 7000 ", "8000 - 8001"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []portRange{{6000, 6100}, {7000, 7000}, {8000, 8001}}
+	if fmt.Sprint(ranges) != fmt.Sprint(want) {
+		t.Fatalf("got %v", ranges)
+	}
+	if !ranges[0].contains(6100) || ranges[0].contains(6101) {
+		t.Fatal("range bounds")
+	}
+	for _, s := range []string{"", "0", "6100-6000", "6000-70000", "a-b", "6000-"} {
+		if _, err := parsePortRanges([]string{s}); !errors.Is(err, errInvalidPorts) {
+			t.Errorf("%q: got %v", s, err)
+		}
+	}
+}
+
+func TestCheckPortCount(t *testing.T) {
+	for _, tc := range []struct {
+		conf config.Listener
+		ok   bool
+	}{
+		{config.Listener{PublicProtocol: TCP, PublicPort: 6000, InternalPort: 6000, PortCount: 100}, true},
+		{config.Listener{PublicProtocol: TCP, PublicPort: 65500, InternalPort: 6000, PortCount: 100}, false},
+		{config.Listener{PublicProtocol: TCP, PublicPort: 6000, InternalPort: 65500, PortCount: 100}, false},
+		{config.Listener{PublicProtocol: TCP, PublicPort: 6000, InternalPort: 6000, PortCount: maxPortCount + 1}, false},
+		{config.Listener{PublicProtocol: UDP, PublicPort: 6000, InternalPort: 6000, PortCount: maxUDPPortCount}, true},
+		{config.Listener{PublicProtocol: UDP, PublicPort: 6000, InternalPort: 6000, PortCount: maxUDPPortCount + 1}, false},
+	} {
+		if err := checkPortCount(&tc.conf); (err == nil) != tc.ok {
+			t.Errorf("%s %d+%d: got %v", tc.conf.PublicProtocol, tc.conf.PublicPort, tc.conf.PortCount, err)
+		}
+	}
+}
+
+func TestUDPPortRangeListen(t *testing.T) {
+	l, sm := newTestListener(&config.Listener{
+		PublicProtocol: UDP,
+		PublicIP:       "127.0.0.1",
+		InternalIP:     "127.0.0.1",
+		InternalPort:   5000,
+		PortCount:      3,
+	})
+	mux := connectClient(t, sm, "c1", common.Capabilities)
+	// 从空闲端口起找一段连续可用的端口
+	var err error
+	for i := 0; i < 10; i++ {
+		l.listenerConfig.PublicPort = freePort(t)
+		if err = l.ListenAndServe(); err == nil {
+			break
+		}
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	// 每个端口映射到对应偏移的内网端口
+	targets := make(chan string, 3)
+	go func() {
+		for {
+			stream, vp, err := acceptTunnel(mux)
+			if err != nil {
+				return
+			}
+			targets <- fmt.Sprint(vp.InternalPort)
+			writeStatus(stream, "")
+		}
+	}()
+	for offset := 0; offset < 3; offset++ {
+		conn, err := net.Dial("udp", net.JoinHostPort("127.0.0.1", fmt.Sprint(int(l.listenerConfig.PublicPort)+offset)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		conn.Write([]byte("ping"))
+		select {
+		case got := <-targets:
+			if want := fmt.Sprint(5000 + offset); got != want {
+				t.Fatalf("port offset %d dialed %s, want %s", offset, got, want)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("port offset %d not served", offset)
+		}
+	}
+}
@@ -0,0 +1,271 @@
+package server
+
+import (
+	"bufio"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/atopos31/go-veilink/internal/common"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	socks5Version  = 0x05
+	socks5AuthNone = 0x00
+	socks5AuthUser = 0x02
+	socks5NoAuth   = 0xff
+	socks5Connect  = 0x01
+
+	socks5IPv4   = 0x01
+	socks5Domain = 0x03
+	socks5IPv6   = 0x04
+
+	socks5Succeeded        = 0x00
+	socks5GeneralFailure   = 0x01
+	socks5NotAllowed       = 0x02
+	socks5CmdNotSupported  = 0x07
+	socks5AddrNotSupported = 0x08
+
+	proxyHandshakeTimeout = time.Second * 10
+)
+
+var errProxyAuth = errors.New("proxy authentication failed")
+
+// serveProxy speaks socks5 or HTTP CONNECT with the public client on the same port and
+// asks a client of the tunnel to dial the requested destination.
+func (l *Listener) serveProxy(conn net.Conn, remote, local net.Addr) {
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	conn.SetReadDeadline(time.Now().Add(proxyHandshakeTimeout))
+	first, err := reader.Peek(1)
+	if err != nil {
+		return
+	}
+	var target string
+	var reply func(err error)
+	if first[0] == socks5Version {
+		target, err = l.socks5Handshake(conn, reader)
+		reply = func(err error) { socks5Reply(conn, err) }
+	} else {
+		target, err = l.httpConnectHandshake(conn, reader)
+		reply = func(err error) { httpConnectReply(conn, err) }
+	}
+	conn.SetReadDeadline(time.Time{})
+	if err != nil {
+		logrus.Warnf("proxy %s handshake fail: %v", remote, err)
+		return
+	}
+
+	connProtocol := l.connProtocol(0, remote, local)
+	clientID, tunnelConn, err := l.openTunnelWith(remote, func(clientID string) *common.VeilinkProtocol {
+		vp := connProtocol(clientID)
+		vp.Target = target
+		return vp
+	})
+	if err != nil {
+		logrus.Warnf("proxy %s to %s fail: %v", remote, target, err)
+		reply(err)
+		return
+	}
+	defer tunnelConn.Close()
+	reply(nil)
+	l.balancer.acquire(clientID)
+	defer l.balancer.release(clientID)
+
+	in, out := common.Join(&bufferedConn{Conn: conn, reader: reader}, tunnelConn)
+	l.ioData.AddInput(in)
+	l.ioData.AddOutput(out)
+	logrus.Infof("%s proxy %s => %s in: %d bytes, out: %d bytes", clientID, remote, target, in, out)
+}
+
+func (l *Listener) checkProxyAuth(username, password string) bool {
+	conf := l.listenerConfig
+	userOK := subtle.ConstantTimeCompare([]byte(username), []byte(conf.Username)) == 1
+	passOK := subtle.ConstantTimeCompare([]byte(password), []byte(conf.Password)) == 1
+	return userOK && passOK
+}
+
+// socks5Handshake negotiates the auth method and reads the CONNECT request, see RFC 1928 and RFC 1929.
+func (l *Listener) socks5Handshake(conn net.Conn, reader *bufio.Reader) (string, error) {
+	hdr := make([]byte, 2)
+	if _, err := io.ReadFull(reader, hdr); err != nil {
+		return "", err
+	}
+	methods := make([]byte, hdr[1])
+	if _, err := io.ReadFull(reader, methods); err != nil {
+		return "", err
+	}
+	method := byte(socks5AuthNone)
+	if l.listenerConfig.Username != "" {
+		method = socks5AuthUser
+	}
+	if !slices.Contains(methods, method) {
+		conn.Write([]byte{socks5Version, socks5NoAuth})
+		return "", errors.New("no acceptable socks5 auth method")
+	}
+	if _, err := conn.Write([]byte{socks5Version, method}); err != nil {
+		return "", err
+	}
+	if method == socks5AuthUser {
+		if err := l.socks5Auth(conn, reader); err != nil {
+			return "", err
+		}
+	}
+
+	req := make([]byte, 4)
+	if _, err := io.ReadFull(reader, req); err != nil {
+		return "", err
+	}
+	if req[1] != socks5Connect {
+		socks5ReplyCode(conn, socks5CmdNotSupported)
+		return "", fmt.Errorf("unsupported socks5 command %d", req[1])
+	}
+	var host string
+	switch req[3] {
+	case socks5IPv4, socks5IPv6:
+		size := net.IPv4len
+		if req[3] == socks5IPv6 {
+			size = net.IPv6len
+		}
+		ip := make(net.IP, size)
+		if _, err := io.ReadFull(reader, ip); err != nil {
+			return "", err
+		}
+		host = ip.String()
+	case socks5Domain:
+		size, err := reader.ReadByte()
+		if err != nil {
+			return "", err
+		}
+		domain := make([]byte, size)
+		if _, err := io.ReadFull(reader, domain); err != nil {
+			return "", err
+		}
+		host = string(domain)
+	default:
+		socks5ReplyCode(conn, socks5AddrNotSupported)
+		return "", fmt.Errorf("unsupported socks5 address type %d", req[3])
+	}
+	port := make([]byte, 2)
+	if _, err := io.ReadFull(reader, port); err != nil {
+		return "", err
+	}
+	return net.JoinHostPort(host, strconv.Itoa(int(port[0])<<8|int(port[1]))), nil
+}
+
+func (l *Listener) socks5Auth(conn net.Conn, reader *bufio.Reader) error {
+	ver, err := reader.ReadByte()
+	if err != nil {
+		return err
+	}
+	if ver != 0x01 {
+		return fmt.Errorf("unsupported socks5 auth version %d", ver)
+	}
+	readField := func() (string, error) {
+		size, err := reader.ReadByte()
+		if err != nil {
+			return "", err
+		}
+		field := make([]byte, size)
+		_, err = io.ReadFull(reader, field)
+		return string(field), err
+	}
+	username, err := readField()
+	if err != nil {
+		return err
+	}
+	password, err := readField()
+	if err != nil {
+		return err
+	}
+	if !l.checkProxyAuth(username, password) {
+		conn.Write([]byte{0x01, 0x01})
+		return errProxyAuth
+	}
+	_, err = conn.Write([]byte{0x01, 0x00})
+	return err
+}
+
+func socks5Reply(conn net.Conn, err error) {
+	if errors.Is(err, common.ErrTargetDenied) {
+		socks5ReplyCode(conn, socks5NotAllowed)
+		return
+	}
+	if err != nil {
+		socks5ReplyCode(conn, socks5GeneralFailure)
+		return
+	}
+	socks5ReplyCode(conn, socks5Succeeded)
+}
+
+// 绑定地址对经由隧道的连接没有意义，固定回复0.0.0.0:0
+func socks5ReplyCode(conn net.Conn, code byte) {
+	conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+	conn.Write([]byte{socks5Version, code, 0x00, socks5IPv4, 0, 0, 0, 0, 0, 0})
+	conn.SetWriteDeadline(time.Time{})
+}
+
+func (l *Listener) httpConnectHandshake(conn net.Conn, reader *bufio.Reader) (string, error) {
+	req, err := http.ReadRequest(reader)
+	if err != nil {
+		httpProxyError(conn, http.StatusBadRequest, "")
+		return "", err
+	}
+	if req.Method != http.MethodConnect {
+		httpProxyError(conn, http.StatusMethodNotAllowed, "")
+		return "", fmt.Errorf("unsupported method %s", req.Method)
+	}
+	if l.listenerConfig.Username != "" {
+		username, password, ok := parseProxyAuth(req.Header.Get("Proxy-Authorization"))
+		if !ok || !l.checkProxyAuth(username, password) {
+			httpProxyError(conn, http.StatusProxyAuthRequired, "Proxy-Authenticate: Basic realm=\"veilink\"\r\n")
+			return "", errProxyAuth
+		}
+	}
+	if _, _, err := net.SplitHostPort(req.Host); err != nil {
+		httpProxyError(conn, http.StatusBadRequest, "")
+		return "", err
+	}
+	return req.Host, nil
+}
+
+func parseProxyAuth(auth string) (username, password string, ok bool) {
+	const prefix = "Basic "
+	if len(auth) < len(prefix) || !strings.EqualFold(auth[:len(prefix)], prefix) {
+		return "", "", false
+	}
+	decoded, err := base64.StdEncoding.DecodeString(auth[len(prefix):])
+	if err != nil {
+		return "", "", false
+	}
+	return strings.Cut(string(decoded), ":")
+}
+
+func httpConnectReply(conn net.Conn, err error) {
+	if errors.Is(err, common.ErrTargetDenied) {
+		httpProxyError(conn, http.StatusForbidden, "")
+		return
+	}
+	if err != nil {
+		httpProxyError(conn, http.StatusBadGateway, "")
+		return
+	}
+	conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+	conn.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n"))
+	conn.SetWriteDeadline(time.Time{})
+}
+
+func httpProxyError(conn net.Conn, code int, header string) {
+	conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+	fmt.Fprintf(conn, "HTTP/1.1 %d %s\r\n%sContent-Length: 0\r\nConnection: close\r\n\r\n", code, http.StatusText(code), header)
+	conn.SetWriteDeadline(time.Time{})
+}
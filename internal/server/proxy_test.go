@@ -0,0 +1,153 @@
+package server
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/atopos31/go-veilink/internal/common"
+	"github.com/atopos31/go-veilink/internal/config"
+	"github.com/xtaci/smux"
+)
+
+// proxyClient answers the next stream as the client does after checking the target
+// against its allowlist, and reports the requested target.
+func proxyClient(mux *smux.Session, denied bool) <-chan string {
+	targets := make(chan string, 1)
+	go func() {
+		stream, vp, err := acceptTunnel(mux)
+		if err != nil {
+			return
+		}
+		st := &common.StreamStatus{OK: !denied}
+		if denied {
+			st.Denied = true
+			st.Error = fmt.Sprintf("%v: %s", common.ErrTargetDenied, vp.Target)
+		}
+		st.WriteBinary(stream, common.FrameLong)
+		targets <- vp.Target
+	}()
+	return targets
+}
+
+// proxyConn serves one public proxy connection over a pipe and returns its public end.
+func proxyConn(t *testing.T, l *Listener) net.Conn {
+	t.Helper()
+	serverConn, conn := net.Pipe()
+	remote := &net.TCPAddr{IP: net.IPv4(203, 0, 113, 7), Port: 52311}
+	go l.serveProxy(serverConn, remote, serverConn.LocalAddr())
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+func newProxyListener(t *testing.T) (*Listener, *smux.Session) {
+	t.Helper()
+	l, sm := newTestListener(&config.Listener{PublicProtocol: SOCKS5})
+	return l, connectClient(t, sm, "c1", common.Capabilities)
+}
+
+// socks5Request writes a CONNECT request without authentication and returns the reply code.
+func socks5Request(t *testing.T, conn net.Conn, cmd byte, addr []byte) byte {
+	t.Helper()
+	if _, err := conn.Write([]byte{socks5Version, 1, socks5AuthNone}); err != nil {
+		t.Fatal(err)
+	}
+	method := make([]byte, 2)
+	if _, err := io.ReadFull(conn, method); err != nil || method[1] != socks5AuthNone {
+		t.Fatalf("method %v, %v", method, err)
+	}
+	if _, err := conn.Write(append([]byte{socks5Version, cmd, 0}, addr...)); err != nil {
+		t.Fatal(err)
+	}
+	reply := make([]byte, 10)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		t.Fatal(err)
+	}
+	return reply[1]
+}
+
+func TestSOCKS5Connect(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		addr   []byte
+		target string
+	}{
+		{"ipv4", []byte{socks5IPv4, 10, 0, 0, 1, 0, 80}, "10.0.0.1:80"},
+		{"domain", append(append([]byte{socks5Domain, 11}, "example.com"...), 1, 187), "example.com:443"},
+		{"ipv6", append(append([]byte{socks5IPv6}, net.ParseIP("2001:db8::1")...), 0, 22), "[2001:db8::1]:22"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			l, mux := newProxyListener(t)
+			targets := proxyClient(mux, false)
+			conn := proxyConn(t, l)
+			if code := socks5Request(t, conn, socks5Connect, tc.addr); code != socks5Succeeded {
+				t.Fatalf("reply %d", code)
+			}
+			if target := <-targets; target != tc.target {
+				t.Fatalf("target %s, want %s", target, tc.target)
+			}
+		})
+	}
+}
+
+func TestSOCKS5Refused(t *testing.T) {
+	l, mux := newProxyListener(t)
+	// 客户端的允许列表拒绝目标
+	proxyClient(mux, true)
+	if code := socks5Request(t, proxyConn(t, l), socks5Connect, []byte{socks5IPv4, 10, 0, 0, 1, 0, 80}); code != socks5NotAllowed {
+		t.Fatalf("denied target got reply %d", code)
+	}
+
+	// BIND等命令不支持，不会打开隧道
+	if code := socks5Request(t, proxyConn(t, l), 0x02, []byte{socks5IPv4, 10, 0, 0, 1, 0, 80}); code != socks5CmdNotSupported {
+		t.Fatalf("bind got reply %d", code)
+	}
+
+	// 未配置用户名时只接受无认证
+	conn := proxyConn(t, l)
+	if _, err := conn.Write([]byte{socks5Version, 1, socks5AuthUser}); err != nil {
+		t.Fatal(err)
+	}
+	method := make([]byte, 2)
+	if _, err := io.ReadFull(conn, method); err != nil || method[1] != socks5NoAuth {
+		t.Fatalf("method %v, %v", method, err)
+	}
+}
+
+// httpConnect writes raw as the request and returns the status code of the response.
+func httpConnect(t *testing.T, conn net.Conn, raw string) int {
+	t.Helper()
+	go conn.Write([]byte(raw))
+	resp, err := http.ReadResponse(bufio.NewReader(conn), &http.Request{Method: http.MethodConnect})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+func TestHTTPConnect(t *testing.T) {
+	l, mux := newProxyListener(t)
+	targets := proxyClient(mux, false)
+	conn := proxyConn(t, l)
+	if code := httpConnect(t, conn, "CONNECT example.com:443 HTTP/1.1\r\nHost: example.com:443\r\n\r\n"); code != http.StatusOK {
+		t.Fatalf("got %d", code)
+	}
+	if target := <-targets; target != "example.com:443" {
+		t.Fatalf("target %s", target)
+	}
+
+	proxyClient(mux, true)
+	if code := httpConnect(t, proxyConn(t, l), "CONNECT 10.0.0.1:22 HTTP/1.1\r\nHost: 10.0.0.1:22\r\n\r\n"); code != http.StatusForbidden {
+		t.Fatalf("denied target got %d", code)
+	}
+
+	if code := httpConnect(t, proxyConn(t, l), "CONNECT\r\n\r\n"); code != http.StatusBadRequest {
+		t.Fatalf("malformed request got %d", code)
+	}
+}
@@ -0,0 +1,141 @@
+package server
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/atopos31/go-veilink/internal/common"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	probeWaitTimeout = time.Second * 5  // 等待打洞双方探测包的时间
+	probeExpire      = time.Second * 30 // 探测记录及已签发token的保留时间
+	maxPendingP2P    = 1024             // 同时进行中的打洞请求上限
+)
+
+var (
+	errProbeTimeout   = errors.New("p2p probe timeout")
+	errTooManyPending = errors.New("too many pending p2p requests")
+	errTokenInUse     = errors.New("p2p token already in use")
+)
+
+type probe struct {
+	addr net.Addr
+	at   time.Time
+}
+
+// rendezvous 在gateway的UDP端口上接收打洞双方的探测包，记录各自在公网上的地址。
+// 只记录gateway为签名有效的访问请求签发的token，其他探测包直接丢弃
+type rendezvous struct {
+	conn   net.PacketConn
+	lock   sync.Mutex
+	tokens map[string]time.Time // 已签发的token => 过期时间
+	probes map[string]probe     // token/角色 => 观察到的地址
+}
+
+func newRendezvous(addr string) (*rendezvous, error) {
+	conn, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	r := &rendezvous{
+		conn:   conn,
+		tokens: make(map[string]time.Time),
+		probes: make(map[string]probe),
+	}
+	go r.serve()
+	go r.expireLoop()
+	return r, nil
+}
+
+func probeKey(token string, role byte) string {
+	return token + "/" + string(role)
+}
+
+// issue lets the probes of token be recorded until release or probeExpire.
+func (r *rendezvous) issue(token string) error {
+	if token == "" || len(token) > maxP2PToken {
+		return errors.New("invalid p2p token")
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if _, ok := r.tokens[token]; ok {
+		return errTokenInUse
+	}
+	if len(r.tokens) >= maxPendingP2P {
+		return errTooManyPending
+	}
+	r.tokens[token] = time.Now().Add(probeExpire)
+	return nil
+}
+
+// release forgets the token and the probes recorded for it.
+func (r *rendezvous) release(token string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	delete(r.tokens, token)
+	delete(r.probes, probeKey(token, common.P2PRoleVisitor))
+	delete(r.probes, probeKey(token, common.P2PRoleClient))
+}
+
+func (r *rendezvous) serve() {
+	buf := make([]byte, 512)
+	for {
+		n, addr, err := r.conn.ReadFrom(buf)
+		if err != nil {
+			logrus.Errorf("rendezvous read error: %v", err)
+			return
+		}
+		token, role, ok := common.DecodeP2PProbe(buf[:n])
+		if !ok || len(token) > maxP2PToken || (role != common.P2PRoleVisitor && role != common.P2PRoleClient) {
+			continue
+		}
+		r.lock.Lock()
+		if _, issued := r.tokens[token]; issued {
+			r.probes[probeKey(token, role)] = probe{addr: addr, at: time.Now()}
+		}
+		r.lock.Unlock()
+	}
+}
+
+// expireLoop drops the tokens and probes of requests that never released them.
+func (r *rendezvous) expireLoop() {
+	ticker := time.NewTicker(probeExpire / 2)
+	defer ticker.Stop()
+	for now := range ticker.C {
+		r.lock.Lock()
+		for token, expire := range r.tokens {
+			if now.After(expire) {
+				delete(r.tokens, token)
+			}
+		}
+		for key, p := range r.probes {
+			if now.Sub(p.at) > probeExpire {
+				delete(r.probes, key)
+			}
+		}
+		r.lock.Unlock()
+	}
+}
+
+// wait returns the address the probe of token and role came from.
+func (r *rendezvous) wait(token string, role byte) (net.Addr, error) {
+	deadline := time.Now().Add(probeWaitTimeout)
+	key := probeKey(token, role)
+	for time.Now().Before(deadline) {
+		r.lock.Lock()
+		p, ok := r.probes[key]
+		if ok {
+			delete(r.probes, key)
+		}
+		r.lock.Unlock()
+		if ok {
+			return p.addr, nil
+		}
+		time.Sleep(time.Millisecond * 50)
+	}
+	return nil, errProbeTimeout
+}
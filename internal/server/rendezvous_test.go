@@ -0,0 +1,75 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/atopos31/go-veilink/internal/common"
+)
+
+func TestRendezvousIssuedTokens(t *testing.T) {
+	r, err := newRendezvous("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.conn.Close()
+	conn, err := net.Dial("udp", r.conn.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// 未签发的token及超长的token不会被记录
+	conn.Write(common.EncodeP2PProbe("unknown", common.P2PRoleVisitor))
+	conn.Write(common.EncodeP2PProbe(strings.Repeat("x", maxP2PToken+1), common.P2PRoleVisitor))
+	if err := r.issue(strings.Repeat("x", maxP2PToken+1)); err == nil {
+		t.Fatal("issued an oversized token")
+	}
+	if err := r.issue("t1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.issue("t1"); !errors.Is(err, errTokenInUse) {
+		t.Fatalf("got %v", err)
+	}
+	conn.Write(common.EncodeP2PProbe("t1", common.P2PRoleVisitor))
+	addr, err := r.wait("t1", common.P2PRoleVisitor)
+	if err != nil || addr.String() != conn.LocalAddr().String() {
+		t.Fatalf("got %v, %v", addr, err)
+	}
+	r.lock.Lock()
+	_, recorded := r.probes[probeKey("unknown", common.P2PRoleVisitor)]
+	r.lock.Unlock()
+	if recorded || len(r.probes) != 0 {
+		t.Fatalf("unexpected probes recorded: %v", r.probes)
+	}
+
+	// 释放后的token不再记录探测包
+	r.release("t1")
+	conn.Write(common.EncodeP2PProbe("t1", common.P2PRoleClient))
+	time.Sleep(100 * time.Millisecond)
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if len(r.tokens) != 0 || len(r.probes) != 0 {
+		t.Fatalf("released token kept: %v %v", r.tokens, r.probes)
+	}
+}
+
+func TestRendezvousPendingLimit(t *testing.T) {
+	r := &rendezvous{tokens: make(map[string]time.Time), probes: make(map[string]probe)}
+	for i := 0; i < maxPendingP2P; i++ {
+		if err := r.issue(fmt.Sprint(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := r.issue("full"); !errors.Is(err, errTooManyPending) {
+		t.Fatalf("got %v", err)
+	}
+	r.release("0")
+	if err := r.issue("full"); err != nil {
+		t.Fatal(err)
+	}
+}
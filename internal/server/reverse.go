@@ -0,0 +1,99 @@
+package server
+
+import (
+	"net"
+	"time"
+
+	"github.com/atopos31/go-veilink/internal/common"
+	"github.com/sirupsen/logrus"
+	"github.com/xtaci/smux"
+)
+
+const reverseDialTimeout = time.Second * 5
+
+// setReverseAllow sets the targets the reverse tunnels of the client may reach, nil disables them.
+func (g *Gateway) setReverseAllow(clientID string, rules []string) {
+	if len(rules) == 0 {
+		g.reverseAllow.Delete(clientID)
+		return
+	}
+	allow, err := common.ParseAllowlist(rules)
+	if err != nil {
+		logrus.Errorf("client %s %v, reverse tunnels disabled", clientID, err)
+		g.reverseAllow.Delete(clientID)
+		return
+	}
+	g.reverseAllow.Store(clientID, allow)
+}
+
+// serveReverse accepts the streams the client opens for its reverse tunnels.
+func (g *Gateway) serveReverse(sess *Session) {
+	for {
+		stream, err := sess.Connection.AcceptStream()
+		if err != nil {
+			return
+		}
+		go g.handleReverse(sess.ClientID, sess.Caps.FrameFormat(), stream)
+	}
+}
+
+// handleReverse dials the target requested by the client from the server side,
+// the stream is set up like the ones the server opens: encryption flag, optional chacha20 and the request.
+func (g *Gateway) handleReverse(clientID string, format common.FrameFormat, stream *smux.Stream) {
+	defer stream.Close()
+	var conn common.VeilConn = stream
+	stream.SetReadDeadline(time.Now().Add(handshakeTimeout))
+	enc := &common.EncryptProtocl{}
+	encryptOn, compression, err := enc.Check(stream)
+	if err != nil {
+		logrus.Errorf("client %s reverse stream: %v", clientID, err)
+		return
+	}
+	if encryptOn {
+		key, err := g.listenerMgr.keymap.Get(clientID)
+		if err != nil {
+			logrus.Errorf("client %s reverse stream: %v", clientID, err)
+			return
+		}
+		if conn, err = common.NewChacha20Stream(key, stream); err != nil {
+			logrus.Errorf("client %s reverse stream: %v", clientID, err)
+			return
+		}
+	}
+	if compression != common.CompressionNone {
+		if conn, err = common.NewCompressStream(compression, conn, nil); err != nil {
+			logrus.Errorf("client %s reverse stream: %v", clientID, err)
+			return
+		}
+	}
+	req := &common.ReverseReq{}
+	err = req.Decode(conn)
+	stream.SetReadDeadline(time.Time{})
+	if err != nil {
+		logrus.Errorf("client %s reverse request: %v", clientID, err)
+		return
+	}
+
+	var allow common.Allowlist
+	if v, ok := g.reverseAllow.Load(clientID); ok {
+		allow = v.(common.Allowlist)
+	}
+	addr, err := allow.Resolve(req.Target, reverseDialTimeout)
+	if err != nil {
+		logrus.Warnf("client %s reverse to %s refused: %v", clientID, req.Target, err)
+		sendStreamStatus(conn, err, format)
+		return
+	}
+	targetConn, err := net.DialTimeout("tcp", addr, reverseDialTimeout)
+	if err != nil {
+		logrus.Warnf("client %s reverse to %s fail: %v", clientID, req.Target, err)
+		sendStreamStatus(conn, err, format)
+		return
+	}
+	defer targetConn.Close()
+	if err := sendStreamStatus(conn, nil, format); err != nil {
+		return
+	}
+	in, out := common.Join(targetConn, conn)
+	logrus.Infof("%s reverse => %s in: %d bytes, out: %d bytes", clientID, req.Target, in, out)
+}
@@ -0,0 +1,85 @@
+package server
+
+import (
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/atopos31/go-veilink/internal/common"
+	"github.com/xtaci/smux"
+)
+
+// reverseStream opens a reverse stream to the server as the client does and returns the dial status.
+func reverseStream(t *testing.T, mux *smux.Session, target string) (*smux.Stream, *common.StreamStatus) {
+	t.Helper()
+	stream, err := mux.OpenStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { stream.Close() })
+	buf, _ := (&common.ReverseReq{Target: target}).Encode(common.FrameLong)
+	stream.Write(append((common.EncryptProtocl{}).Encode(false, common.CompressionNone, common.FrameLong), buf...))
+	st := &common.StreamStatus{}
+	stream.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if err := st.Decode(stream); err != nil {
+		t.Fatal(err)
+	}
+	stream.SetReadDeadline(time.Time{})
+	return stream, st
+}
+
+func TestHandleReverse(t *testing.T) {
+	target, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer target.Close()
+	go func() {
+		for {
+			conn, err := target.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+
+	sm := NewSessionManager()
+	g := &Gateway{listenerMgr: NewListenerMgr(sm, NewKeyMap()), sessionMgr: sm}
+	serverConn, clientConn := net.Pipe()
+	serverMux, err := smux.Server(serverConn, smux.DefaultConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer serverMux.Close()
+	mux, err := smux.Client(clientConn, smux.DefaultConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mux.Close()
+	go g.serveReverse(&Session{ClientID: "c1", Connection: serverMux})
+
+	// 未配置reverse_allow时拒绝所有目标
+	if _, st := reverseStream(t, mux, target.Addr().String()); st.OK {
+		t.Fatal("reverse allowed without reverse_allow")
+	}
+	g.setReverseAllow("c1", []string{target.Addr().String()})
+	if _, st := reverseStream(t, mux, "127.0.0.1:1"); st.OK || !strings.Contains(st.Error, "not allowed") {
+		t.Fatalf("got %+v", st)
+	}
+	stream, st := reverseStream(t, mux, target.Addr().String())
+	if !st.OK {
+		t.Fatalf("got %+v", st)
+	}
+	stream.Write([]byte("ping"))
+	buf := make([]byte, 4)
+	stream.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := io.ReadFull(stream, buf); err != nil || string(buf) != "ping" {
+		t.Fatalf("got %q, %v", buf, err)
+	}
+}
@@ -3,6 +3,7 @@ package server
 import (
 	"errors"
 	"net"
+	"slices"
 	"sync"
 	"time"
 
@@ -14,96 +15,155 @@ import (
 var (
 	ErrNotConnected   = errors.New("not connected")
 	ErrClientIsOnline = errors.New("client is online")
+	ErrNoClientOnline = errors.New("no client of the tunnel is online")
 )
 
-type UDPsession struct {
-	RemoteAddr string
-	LocalAddr  string
-	tunnelConn common.VeilConn
-}
+// 新stream在同一客户端的多个会话间的分配方式
+const (
+	BalanceLeastStreams = "least_streams"
+	BalanceRoundRobin   = "round_robin"
+)
 
-// 管理UDP连接
-type UDPSessionManage struct {
-	sessionMu sync.Mutex
-	sessions  map[string]*UDPsession
+// SessionPolicy 单个客户端的会话池策略
+type SessionPolicy struct {
+	MaxSessions int    // 同时保持的会话数上限
+	Replace     bool   // 会话池已满时，新连接替换一个会话而不是被拒绝，见staleSession
+	Balance     string // 新stream的分配方式
 }
 
-func NewUDPSessionManage() *UDPSessionManage {
-	return &UDPSessionManage{
-		sessions: make(map[string]*UDPsession),
-	}
+type Session struct {
+	ClientID   string        // 客户端ID
+	Connection *smux.Session // 双向连接 server <=> client
+	CreatedAt  time.Time
+	Caps       common.Capability // 握手时协商的双方都支持的功能
 }
 
-func (usm *UDPSessionManage) Get(key string) (*UDPsession, error) {
-	usm.sessionMu.Lock()
-	defer usm.sessionMu.Unlock()
+type SessionManager struct {
+	mu        sync.Mutex
+	sessions  map[string][]*Session // 按建立时间排序的会话池
+	policies  map[string]SessionPolicy
+	cursor    map[string]int // round robin 游标
+	accepting map[string]int // 已通过准入、正在回复握手的连接数，计入会话数上限
+	onOffline func(clientID string)
+}
 
-	session, ok := usm.sessions[key]
-	if ok {
-		return session, nil
-	} else {
-		return nil, errors.New("not found")
+func NewSessionManager() *SessionManager {
+	return &SessionManager{
+		sessions:  make(map[string][]*Session),
+		policies:  make(map[string]SessionPolicy),
+		cursor:    make(map[string]int),
+		accepting: make(map[string]int),
 	}
 }
 
-func (usm *UDPSessionManage) Add(key string, session *UDPsession) {
-	usm.sessionMu.Lock()
-	defer usm.sessionMu.Unlock()
+func (sm *SessionManager) SetPolicy(clientID string, policy SessionPolicy) {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	sm.policies[clientID] = policy
+}
 
-	usm.sessions[key] = session
-	go usm.CleanCache(key)
+// OnOffline registers fn to be called when the last session of a client is closed.
+func (sm *SessionManager) OnOffline(fn func(clientID string)) {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	sm.onOffline = fn
 }
 
-func (usm *UDPSessionManage) CleanCache(key string) {
-	tick := time.NewTicker(time.Second * 20)
-	defer tick.Stop()
-	for range tick.C {
-		usm.sessionMu.Lock()
-		usm.sessions[key].tunnelConn.Close()
-		delete(usm.sessions, key)
-		usm.sessionMu.Unlock()
-		break
+func (sm *SessionManager) policy(clientID string) SessionPolicy {
+	policy := sm.policies[clientID]
+	if policy.MaxSessions <= 0 {
+		policy.MaxSessions = 1
 	}
+	return policy
 }
 
-type Session struct {
-	ClientID   string        // 客户端ID
-	Connection *smux.Session // 双向连接 server <=> client
+// GetSessionConnByID opens a stream on one of the client's sessions and returns the capabilities of that session.
+// Sessions that fail to open a stream are dropped from the pool.
+func (sm *SessionManager) GetSessionConnByID(clientID string) (common.VeilConn, common.Capability, error) {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+
+	for len(sm.sessions[clientID]) > 0 {
+		sess := sm.pick(clientID)
+		stream, err := sess.Connection.OpenStream()
+		if err == nil {
+			return stream, sess.Caps, nil
+		}
+		logrus.Warnf("client %s session open stream fail: %v", clientID, err)
+		sess.Connection.Close()
+		sm.remove(sess)
+	}
+	return nil, 0, ErrNotConnected
 }
 
-type SessionManager struct {
-	mu       sync.Mutex
-	sessions map[string]*Session
+func (sm *SessionManager) pick(clientID string) *Session {
+	pool := sm.sessions[clientID]
+	if sm.policy(clientID).Balance == BalanceRoundRobin {
+		sm.cursor[clientID] = (sm.cursor[clientID] + 1) % len(pool)
+		return pool[sm.cursor[clientID]]
+	}
+	best := pool[0]
+	for _, sess := range pool[1:] {
+		if sess.Connection.NumStreams() < best.Connection.NumStreams() {
+			best = sess
+		}
+	}
+	return best
 }
 
-func NewSessionManager() *SessionManager {
-	return &SessionManager{
-		sessions: make(map[string]*Session),
+func (sm *SessionManager) remove(sess *Session) {
+	sm.sessions[sess.ClientID] = slices.DeleteFunc(sm.sessions[sess.ClientID], func(s *Session) bool {
+		return s == sess
+	})
+	if len(sm.sessions[sess.ClientID]) == 0 {
+		delete(sm.sessions, sess.ClientID)
+		delete(sm.cursor, sess.ClientID)
 	}
 }
 
-func (sm *SessionManager) GetSessionConnByID(clientID string) (common.VeilConn, error) {
+func (sm *SessionManager) IsOnline(clientID string) bool {
 	sm.mu.Lock()
 	defer sm.mu.Unlock()
+	return len(sm.sessions[clientID]) > 0
+}
 
-	sess := sm.sessions[clientID]
-	if sess == nil {
-		return nil, ErrNotConnected
-	}
-	return sess.Connection.OpenStream()
+// IsOnlineOrAdmitting reports whether the client has a session or a handshake that passed
+// admission and may still add one.
+func (sm *SessionManager) IsOnlineOrAdmitting(clientID string) bool {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	return len(sm.sessions[clientID]) > 0 || sm.accepting[clientID] > 0
 }
 
-func (sm *SessionManager) AddSession(clientID string, conn net.Conn) (*Session, error) {
+func (sm *SessionManager) SessionCount(clientID string) int {
 	sm.mu.Lock()
 	defer sm.mu.Unlock()
+	return len(sm.sessions[clientID])
+}
 
-	oldsess := sm.sessions[clientID]
-	if oldsess != nil {
-		return nil, ErrClientIsOnline
+// AddSession admits a new session of the client and starts serving it on conn.
+// The admission is decided under sm.mu, so concurrent handshakes can not both take the
+// last slot; the slot stays reserved while accept replies to the client outside the lock.
+// ErrClientIsOnline means the client was not admitted and accept was not called.
+func (sm *SessionManager) AddSession(clientID string, conn net.Conn, smuxconfig *smux.Config, caps common.Capability, accept func() error) (*Session, error) {
+	sm.mu.Lock()
+	if err := sm.admit(clientID); err != nil {
+		sm.mu.Unlock()
+		return nil, err
+	}
+	sm.accepting[clientID]++
+	sm.mu.Unlock()
+
+	err := accept()
+
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	if sm.accepting[clientID]--; sm.accepting[clientID] == 0 {
+		delete(sm.accepting, clientID)
+	}
+	if err != nil {
+		return nil, err
 	}
-	smuxconfig := smux.DefaultConfig()
-	smuxconfig.KeepAliveInterval = 1 * time.Second
-	smuxconfig.KeepAliveTimeout = 2 * time.Second
 	muxsess, err := smux.Server(conn, smuxconfig)
 	if err != nil {
 		return nil, err
@@ -112,18 +172,64 @@ func (sm *SessionManager) AddSession(clientID string, conn net.Conn) (*Session,
 	sess := &Session{
 		ClientID:   clientID,
 		Connection: muxsess,
+		CreatedAt:  time.Now(),
+		Caps:       caps,
 	}
-	go sm.CheckAlive(clientID)
-	sm.sessions[clientID] = sess
+	go sm.CheckAlive(sess)
+	sm.sessions[clientID] = append(sm.sessions[clientID], sess)
 	return sess, nil
 }
 
-// 检测到客户端离线后删除session
-func (sm *SessionManager) CheckAlive(clientID string) {
-	logrus.Debugf("client %s start online", clientID)
-	<-sm.sessions[clientID].Connection.CloseChan()
+// admit makes room for one more session of the client, replacing a session when the policy allows it.
+func (sm *SessionManager) admit(clientID string) error {
+	policy := sm.policy(clientID)
+	if len(sm.sessions[clientID])+sm.accepting[clientID] < policy.MaxSessions {
+		return nil
+	}
+	if !policy.Replace || len(sm.sessions[clientID]) == 0 {
+		return ErrClientIsOnline
+	}
+	oldsess := staleSession(sm.sessions[clientID])
+	if oldsess == nil {
+		return ErrClientIsOnline
+	}
+	logrus.Infof("client %s replace session created at %v", clientID, oldsess.CreatedAt)
+	oldsess.Connection.Close()
+	sm.remove(oldsess)
+	return nil
+}
+
+// staleSession picks the session a new connection replaces: a session already closed by a failed
+// keepalive, then the oldest session without streams. It returns nil when every session carries
+// streams, replacing one of them would drop connections that are still in use.
+func staleSession(sessions []*Session) *Session {
+	for _, sess := range sessions {
+		if sess.Connection.IsClosed() {
+			return sess
+		}
+	}
+	for _, sess := range sessions {
+		if sess.Connection.NumStreams() == 0 {
+			return sess
+		}
+	}
+	return nil
+}
+
+// 检测到会话断开后将其移出会话池
+func (sm *SessionManager) CheckAlive(sess *Session) {
+	logrus.Debugf("client %s start online", sess.ClientID)
+	<-sess.Connection.CloseChan()
 	sm.mu.Lock()
-	defer sm.mu.Unlock()
-	delete(sm.sessions, clientID)
-	logrus.Debugf("client %s is offline", clientID)
+	sm.remove(sess)
+	// 被替换的会话关闭时新连接还在握手，客户端并未离线
+	offline := len(sm.sessions[sess.ClientID]) == 0 && sm.accepting[sess.ClientID] == 0
+	onOffline := sm.onOffline
+	sm.mu.Unlock()
+	if offline {
+		logrus.Debugf("client %s is offline", sess.ClientID)
+		if onOffline != nil {
+			onOffline(sess.ClientID)
+		}
+	}
 }
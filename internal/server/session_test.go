@@ -0,0 +1,143 @@
+package server
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"testing"
+
+	"github.com/xtaci/smux"
+)
+
+func TestAddSessionConcurrentAdmission(t *testing.T) {
+	sm := NewSessionManager()
+	sm.SetPolicy("c1", SessionPolicy{MaxSessions: 1})
+
+	// 两个握手同时通过准入时，只有一个能占用唯一的会话名额
+	replying := make(chan struct{}, 2)
+	release := make(chan struct{})
+	var wg sync.WaitGroup
+	errs := make([]error, 2)
+	accepted := make([]bool, 2)
+	for i := range errs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			serverConn, clientConn := net.Pipe()
+			t.Cleanup(func() { clientConn.Close() })
+			_, errs[i] = sm.AddSession("c1", serverConn, smux.DefaultConfig(), 0, func() error {
+				accepted[i] = true
+				replying <- struct{}{}
+				<-release
+				return nil
+			})
+		}(i)
+	}
+	<-replying
+	close(release)
+	wg.Wait()
+
+	if accepted[0] == accepted[1] {
+		t.Fatalf("accepted %v", accepted)
+	}
+	for i, err := range errs {
+		if accepted[i] != (err == nil) {
+			t.Fatalf("handshake %d: accepted %v, err %v", i, accepted[i], err)
+		}
+		if err != nil && !errors.Is(err, ErrClientIsOnline) {
+			t.Fatalf("got %v", err)
+		}
+	}
+	if n := sm.SessionCount("c1"); n != 1 {
+		t.Fatalf("%d sessions", n)
+	}
+}
+
+func TestAddSessionReplyFailed(t *testing.T) {
+	sm := NewSessionManager()
+	sm.SetPolicy("c1", SessionPolicy{MaxSessions: 1})
+	serverConn, clientConn := net.Pipe()
+	defer clientConn.Close()
+	if _, err := sm.AddSession("c1", serverConn, smux.DefaultConfig(), 0, func() error { return net.ErrClosed }); !errors.Is(err, net.ErrClosed) {
+		t.Fatalf("got %v", err)
+	}
+	// 回复失败的连接释放占用的名额
+	serverConn, clientConn = net.Pipe()
+	defer clientConn.Close()
+	if _, err := sm.AddSession("c1", serverConn, smux.DefaultConfig(), 0, func() error { return nil }); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// addTestSession adds a session of c1 served by a smux client on the other end of a pipe.
+func addTestSession(t *testing.T, sm *SessionManager) *Session {
+	t.Helper()
+	serverConn, clientConn := net.Pipe()
+	sess, err := sm.AddSession("c1", serverConn, smux.DefaultConfig(), 0, func() error { return nil })
+	if err != nil {
+		t.Fatal(err)
+	}
+	mux, err := smux.Client(clientConn, smux.DefaultConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { mux.Close() })
+	go func() {
+		for {
+			if _, err := mux.AcceptStream(); err != nil {
+				return
+			}
+		}
+	}()
+	return sess
+}
+
+func TestAddSessionReplace(t *testing.T) {
+	sm := NewSessionManager()
+	sm.SetPolicy("c1", SessionPolicy{MaxSessions: 2, Replace: true})
+	busy := addTestSession(t, sm)
+	idle := addTestSession(t, sm)
+	if _, err := busy.Connection.OpenStream(); err != nil {
+		t.Fatal(err)
+	}
+
+	// 空闲的会话先于最早建立但仍在使用的会话被替换
+	addTestSession(t, sm)
+	if !idle.Connection.IsClosed() || busy.Connection.IsClosed() {
+		t.Fatal("the idle session was not replaced")
+	}
+	if n := sm.SessionCount("c1"); n != 2 {
+		t.Fatalf("%d sessions", n)
+	}
+}
+
+func TestAddSessionBusyPool(t *testing.T) {
+	sm := NewSessionManager()
+	sm.SetPolicy("c1", SessionPolicy{MaxSessions: 2, Replace: true})
+	pool := []*Session{addTestSession(t, sm), addTestSession(t, sm)}
+	for _, sess := range pool {
+		if _, err := sess.Connection.OpenStream(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// 会话都在使用时拒绝新连接，而不是断开正在使用的会话
+	serverConn, clientConn := net.Pipe()
+	defer clientConn.Close()
+	accepted := false
+	_, err := sm.AddSession("c1", serverConn, smux.DefaultConfig(), 0, func() error {
+		accepted = true
+		return nil
+	})
+	if !errors.Is(err, ErrClientIsOnline) || accepted {
+		t.Fatalf("busy pool admitted a session: %v", err)
+	}
+	for _, sess := range pool {
+		if sess.Connection.IsClosed() {
+			t.Fatal("a busy session was replaced")
+		}
+	}
+	if n := sm.SessionCount("c1"); n != 2 {
+		t.Fatalf("%d sessions", n)
+	}
+}
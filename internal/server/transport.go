@@ -0,0 +1,41 @@
+package server
+
+import (
+	"errors"
+	"net"
+
+	"github.com/atopos31/go-veilink/internal/common"
+	"github.com/sirupsen/logrus"
+)
+
+// serve accepts the connections of one transport and hands them to the handshake.
+func (g *Gateway) serve(ln net.Listener, transport string) {
+	logrus.Debugf("Gateway %s is running on %s", transport, ln.Addr())
+	go func() {
+		defer ln.Close()
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				if errors.Is(err, net.ErrClosed) {
+					return
+				}
+				logrus.Errorf("failed to accept %s connection %v", transport, err)
+				continue
+			}
+			logrus.Debugf("accept %s connection from %s", transport, conn.RemoteAddr())
+			go g.handleConn(conn)
+		}
+	}()
+}
+
+// gateway的UDP端口用于打洞协商，kcp需使用其他端口
+func (g *Gateway) listenKCP() (net.Listener, error) {
+	addr := g.kcp.Addr
+	if addr == "" {
+		return nil, errors.New("gateway kcp requires addr")
+	}
+	if addr == g.addr {
+		return nil, errors.New("gateway kcp addr must differ from the gateway, its udp port is used for p2p")
+	}
+	return common.ListenKCP(addr, g.kcp.DataShards, g.kcp.ParityShards)
+}
@@ -0,0 +1,262 @@
+package server
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/atopos31/go-veilink/internal/common"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	defaultUDPIdleTimeout = time.Second * 60
+	maxPendingUDPPackets  = 16 // 连接客户端期间每个流最多暂存的数据包
+)
+
+var (
+	errUDPFlowPending = errors.New("udp flow is still connecting, packet dropped")
+	errUDPFlowClosed  = errors.New("udp flow closed")
+)
+
+// udpFlow 一个公网来源地址对应的UDP流，独占一个到客户端的stream或复用隧道的udpMux
+// 流先加入流表再连接客户端，连接完成前收到的数据包暂存在pending中
+type udpFlow struct {
+	key        string // 流表中的键
+	remoteAddr net.Addr
+	lastActive atomic.Int64
+	closeOnce  sync.Once
+
+	mu      sync.Mutex
+	ready   bool // 以下字段在ready之后不再改变
+	closed  bool
+	pending [][]byte
+
+	clientID   string
+	tunnelConn common.VeilConn // 独占stream模式
+	writer     *common.UDPFrameWriter
+	mux        *udpMux // 复用stream模式
+	id         uint32
+	onClose    func()
+
+	// 复用stream模式下每个数据包复用的datagram，来源地址只随第一个数据包发送。
+	// 写入在attach持锁发送暂存数据包之后才会发生，同一时刻只有一个写入者
+	dg common.UDPDatagram
+}
+
+func newUDPFlow(key string, remoteAddr net.Addr) *udpFlow {
+	flow := &udpFlow{
+		key:        key,
+		remoteAddr: remoteAddr,
+	}
+	flow.touch()
+	return flow
+}
+
+// attach connects the flow to its client and sends the packets queued meanwhile.
+// It fails when the flow was closed before the client was reached.
+func (f *udpFlow) attach(clientID string, tunnelConn common.VeilConn, mux *udpMux, id uint32, onClose func()) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.closed {
+		return errUDPFlowClosed
+	}
+	f.clientID = clientID
+	f.tunnelConn = tunnelConn
+	if tunnelConn != nil {
+		f.writer = common.NewUDPFrameWriter(tunnelConn, writeTimeout)
+	}
+	f.mux = mux
+	f.id = id
+	if mux != nil {
+		f.dg = common.UDPDatagram{FlowID: id, Addr: f.remoteAddr.String()}
+	}
+	f.onClose = onClose
+	f.ready = true
+	// 持有锁发送，保证暂存的数据包先于之后的数据包
+	for _, p := range f.pending {
+		if _, err := f.write(p); err != nil {
+			logrus.Debugf("udp flow %s send queued packet fail: %v", f.remoteAddr, err)
+		}
+	}
+	f.pending = nil
+	return nil
+}
+
+// touch records traffic in either direction.
+func (f *udpFlow) touch() {
+	f.lastActive.Store(time.Now().UnixNano())
+}
+
+func (f *udpFlow) idle(now time.Time) time.Duration {
+	return now.Sub(time.Unix(0, f.lastActive.Load()))
+}
+
+// Write sends one datagram from the public side to the client, or queues a copy
+// while the flow is still connecting.
+func (f *udpFlow) Write(p []byte) (int, error) {
+	f.mu.Lock()
+	if !f.ready {
+		defer f.mu.Unlock()
+		if f.closed {
+			return 0, errUDPFlowClosed
+		}
+		if len(p) > common.MaxUDPPayload {
+			return 0, common.ErrDatagramSize
+		}
+		if len(f.pending) >= maxPendingUDPPackets {
+			return 0, errUDPFlowPending
+		}
+		f.pending = append(f.pending, append([]byte(nil), p...))
+		return len(p), nil
+	}
+	f.mu.Unlock()
+	return f.write(p)
+}
+
+func (f *udpFlow) write(p []byte) (int, error) {
+	if f.mux != nil {
+		f.dg.Data = p
+		n, err := f.mux.writer.WriteDatagram(&f.dg)
+		f.dg.Data = nil
+		if err == nil {
+			f.dg.Addr = ""
+		}
+		return n, err
+	}
+	return f.writer.WritePacket(p)
+}
+
+func (f *udpFlow) Close() {
+	f.closeOnce.Do(func() {
+		f.mu.Lock()
+		f.closed = true
+		f.pending = nil
+		ready := f.ready
+		f.mu.Unlock()
+		if !ready {
+			return
+		}
+		if f.mux != nil {
+			f.mux.closeFlow(f)
+		} else {
+			f.tunnelConn.Close()
+		}
+		if f.onClose != nil {
+			f.onClose()
+		}
+	})
+}
+
+// udpFlowTable 单个UDP隧道的流表，按来源地址索引，空闲超时后回收
+type udpFlowTable struct {
+	mu          sync.Mutex
+	flows       map[string]*udpFlow
+	idleTimeout time.Duration
+	maxFlows    int // 0 表示不限制
+	rejected    atomic.Int64
+	done        chan struct{}
+	closeOnce   sync.Once
+}
+
+func newUDPFlowTable(idleTimeout time.Duration, maxFlows int) *udpFlowTable {
+	if idleTimeout <= 0 {
+		idleTimeout = defaultUDPIdleTimeout
+	}
+	t := &udpFlowTable{
+		flows:       make(map[string]*udpFlow),
+		idleTimeout: idleTimeout,
+		maxFlows:    maxFlows,
+		done:        make(chan struct{}),
+	}
+	go t.expireLoop()
+	return t
+}
+
+func (t *udpFlowTable) Get(key string) *udpFlow {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.flows[key]
+}
+
+// Admit reports whether a new flow may be created, counting the rejection if not.
+func (t *udpFlowTable) Admit() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.maxFlows > 0 && len(t.flows) >= t.maxFlows {
+		t.rejected.Add(1)
+		return false
+	}
+	return true
+}
+
+func (t *udpFlowTable) Add(key string, flow *udpFlow) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.flows[key] = flow
+}
+
+// Remove closes the flow and deletes it if it is still the one stored under key.
+func (t *udpFlowTable) Remove(key string, flow *udpFlow) {
+	t.mu.Lock()
+	if t.flows[key] == flow {
+		delete(t.flows, key)
+	}
+	t.mu.Unlock()
+	flow.Close()
+}
+
+func (t *udpFlowTable) Len() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return len(t.flows)
+}
+
+func (t *udpFlowTable) Rejected() int64 {
+	return t.rejected.Load()
+}
+
+func (t *udpFlowTable) expireLoop() {
+	interval := t.idleTimeout / 2
+	if interval < time.Second {
+		interval = time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-t.done:
+			return
+		case now := <-ticker.C:
+			var expired []*udpFlow
+			t.mu.Lock()
+			for key, flow := range t.flows {
+				if flow.idle(now) >= t.idleTimeout {
+					delete(t.flows, key)
+					expired = append(expired, flow)
+				}
+			}
+			t.mu.Unlock()
+			for _, flow := range expired {
+				logrus.Debugf("udp flow %s idle timeout", flow.remoteAddr)
+				flow.Close()
+			}
+		}
+	}
+}
+
+// Close stops the expiry loop and closes every flow.
+func (t *udpFlowTable) Close() {
+	t.closeOnce.Do(func() {
+		close(t.done)
+		t.mu.Lock()
+		flows := t.flows
+		t.flows = make(map[string]*udpFlow)
+		t.mu.Unlock()
+		for _, flow := range flows {
+			flow.Close()
+		}
+	})
+}
@@ -0,0 +1,114 @@
+package server
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/atopos31/go-veilink/internal/common"
+)
+
+func TestUDPFlowTableCap(t *testing.T) {
+	table := newUDPFlowTable(time.Minute, 2)
+	defer table.Close()
+	addr := &net.UDPAddr{IP: net.IPv4(203, 0, 113, 7), Port: 4000}
+	for _, key := range []string{"a", "b"} {
+		if !table.Admit() {
+			t.Fatalf("flow %s rejected", key)
+		}
+		table.Add(key, newUDPFlow(key, addr))
+	}
+	if table.Admit() || table.Rejected() != 1 {
+		t.Fatalf("flow over the cap admitted, rejected %d", table.Rejected())
+	}
+
+	// 只删除仍在表中的同一个流，已被替换的旧流不影响新流
+	old := table.Get("a")
+	table.Add("a", newUDPFlow("a", addr))
+	table.Remove("a", old)
+	if table.Get("a") == nil || table.Len() != 2 {
+		t.Fatal("replaced flow removed the new one")
+	}
+	table.Remove("a", table.Get("a"))
+	if !table.Admit() {
+		t.Fatal("removed flow still counted")
+	}
+}
+
+func TestUDPFlowTableIdleExpiry(t *testing.T) {
+	table := newUDPFlowTable(10*time.Millisecond, 0)
+	defer table.Close()
+	flow := newUDPFlow("a", &net.UDPAddr{IP: net.IPv4(203, 0, 113, 7), Port: 4000})
+	table.Add("a", flow)
+
+	deadline := time.Now().Add(3 * time.Second)
+	for table.Len() > 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("idle flow not expired")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	if _, err := flow.Write([]byte("late")); !errors.Is(err, errUDPFlowClosed) {
+		t.Fatalf("expired flow not closed: %v", err)
+	}
+}
+
+func TestUDPFlowPendingLimit(t *testing.T) {
+	flow := newUDPFlow("a", &net.UDPAddr{IP: net.IPv4(203, 0, 113, 7), Port: 4000})
+	for i := 0; i < maxPendingUDPPackets; i++ {
+		if _, err := flow.Write([]byte("queued")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := flow.Write([]byte("dropped")); !errors.Is(err, errUDPFlowPending) {
+		t.Fatalf("got %v", err)
+	}
+	flow.Close()
+	if err := flow.attach("c1", nil, nil, 0, nil); !errors.Is(err, errUDPFlowClosed) {
+		t.Fatalf("closed flow attached: %v", err)
+	}
+}
+
+// bufferConn 把写入的帧留在缓冲区中的stream
+type bufferConn struct {
+	bytes.Buffer
+}
+
+func (c *bufferConn) Close() error                     { return nil }
+func (c *bufferConn) SetReadDeadline(time.Time) error  { return nil }
+func (c *bufferConn) SetWriteDeadline(time.Time) error { return nil }
+
+func TestUDPFlowMuxWrite(t *testing.T) {
+	conn := &bufferConn{}
+	flow := newUDPFlow("a", &net.UDPAddr{IP: net.IPv4(203, 0, 113, 7), Port: 4000})
+	if err := flow.attach("c1", nil, newUDPMux("c1", conn), 1, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// 来源地址只随第一个数据包发送
+	dg := common.UDPDatagram{}
+	for i, want := range []string{"203.0.113.7:4000", ""} {
+		if _, err := flow.Write([]byte("ping")); err != nil {
+			t.Fatal(err)
+		}
+		if err := dg.Decode(conn); err != nil {
+			t.Fatal(err)
+		}
+		if dg.FlowID != 1 || dg.Addr != want || string(dg.Data) != "ping" {
+			t.Fatalf("datagram %d: %+v", i, dg)
+		}
+	}
+
+	payload := make([]byte, 1200)
+	allocs := testing.AllocsPerRun(100, func() {
+		conn.Reset()
+		if _, err := flow.Write(payload); err != nil {
+			t.Fatal(err)
+		}
+	})
+	if allocs != 0 {
+		t.Fatalf("%v allocs per datagram", allocs)
+	}
+}
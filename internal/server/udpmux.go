@@ -0,0 +1,122 @@
+package server
+
+import (
+	"errors"
+	"io"
+	"net"
+	"sync"
+
+	"github.com/atopos31/go-veilink/internal/common"
+	"github.com/sirupsen/logrus"
+)
+
+// udpMux 复用同一个stream承载隧道到某个客户端的所有UDP流
+type udpMux struct {
+	clientID string
+	conn     common.VeilConn
+	writer   *common.UDPFrameWriter
+	mu       sync.Mutex
+	flows    map[uint32]*udpFlow
+	nextID   uint32
+	done     chan struct{}
+	doneOnce sync.Once
+}
+
+func newUDPMux(clientID string, conn common.VeilConn) *udpMux {
+	return &udpMux{
+		clientID: clientID,
+		conn:     conn,
+		writer:   common.NewUDPFrameWriter(conn, writeTimeout),
+		flows:    make(map[uint32]*udpFlow),
+		done:     make(chan struct{}),
+	}
+}
+
+func (m *udpMux) alive() bool {
+	select {
+	case <-m.done:
+		return false
+	default:
+		return true
+	}
+}
+
+// addFlow attaches the flow to the mux under a new flow id.
+func (m *udpMux) addFlow(flow *udpFlow, onClose func()) error {
+	m.mu.Lock()
+	m.nextID++
+	id := m.nextID
+	m.flows[id] = flow
+	m.mu.Unlock()
+	if err := flow.attach(m.clientID, nil, m, id, onClose); err != nil {
+		m.mu.Lock()
+		delete(m.flows, id)
+		m.mu.Unlock()
+		return err
+	}
+	return nil
+}
+
+// closeFlow unregisters the flow and tells the client to release its local socket.
+func (m *udpMux) closeFlow(flow *udpFlow) {
+	m.mu.Lock()
+	delete(m.flows, flow.id)
+	m.mu.Unlock()
+	if m.alive() {
+		m.writer.WriteDatagram(&common.UDPDatagram{FlowID: flow.id, Close: true})
+	}
+}
+
+// readLoop delivers the client's replies to the public side until the stream fails,
+// then drops every flow that was using it.
+func (m *udpMux) readLoop(l *Listener, pc net.PacketConn) {
+	defer m.close(l)
+	// 数据包在下一次解码前已同步写出，整个循环复用同一个缓冲区
+	dg := common.UDPDatagram{}
+	for {
+		err := dg.Decode(m.conn)
+		if errors.Is(err, common.ErrDatagramSize) {
+			l.udpOversized.Add(1)
+			continue
+		}
+		if err != nil {
+			if !errors.Is(err, io.EOF) && !errors.Is(err, io.ErrClosedPipe) {
+				logrus.Warnf("decode udp datagram fail: %v", err)
+			}
+			return
+		}
+		m.mu.Lock()
+		flow := m.flows[dg.FlowID]
+		m.mu.Unlock()
+		if flow == nil {
+			continue
+		}
+		if dg.Close {
+			l.udpFlows.Remove(flow.key, flow)
+			continue
+		}
+		n, err := pc.WriteTo(dg.Data, flow.remoteAddr)
+		if err != nil {
+			logrus.Warnf("write udp packet fail: %v", err)
+			continue
+		}
+		flow.touch()
+		l.ioData.AddOutput(int64(n))
+	}
+}
+
+func (m *udpMux) close(l *Listener) {
+	m.doneOnce.Do(func() {
+		close(m.done)
+		m.conn.Close()
+	})
+	m.mu.Lock()
+	flows := make([]*udpFlow, 0, len(m.flows))
+	for _, flow := range m.flows {
+		flows = append(flows, flow)
+	}
+	m.mu.Unlock()
+	for _, flow := range flows {
+		l.udpFlows.Remove(flow.key, flow)
+	}
+}
@@ -0,0 +1,100 @@
+package server
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/atopos31/go-veilink/internal/common"
+	"github.com/atopos31/go-veilink/internal/config"
+)
+
+func TestUDPMuxRoutesFlows(t *testing.T) {
+	l, sm := newTestListener(&config.Listener{
+		PublicProtocol: UDP,
+		PublicIP:       "127.0.0.1",
+		InternalIP:     "127.0.0.1",
+		InternalPort:   53,
+		UDPMux:         true,
+	})
+	mux := connectClient(t, sm, "c1", common.Capabilities)
+	if err := l.ListenAndServe(); err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	public := l.listeners[0].(net.PacketConn).LocalAddr().String()
+
+	// 所有来源共用一个stream，客户端按流ID回复
+	streams := make(chan int, 4)
+	closed := make(chan uint32, 1)
+	go func() {
+		for {
+			stream, vp, err := acceptTunnel(mux)
+			if err != nil {
+				return
+			}
+			if !vp.UDPMux {
+				stream.Close()
+				continue
+			}
+			streams <- 1
+			writeStatus(stream, "")
+			go func() {
+				w := common.NewUDPFrameWriter(stream, time.Second)
+				for {
+					dg := common.UDPDatagram{}
+					if err := dg.Decode(stream); err != nil {
+						return
+					}
+					if string(dg.Data) == "bye" {
+						w.WriteDatagram(&common.UDPDatagram{FlowID: dg.FlowID, Close: true})
+						closed <- dg.FlowID
+						continue
+					}
+					w.WriteDatagram(&common.UDPDatagram{FlowID: dg.FlowID, Data: append([]byte("re: "), dg.Data...)})
+				}
+			}()
+		}
+	}()
+
+	read := func(conn net.Conn) string {
+		conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		buf := make([]byte, 64)
+		n, err := conn.Read(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(buf[:n])
+	}
+	var conns []net.Conn
+	for _, msg := range []string{"a", "b"} {
+		conn, err := net.Dial("udp", public)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		conn.Write([]byte(msg))
+		if got := read(conn); got != "re: "+msg {
+			t.Fatalf("got %q", got)
+		}
+		conns = append(conns, conn)
+	}
+	if len(streams) != 1 || l.udpFlows.Len() != 2 {
+		t.Fatalf("%d streams, %d flows", len(streams), l.udpFlows.Len())
+	}
+
+	// 客户端关闭一个流后，服务端回收该流，其他流不受影响
+	conns[0].Write([]byte("bye"))
+	<-closed
+	deadline := time.Now().Add(2 * time.Second)
+	for l.udpFlows.Len() != 1 {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d flows after close", l.udpFlows.Len())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	conns[1].Write([]byte("c"))
+	if got := read(conns[1]); got != "re: c" {
+		t.Fatalf("got %q", got)
+	}
+}
@@ -0,0 +1,120 @@
+package server
+
+import (
+	"net"
+	"net/http"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+	"golang.org/x/net/websocket"
+)
+
+const defaultWebSocketPath = "/veilink"
+
+// wsConn 经WebSocket连接的客户端，地址取自HTTP请求，关闭后通知处理函数返回
+type wsConn struct {
+	*websocket.Conn
+	remote    net.Addr
+	local     net.Addr
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+func (c *wsConn) RemoteAddr() net.Addr { return c.remote }
+func (c *wsConn) LocalAddr() net.Addr  { return c.local }
+
+func (c *wsConn) Close() error {
+	c.closeOnce.Do(func() { close(c.closed) })
+	return c.Conn.Close()
+}
+
+// WebSocketPath returns the path of the websocket entry of the gateway.
+func (g *Gateway) WebSocketPath() string {
+	if g.websocket == nil || g.websocket.Path == "" {
+		return defaultWebSocketPath
+	}
+	return g.websocket.Path
+}
+
+// WebSocketHandler accepts clients and visitors over websocket, the connection then
+// carries the same handshake and smux session as a TCP connection to the gateway.
+func (g *Gateway) WebSocketHandler() http.Handler {
+	return websocket.Server{
+		// 客户端不是浏览器，不检查Origin
+		Handshake: func(*websocket.Config, *http.Request) error { return nil },
+		Handler:   g.serveWebSocket,
+	}
+}
+
+func (g *Gateway) serveWebSocket(ws *websocket.Conn) {
+	ws.PayloadType = websocket.BinaryFrame
+	req := ws.Request()
+	conn := &wsConn{Conn: ws, remote: parseTCPAddr(req.RemoteAddr), local: &net.TCPAddr{}, closed: make(chan struct{})}
+	if local, ok := req.Context().Value(http.LocalAddrContextKey).(net.Addr); ok {
+		conn.local = local
+	}
+	select {
+	case g.ws.conns <- conn:
+	case <-g.ws.done:
+		return
+	}
+	// 处理函数返回后连接即被关闭，需等到会话结束
+	<-conn.closed
+}
+
+// wsListener 将WebSocket处理函数收到的连接交给gateway的accept循环
+type wsListener struct {
+	conns     chan net.Conn
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func newWSListener() *wsListener {
+	return &wsListener{conns: make(chan net.Conn), done: make(chan struct{})}
+}
+
+func (l *wsListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *wsListener) Close() error {
+	l.closeOnce.Do(func() { close(l.done) })
+	return nil
+}
+
+func (l *wsListener) Addr() net.Addr {
+	return wsAddr{}
+}
+
+type wsAddr struct{}
+
+func (wsAddr) Network() string { return "websocket" }
+func (wsAddr) String() string  { return "websocket" }
+
+// 单独监听的WebSocket入口，未配置addr时由webui提供
+func (g *Gateway) listenWebSocket() error {
+	conf := g.websocket
+	ln, err := net.Listen("tcp", conf.Addr)
+	if err != nil {
+		return err
+	}
+	mux := http.NewServeMux()
+	mux.Handle(g.WebSocketPath(), g.WebSocketHandler())
+	server := &http.Server{Handler: mux, ReadHeaderTimeout: handshakeTimeout}
+	go func() {
+		var err error
+		if conf.CertFile != "" {
+			err = server.ServeTLS(ln, conf.CertFile, conf.KeyFile)
+		} else {
+			err = server.Serve(ln)
+		}
+		logrus.Errorf("websocket gateway stopped: %v", err)
+	}()
+	logrus.Debugf("Gateway websocket is listening on %s%s", conf.Addr, g.WebSocketPath())
+	return nil
+}
@@ -0,0 +1,44 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/atopos31/go-veilink/internal/common"
+	"github.com/atopos31/go-veilink/internal/config"
+	"golang.org/x/net/websocket"
+)
+
+func TestWebSocketHandlerReturns(t *testing.T) {
+	sm := NewSessionManager()
+	g := NewGateway(config.Gateway{WebSocket: &config.WebSocket{}}, NewListenerMgr(sm, NewKeyMap()), sm)
+	g.serve(g.ws, "websocket")
+	defer g.ws.Close()
+	returned := make(chan struct{}, 4)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		g.WebSocketHandler().ServeHTTP(w, r)
+		returned <- struct{}{}
+	}))
+	defer srv.Close()
+	wsURL := "ws" + strings.TrimPrefix(srv.URL, "http") + defaultWebSocketPath
+
+	// 被拒绝的握手及无法解析的请求都会关闭连接，处理函数随之返回
+	refused, _ := (&common.HandshakeReq{ClientID: "missing", Version: common.ProtocolVersion}).Encode()
+	for _, payload := range [][]byte{refused, {0x01, 0xff, 0, 0}} {
+		ws, err := websocket.Dial(wsURL, "", srv.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ws.PayloadType = websocket.BinaryFrame
+		ws.Write(payload)
+		select {
+		case <-returned:
+		case <-time.After(2 * time.Second):
+			t.Fatalf("handler did not return for %x", payload)
+		}
+		ws.Close()
+	}
+}